@@ -1,13 +1,15 @@
-// Echo server using mangos REP socket over IPC
-// Usage: echo <ipc_path>
+// Echo server using mangos REP socket
+// Usage: echo [flags] <url> [<url>...]
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 
 	"go.nanomsg.org/mangos/v3/protocol/rep"
-	_ "go.nanomsg.org/mangos/v3/transport/ipc"
+
+	"mangoro.local/pkg/rgoipc"
 )
 
 func die(format string, v ...interface{}) {
@@ -16,15 +18,23 @@ func die(format string, v ...interface{}) {
 }
 
 func main() {
-	if len(os.Args) != 2 {
-		die("Usage: %s <ipc_path>", os.Args[0])
+	var listen rgoipc.ListenConfig
+	listen.AddFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <url> [<url>...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
 	}
-	url := os.Args[1]
+	listen.URLs = flag.Args()
 	sock, err := rep.NewSocket()
 	if err != nil {
 		die("can't get new rep socket: %s", err)
 	}
-	if err = sock.Listen(url); err != nil {
+	if err = listen.Listen(sock); err != nil {
 		die("can't listen on rep socket: %s", err)
 	}
 	for {
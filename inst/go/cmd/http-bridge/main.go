@@ -6,6 +6,7 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -13,12 +14,11 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
-	"go.nanomsg.org/mangos/v3"
 	"go.nanomsg.org/mangos/v3/protocol/rep"
-	_ "go.nanomsg.org/mangos/v3/transport/ipc"
 
 	"mangoro.local/pkg/rgoipc"
 
@@ -233,19 +233,27 @@ func serveLogger(l *log.Logger, next http.Handler) http.Handler {
 }
 
 func main() {
-	if len(os.Args) != 2 {
-		die("Usage: %s <ipc_path>", os.Args[0])
+	var listen rgoipc.ListenConfig
+	listen.AddFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <url> [<url>...]\n", os.Args[0])
+		flag.PrintDefaults()
 	}
-	url := os.Args[1]
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	listen.URLs = flag.Args()
 
 	// Graceful shutdown on SIGINT/SIGTERM
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
 	registry := rgoipc.NewRegistry()
-	// Return type shared by handlers: struct{status string, message string}
+	// Return type shared by handlers: columns status and message
 	returnType := rgoipc.TypeSpec{
-		Type: rgoipc.TypeStruct,
+		Type: rgoipc.TypeRecord,
 		StructDef: &rgoipc.StructDef{
 			Fields: []rgoipc.FieldDef{
 				{Name: "status", Type: rgoipc.TypeSpec{Type: rgoipc.TypeString}},
@@ -266,29 +274,29 @@ func main() {
 			{Name: "key", Type: rgoipc.TypeSpec{Type: rgoipc.TypeString, Nullable: true}},
 			{Name: "silent", Type: rgoipc.TypeSpec{Type: rgoipc.TypeBool}},
 		},
-		ReturnType: returnType,
-		Vectorized: false,
-		Metadata:   map[string]string{"description": "Start HTTP server"},
+		ReturnType:  returnType,
+		Vectorized:  false,
+		Description: "Start HTTP server",
 	})
 	if err != nil {
 		die("register startServer failed: %s", err)
 	}
 
 	err = registry.Register("stopServer", stopServerHandler, rgoipc.FunctionSignature{
-		Args:       []rgoipc.ArgSpec{},
-		ReturnType: returnType,
-		Vectorized: false,
-		Metadata:   map[string]string{"description": "Stop HTTP server"},
+		Args:        []rgoipc.ArgSpec{},
+		ReturnType:  returnType,
+		Vectorized:  false,
+		Description: "Stop HTTP server",
 	})
 	if err != nil {
 		die("register stopServer failed: %s", err)
 	}
 
 	err = registry.Register("serverStatus", statusHandler, rgoipc.FunctionSignature{
-		Args:       []rgoipc.ArgSpec{},
-		ReturnType: returnType,
-		Vectorized: false,
-		Metadata:   map[string]string{"description": "HTTP server status"},
+		Args:        []rgoipc.ArgSpec{},
+		ReturnType:  returnType,
+		Vectorized:  false,
+		Description: "HTTP server status",
 	})
 	if err != nil {
 		die("register serverStatus failed: %s", err)
@@ -299,106 +307,16 @@ func main() {
 	if err != nil {
 		die("can't get new rep socket: %s", err)
 	}
-	if err = sock.Listen(url); err != nil {
+	// The server tracks clients from when they connect, so it is created
+	// before the socket listens
+	server := rgoipc.NewServer(registry, sock)
+	if err = listen.Listen(sock); err != nil {
 		die("can't listen on rep socket: %s", err)
 	}
 
-	fmt.Printf("HTTP controller listening on %s\n", url)
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-		}
-
-		msgBytes, err := sock.Recv()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "receive error: %s\n", err)
-			continue
-		}
-
-		msg, err := rgoipc.UnmarshalRPCMessage(msgBytes)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "unmarshal error: %s\n", err)
-			sendError(sock, "", fmt.Sprintf("unmarshal error: %s", err))
-			continue
-		}
-
-		switch msg.Type {
-		case rgoipc.MsgTypeManifest:
-			handleManifest(sock, registry)
-		case rgoipc.MsgTypeCall:
-			handleCall(sock, registry, msg)
-		default:
-			sendError(sock, "", "unknown message type")
-		}
-	}
-}
-
-func handleManifest(sock mangos.Socket, registry *rgoipc.Registry) {
-	manifest, err := registry.Manifest()
-	if err != nil {
-		sendError(sock, "", fmt.Sprintf("manifest error: %s", err))
-		return
-	}
-	response := &rgoipc.RPCMessage{
-		Type:      rgoipc.MsgTypeManifest,
-		ArrowData: manifest,
-	}
-	sock.Send(response.Marshal())
-}
-
-func handleCall(sock mangos.Socket, registry *rgoipc.Registry, msg *rgoipc.RPCMessage) {
-	fn, ok := registry.Get(msg.FuncName)
-	if !ok {
-		sendError(sock, msg.FuncName, "function not found")
-		return
-	}
-
-	reader, err := rgoipc.NewArrowReader(msg.ArrowData)
-	if err != nil {
-		sendError(sock, msg.FuncName, fmt.Sprintf("arrow read error: %s", err))
-		return
-	}
-	defer reader.Release()
-
-	var inputRecord arrow.Record
-	if reader.Next() {
-		inputRecord = reader.Record()
-		defer inputRecord.Release()
-	} else {
-		// empty record
-		inputRecord = array.NewRecord(arrow.NewSchema([]arrow.Field{}, nil), []arrow.Array{}, 0)
-		defer inputRecord.Release()
-	}
-
-	result, err := fn.Handler(inputRecord)
-	if err != nil {
-		sendError(sock, msg.FuncName, fmt.Sprintf("execution error: %s", err))
-		return
-	}
-	defer result.Release()
-
-	buf, err := rgoipc.WriteArrowRecord(result)
-	if err != nil {
-		sendError(sock, msg.FuncName, fmt.Sprintf("arrow write error: %s", err))
-		return
-	}
-
-	response := &rgoipc.RPCMessage{
-		Type:      rgoipc.MsgTypeResult,
-		FuncName:  msg.FuncName,
-		ArrowData: buf,
-	}
-	sock.Send(response.Marshal())
-}
+	fmt.Printf("HTTP controller listening on %s\n", strings.Join(listen.URLs, ", "))
 
-func sendError(sock mangos.Socket, funcName, errMsg string) {
-	response := &rgoipc.RPCMessage{
-		Type:     rgoipc.MsgTypeError,
-		FuncName: funcName,
-		ErrorMsg: errMsg,
+	if err := server.Serve(ctx); err != nil && err != rgoipc.ErrServerClosed {
+		die("rpc server error: %s", err)
 	}
-	sock.Send(response.Marshal())
 }
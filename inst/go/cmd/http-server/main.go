@@ -4,17 +4,17 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
-	"go.nanomsg.org/mangos/v3"
 	"go.nanomsg.org/mangos/v3/protocol/rep"
-	_ "go.nanomsg.org/mangos/v3/transport/ipc"
 
 	"mangoro.local/pkg/rgoipc"
 
@@ -247,19 +247,28 @@ func enableCOOP(next http.Handler) http.Handler {
 }
 
 func main() {
-	if len(os.Args) != 2 {
-		die("Usage: %s <ipc_path>", os.Args[0])
+	var listen rgoipc.ListenConfig
+	listen.AddFlags(flag.CommandLine)
+	tokenFile := flag.String("tokens", "", "token `file` granting scopes to API tokens and TLS peers")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <url> [<url>...]\n", os.Args[0])
+		flag.PrintDefaults()
 	}
-	url := os.Args[1]
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	listen.URLs = flag.Args()
 
 	registry := rgoipc.NewRegistry()
 
 	// Define the return type for all HTTP server functions
-	// Note: TypeStruct here is used to describe the schema of the returned RecordBatch,
-	// not an Arrow Struct type. The handler returns an arrow.Record with 2 columns
-	// (status and message), which gets deserialized as a 1-row, 2-column data.frame in R.
+	// TypeRecord describes the columns of the returned RecordBatch: the handler
+	// returns an arrow.Record with 2 columns (status and message), which gets
+	// deserialized as a 1-row, 2-column data.frame in R.
 	returnType := rgoipc.TypeSpec{
-		Type: rgoipc.TypeStruct,
+		Type: rgoipc.TypeRecord,
 		StructDef: &rgoipc.StructDef{
 			Fields: []rgoipc.FieldDef{
 				{Name: "status", Type: rgoipc.TypeSpec{Type: rgoipc.TypeString}},
@@ -281,26 +290,28 @@ func main() {
 			{Name: "key", Type: rgoipc.TypeSpec{Type: rgoipc.TypeString, Nullable: true}},
 			{Name: "silent", Type: rgoipc.TypeSpec{Type: rgoipc.TypeBool, Nullable: true}},
 		},
-		ReturnType: returnType,
-		Metadata:   map[string]string{"description": "Start HTTP file server"},
+		ReturnType:  returnType,
+		Description: "Start HTTP file server",
+		Scopes:      []string{"http"},
 	})
 	if err != nil {
 		die("Failed to register startServer: %s", err)
 	}
 
 	err = registry.Register("stopServer", stopServerHandler, rgoipc.FunctionSignature{
-		Args:       []rgoipc.ArgSpec{},
-		ReturnType: returnType,
-		Metadata:   map[string]string{"description": "Stop HTTP file server"},
+		Args:        []rgoipc.ArgSpec{},
+		ReturnType:  returnType,
+		Description: "Stop HTTP file server",
+		Scopes:      []string{"http"},
 	})
 	if err != nil {
 		die("Failed to register stopServer: %s", err)
 	}
 
 	err = registry.Register("serverStatus", statusHandler, rgoipc.FunctionSignature{
-		Args:       []rgoipc.ArgSpec{},
-		ReturnType: returnType,
-		Metadata:   map[string]string{"description": "Get HTTP server status"},
+		Args:        []rgoipc.ArgSpec{},
+		ReturnType:  returnType,
+		Description: "Get HTTP server status",
 	})
 	if err != nil {
 		die("Failed to register serverStatus: %s", err)
@@ -308,118 +319,29 @@ func main() {
 
 	fmt.Println("Registered functions:", registry.List())
 
-	// Setup RPC socket
-	sock, err := rep.NewSocket()
-	if err != nil {
-		die("can't get new rep socket: %s", err)
-	}
-	if err = sock.Listen(url); err != nil {
-		die("can't listen on rep socket: %s", err)
-	}
-
-	fmt.Printf("HTTP server controller listening on %s\n", url)
-
-	// Main RPC loop
-	for {
-		msgBytes, err := sock.Recv()
+	if *tokenFile != "" {
+		authorizer, err := rgoipc.LoadTokenFile(*tokenFile)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "receive error: %s\n", err)
-			continue
-		}
-
-		msg, err := rgoipc.UnmarshalRPCMessage(msgBytes)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "unmarshal error: %s\n", err)
-			sendError(sock, "", fmt.Sprintf("unmarshal error: %s", err))
-			continue
-		}
-
-		switch msg.Type {
-		case rgoipc.MsgTypeManifest:
-			handleManifest(sock, registry)
-		case rgoipc.MsgTypeCall:
-			handleCall(sock, registry, msg)
-		default:
-			sendError(sock, "", "unknown message type")
+			die("can't load tokens: %s", err)
 		}
+		registry.SetAuthorizer(authorizer)
 	}
-}
 
-func handleManifest(sock mangos.Socket, registry *rgoipc.Registry) {
-	manifest, err := registry.Manifest()
-	if err != nil {
-		sendError(sock, "", fmt.Sprintf("manifest error: %s", err))
-		return
-	}
-
-	response := &rgoipc.RPCMessage{
-		Type:      rgoipc.MsgTypeManifest,
-		ArrowData: manifest,
-	}
-	sock.Send(response.Marshal())
-}
-
-func handleCall(sock mangos.Socket, registry *rgoipc.Registry, msg *rgoipc.RPCMessage) {
-	fn, ok := registry.Get(msg.FuncName)
-	if !ok {
-		sendError(sock, msg.FuncName, "function not found")
-		return
-	}
-
-	// Parse Arrow IPC input
-	var inputRecord arrow.Record
-	reader, err := rgoipc.NewArrowReader(msg.ArrowData)
-	if err != nil {
-		sendError(sock, msg.FuncName, fmt.Sprintf("arrow read error: %s", err))
-		return
-	}
-	defer reader.Release()
-
-	// Check if there's a record batch in the stream
-	if !reader.Next() {
-		// No records - create an empty record with the schema from the reader
-		// or an empty schema if the function expects no args
-		if len(fn.Signature.Args) == 0 {
-			schema := arrow.NewSchema([]arrow.Field{}, nil)
-			inputRecord = array.NewRecord(schema, []arrow.Array{}, 0)
-		} else {
-			// Empty record batch with the schema from input
-			inputRecord = array.NewRecord(reader.Schema(), []arrow.Array{}, 0)
-		}
-		defer inputRecord.Release()
-	} else {
-		inputRecord = reader.Record()
-		defer inputRecord.Release()
-	}
-
-	// Execute function
-	result, err := fn.Handler(inputRecord)
+	// Setup RPC socket
+	sock, err := rep.NewSocket()
 	if err != nil {
-		sendError(sock, msg.FuncName, fmt.Sprintf("execution error: %s", err))
-		return
+		die("can't get new rep socket: %s", err)
 	}
-	defer result.Release()
-
-	// Serialize result
-	buf, err := rgoipc.WriteArrowRecord(result)
-	if err != nil {
-		sendError(sock, msg.FuncName, fmt.Sprintf("arrow write error: %s", err))
-		return
+	// The server tracks clients from when they connect, so it is created
+	// before the socket listens
+	server := rgoipc.NewServer(registry, sock)
+	if err = listen.Listen(sock); err != nil {
+		die("can't listen on rep socket: %s", err)
 	}
 
-	response := &rgoipc.RPCMessage{
-		Type:      rgoipc.MsgTypeResult,
-		FuncName:  msg.FuncName,
-		ArrowData: buf,
-	}
-	sock.Send(response.Marshal())
-}
+	fmt.Printf("HTTP server controller listening on %s\n", strings.Join(listen.URLs, ", "))
 
-func sendError(sock mangos.Socket, funcName, errMsg string) {
-	response := &rgoipc.RPCMessage{
-		Type:     rgoipc.MsgTypeError,
-		FuncName: funcName,
-		ErrorMsg: errMsg,
+	if err := server.Serve(context.Background()); err != nil && err != rgoipc.ErrServerClosed {
+		die("rpc server error: %s", err)
 	}
-	sock.Send(response.Marshal())
 }
@@ -2,19 +2,21 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"flag"
 	"fmt"
+	"math"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"mangoro.local/pkg/rgoipc"
 
 	"github.com/apache/arrow/go/v18/arrow"
 	"github.com/apache/arrow/go/v18/arrow/array"
-	"github.com/apache/arrow/go/v18/arrow/ipc"
-	"github.com/apache/arrow/go/v18/arrow/memory"
-	"go.nanomsg.org/mangos/v3"
-	"go.nanomsg.org/mangos/v3/protocol/rep"
-	_ "go.nanomsg.org/mangos/v3/transport/ipc"
+	"go.nanomsg.org/mangos/v3/protocol/pub"
+	"go.nanomsg.org/mangos/v3/protocol/xrep"
 )
 
 func die(format string, v ...interface{}) {
@@ -24,63 +26,32 @@ func die(format string, v ...interface{}) {
 
 // addHandler adds two numeric vectors element-wise
 func addHandler(input arrow.Record) (arrow.Record, error) {
-	if input.NumCols() != 2 {
-		return nil, fmt.Errorf("expected 2 columns, got %d", input.NumCols())
+	x, err := rgoipc.Column[rgoipc.Optional[float64]](input, "x")
+	if err != nil {
+		return nil, err
 	}
-
-	x := input.Column(0).(*array.Float64)
-	y := input.Column(1).(*array.Float64)
-
-	if x.Len() != y.Len() {
-		return nil, fmt.Errorf("length mismatch: %d vs %d", x.Len(), y.Len())
+	y, err := rgoipc.Column[rgoipc.Optional[float64]](input, "y")
+	if err != nil {
+		return nil, err
 	}
 
-	// Build result
-	pool := memory.NewGoAllocator()
-	builder := array.NewFloat64Builder(pool)
-	defer builder.Release()
-
-	for i := 0; i < x.Len(); i++ {
-		if x.IsNull(i) || y.IsNull(i) {
-			builder.AppendNull()
-		} else {
-			builder.Append(x.Value(i) + y.Value(i))
+	result := make([]rgoipc.Optional[float64], len(x))
+	for i := range x {
+		if x[i].Valid && y[i].Valid {
+			result[i] = rgoipc.Some(x[i].Value + y[i].Value)
 		}
 	}
 
-	result := builder.NewArray()
-	defer result.Release()
-
-	schema := arrow.NewSchema([]arrow.Field{{Name: "result", Type: arrow.PrimitiveTypes.Float64}}, nil)
-	return array.NewRecord(schema, []arrow.Array{result}, int64(result.Len())), nil
+	return rgoipc.NewRecordBuilder().Add("result", result).NewRecord()
 }
 
 // echoStringHandler echoes back a string vector unchanged
 func echoStringHandler(input arrow.Record) (arrow.Record, error) {
-	if input.NumCols() != 1 {
-		return nil, fmt.Errorf("expected 1 column, got %d", input.NumCols())
-	}
-
-	strCol := input.Column(0).(*array.String)
-
-	// Build result
-	pool := memory.NewGoAllocator()
-	builder := array.NewStringBuilder(pool)
-	defer builder.Release()
-
-	for i := 0; i < strCol.Len(); i++ {
-		if strCol.IsNull(i) {
-			builder.AppendNull()
-		} else {
-			builder.Append(strCol.Value(i))
-		}
+	s, err := rgoipc.Column[*string](input, "s")
+	if err != nil {
+		return nil, err
 	}
-
-	result := builder.NewArray()
-	defer result.Release()
-
-	schema := arrow.NewSchema([]arrow.Field{{Name: "result", Type: arrow.BinaryTypes.String}}, nil)
-	return array.NewRecord(schema, []arrow.Array{result}, int64(result.Len())), nil
+	return rgoipc.NewRecordBuilder().Add("result", s).NewRecord()
 }
 
 // echoStructHandler echoes back a struct column (nested data)
@@ -91,75 +62,34 @@ func echoStringHandler(input arrow.Record) (arrow.Record, error) {
 // contains a nested record with named fields. In R, this maps to a list column.
 // This is different from a regular multi-column data.frame!
 func echoStructHandler(input arrow.Record) (arrow.Record, error) {
-	if input.NumCols() != 1 {
-		return nil, fmt.Errorf("expected 1 column, got %d", input.NumCols())
-	}
-
-	structCol, ok := input.Column(0).(*array.Struct)
-	if !ok {
-		return nil, fmt.Errorf("expected struct column, got %T", input.Column(0))
-	}
-
-	// Get the struct type to reconstruct it
-	structType := structCol.DataType().(*arrow.StructType)
-	
-	// Build output struct column
-	pool := memory.NewGoAllocator()
-	builder := array.NewStructBuilder(pool, structType)
-	defer builder.Release()
-
-	// Copy each struct row
-	for i := 0; i < structCol.Len(); i++ {
-		if structCol.IsNull(i) {
-			builder.AppendNull()
-		} else {
-			builder.Append(true)
-			// Copy each field
-			for fieldIdx := 0; fieldIdx < structCol.NumField(); fieldIdx++ {
-				fieldArray := structCol.Field(fieldIdx)
-				fieldBuilder := builder.FieldBuilder(fieldIdx)
-				
-				// Copy value based on type
-				switch fb := fieldBuilder.(type) {
-				case *array.StringBuilder:
-					strArray := fieldArray.(*array.String)
-					if strArray.IsNull(i) {
-						fb.AppendNull()
-					} else {
-						fb.Append(strArray.Value(i))
-					}
-				case *array.Int32Builder:
-					intArray := fieldArray.(*array.Int32)
-					if intArray.IsNull(i) {
-						fb.AppendNull()
-					} else {
-						fb.Append(intArray.Value(i))
-					}
-				case *array.Float64Builder:
-					floatArray := fieldArray.(*array.Float64)
-					if floatArray.IsNull(i) {
-						fb.AppendNull()
-					} else {
-						fb.Append(floatArray.Value(i))
-					}
-				default:
-					return nil, fmt.Errorf("unsupported field type: %T", fb)
-				}
-			}
-		}
+	person, err := rgoipc.ColumnByName(input, "person")
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := person.(*array.Struct); !ok {
+		return nil, fmt.Errorf("expected struct column, got %s", person.DataType())
 	}
 
-	result := builder.NewArray()
-	defer result.Release()
+	// AddArray deep-copies the column whatever its field types are
+	result, err := rgoipc.NewRecordBuilder().AddArray("person", person).NewRecord()
+	if err != nil {
+		return nil, err
+	}
 
-	schema := arrow.NewSchema([]arrow.Field{{Name: "person", Type: structType}}, nil)
-	return array.NewRecord(schema, []arrow.Array{result}, int64(structCol.Len())), nil
+	// Hand back the R attributes of the input (e.g. the AsIs class of an
+	// I() column) to clients that restore them, such as arrow-R
+	meta, err := rgoipc.ReadRMetadata(input.Schema())
+	if err != nil || meta == nil {
+		return result, nil
+	}
+	defer result.Release()
+	return rgoipc.RecordWithRMetadata(result, meta)
 }
 
 // transposeMatrixHandler transposes a matrix passed as a data.frame (columns become rows)
 // Input: data.frame with N numeric columns of length M (sent as arrow.Record)
 // Output: data.frame with M numeric columns of length N (returned as arrow.Record)
-// 
+//
 // Note: This demonstrates how arrow.Record (tabular data) naturally maps to R data.frames.
 // The input data.frame is deserialized as an arrow.Record where each df column is an Arrow column.
 // The output arrow.Record is serialized back to R as a data.frame with transposed dimensions.
@@ -174,47 +104,140 @@ func transposeMatrixHandler(input arrow.Record) (arrow.Record, error) {
 		return nil, fmt.Errorf("expected at least 1 row")
 	}
 
-	// Read all input columns as float64 arrays
-	inputCols := make([]*array.Float64, nCols)
-	for i := 0; i < nCols; i++ {
-		col, ok := input.Column(i).(*array.Float64)
-		if !ok {
-			return nil, fmt.Errorf("column %d is not float64", i)
+	// Read all input columns as float64 values (R integer columns are converted)
+	inputCols := make([][]rgoipc.Optional[float64], nCols)
+	for i, field := range input.Schema().Fields() {
+		col, err := rgoipc.Column[rgoipc.Optional[float64]](input, field.Name)
+		if err != nil {
+			return nil, err
 		}
 		inputCols[i] = col
 	}
 
 	// Build transposed output: nRows columns, each with nCols rows
-	pool := memory.NewGoAllocator()
-	outputCols := make([]arrow.Array, nRows)
-	fields := make([]arrow.Field, nRows)
-
+	builder := rgoipc.NewRecordBuilder()
 	for rowIdx := 0; rowIdx < nRows; rowIdx++ {
-		builder := array.NewFloat64Builder(pool)
-		
-		for colIdx := 0; colIdx < nCols; colIdx++ {
-			if inputCols[colIdx].IsNull(rowIdx) {
-				builder.AppendNull()
-			} else {
-				builder.Append(inputCols[colIdx].Value(rowIdx))
-			}
+		values := make([]rgoipc.Optional[float64], nCols)
+		for colIdx := range inputCols {
+			values[colIdx] = inputCols[colIdx][rowIdx]
+		}
+		builder.Add(fmt.Sprintf("V%d", rowIdx+1), values)
+	}
+	return builder.NewRecord()
+}
+
+// sequenceHandler streams the integers 1..n in batches of at most chunk
+// rows. Streaming clients pull the batches one at a time; others get them
+// all in one multi-batch Arrow stream, which R reads as usual. Each batch
+// is reported as progress.
+func sequenceHandler(ctx context.Context, input arrow.Record, out rgoipc.RecordWriter) error {
+	n, err := rgoipc.ScalarArg[int32](input, "n", 0)
+	if err != nil {
+		return err
+	}
+	chunk, err := rgoipc.ScalarArg[int32](input, "chunk", 1000)
+	if err != nil {
+		return err
+	}
+	if chunk < 1 {
+		return fmt.Errorf("chunk must be positive, got %d", chunk)
+	}
+
+	for start := int32(1); start <= n; start += chunk {
+		values := make([]int32, 0, chunk)
+		for i := start; i <= n && i < start+chunk; i++ {
+			values = append(values, i)
+		}
+		rec, err := rgoipc.NewRecordBuilder().Add("result", values).NewRecord()
+		if err != nil {
+			return err
+		}
+		err = out.Write(rec)
+		rec.Release()
+		if err != nil {
+			return err
+		}
+		rgoipc.Progress(ctx, int64(start)+int64(len(values))-1, int64(n), "")
+	}
+	return nil
+}
+
+// accumulator is a running sum kept between calls behind a handle
+type accumulator struct {
+	mu    sync.Mutex
+	total float64
+}
+
+// handles holds the accumulators created by newAccumulator until R
+// releases them or they sit unused for an hour
+var handles = rgoipc.NewHandleStore(time.Hour)
+
+// newAccumulatorHandler creates an accumulator and returns its handle,
+// which is released when the calling R process goes away
+func newAccumulatorHandler(ctx context.Context, input arrow.Record) (arrow.Record, error) {
+	id := handles.New(&accumulator{})
+	rgoipc.SessionFrom(ctx).Own(handles, id)
+	return rgoipc.NewRecordBuilder().Add("handle", []string{id}).NewRecord()
+}
+
+// accumulateHandler adds x to the accumulator of handle and returns the
+// running total
+func accumulateHandler(input arrow.Record) (arrow.Record, error) {
+	acc, err := rgoipc.HandleArg[*accumulator](handles, input, "handle")
+	if err != nil {
+		return nil, err
+	}
+	x, err := rgoipc.Column[rgoipc.Optional[float64]](input, "x")
+	if err != nil {
+		return nil, err
+	}
+
+	acc.mu.Lock()
+	defer acc.mu.Unlock()
+	for _, v := range x {
+		if v.Valid {
+			acc.total += v.Value
 		}
-		
-		outputCols[rowIdx] = builder.NewArray()
-		defer outputCols[rowIdx].Release()
-		fields[rowIdx] = arrow.Field{Name: fmt.Sprintf("V%d", rowIdx+1), Type: arrow.PrimitiveTypes.Float64}
-		builder.Release()
 	}
+	return rgoipc.NewRecordBuilder().Add("total", []float64{acc.total}).NewRecord()
+}
 
-	schema := arrow.NewSchema(fields, nil)
-	return array.NewRecord(schema, outputCols, int64(nCols)), nil
+// publishClock publishes the time every second on the clock/tick topic,
+// standing in for data that Go produces on its own
+func publishClock(publisher *rgoipc.Publisher) {
+	for now := range time.Tick(time.Second) {
+		rec, err := rgoipc.NewRecordBuilder().
+			Add("time", []string{now.Format(time.RFC3339Nano)}).
+			Add("unix", []float64{float64(now.UnixNano()) / 1e9}).
+			NewRecord()
+		if err != nil {
+			die("can't build clock event: %s", err)
+		}
+		if err := publisher.Publish("clock/tick", rec); err != nil {
+			fmt.Fprintf(os.Stderr, "publish error: %s\n", err)
+		}
+		rec.Release()
+	}
 }
 
 func main() {
-	if len(os.Args) != 2 {
-		die("Usage: %s <ipc_path>", os.Args[0])
+	var listen rgoipc.ListenConfig
+	listen.AddFlags(flag.CommandLine)
+	limits := rgoipc.Limits{MaxMessageSize: 256 << 20}
+	limits.AddFlags(flag.CommandLine)
+	tokenFile := flag.String("tokens", "", "token `file` granting scopes to API tokens and TLS peers")
+	publishURL := flag.String("publish", "", "publish clock/tick events every second on `url`")
+	allowShutdown := flag.Bool("allow-shutdown", false, "let clients close the server with the .shutdown built-in")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <url> [<url>...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
 	}
-	url := os.Args[1]
+	listen.URLs = flag.Args()
 
 	// Create registry and register functions
 	registry := rgoipc.NewRegistry()
@@ -224,9 +247,9 @@ func main() {
 			{Name: "x", Type: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64, Nullable: true}},
 			{Name: "y", Type: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64, Nullable: true}},
 		},
-		ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64, Nullable: true},
-		Vectorized: true,
-		Metadata:   map[string]string{"description": "Add two numeric vectors"},
+		ReturnType:  rgoipc.TypeSpec{Type: rgoipc.TypeFloat64, Nullable: true},
+		Vectorized:  true,
+		Description: "Add two numeric vectors",
 	})
 	if err != nil {
 		die("Failed to register add function: %s", err)
@@ -236,9 +259,9 @@ func main() {
 		Args: []rgoipc.ArgSpec{
 			{Name: "s", Type: rgoipc.TypeSpec{Type: rgoipc.TypeString, Nullable: true}},
 		},
-		ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeString, Nullable: true},
-		Vectorized: true,
-		Metadata:   map[string]string{"description": "Echo back a string vector"},
+		ReturnType:  rgoipc.TypeSpec{Type: rgoipc.TypeString, Nullable: true},
+		Vectorized:  true,
+		Description: "Echo back a string vector",
 	})
 	if err != nil {
 		die("Failed to register echoString function: %s", err)
@@ -269,8 +292,8 @@ func main() {
 				},
 			},
 		},
-		Vectorized: true,
-		Metadata:   map[string]string{"description": "Echo back a struct column (nested data)"},
+		Vectorized:  true,
+		Description: "Echo back a struct column (nested data)",
 	})
 	if err != nil {
 		die("Failed to register echoStruct function: %s", err)
@@ -278,133 +301,116 @@ func main() {
 
 	err = registry.Register("transposeMatrix", transposeMatrixHandler, rgoipc.FunctionSignature{
 		Args: []rgoipc.ArgSpec{},
-		ReturnType: rgoipc.TypeSpec{
-			Type: rgoipc.TypeStruct,
-			StructDef: &rgoipc.StructDef{
-				Fields: []rgoipc.FieldDef{}, // Empty - dynamic structure (schema determined at runtime)
-			},
-		},
-		Vectorized: false,
-		Metadata:   map[string]string{"description": "Transpose a matrix (columns <-> rows)"},
+		// Any number of numeric columns; the result columns depend on the input rows
+		DynamicArgs: true,
+		ReturnType:  rgoipc.TypeSpec{Type: rgoipc.TypeDynamic},
+		Vectorized:  false,
+		Description: "Transpose a matrix (columns <-> rows)",
 	})
 	if err != nil {
 		die("Failed to register transposeMatrix function: %s", err)
 	}
 
-	fmt.Println("Registered functions:", registry.List())
-
-	// Setup socket
-	sock, err := rep.NewSocket()
-	if err != nil {
-		die("can't get new rep socket: %s", err)
-	}
-	if err = sock.Listen(url); err != nil {
-		die("can't listen on rep socket: %s", err)
-	}
-
-	fmt.Printf("RPC server listening on %s\n", url)
-
-	// Main loop - REP socket can handle multiple REQ clients
-	// Process each request in a goroutine for concurrency
-	for {
-		msgBytes, err := sock.Recv()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "receive error: %s\n", err)
-			continue
+	// Plain Go functions need no Arrow code: the signature is derived from
+	// the Go types and a nil pointer is an R NA
+	err = rgoipc.RegisterFunc(registry, "hypot", func(x, y *float64) *float64 {
+		if x == nil || y == nil {
+			return nil
 		}
-
-		// Handle each request concurrently
-		// REP routing ensures response goes to correct client
-		go handleRequest(sock, registry, msgBytes)
+		h := math.Hypot(*x, *y)
+		return &h
+	}, rgoipc.WithArgNames("x", "y"), rgoipc.WithDescription("Euclidean norm sqrt(x^2 + y^2)"))
+	if err != nil {
+		die("Failed to register hypot function: %s", err)
 	}
-}
 
-func handleRequest(sock mangos.Socket, registry *rgoipc.Registry, msgBytes []byte) {
-	msg, err := rgoipc.UnmarshalRPCMessage(msgBytes)
+	err = registry.RegisterStream("sequence", sequenceHandler, rgoipc.FunctionSignature{
+		Args: []rgoipc.ArgSpec{
+			{Name: "n", Type: rgoipc.TypeSpec{Type: rgoipc.TypeInt32}},
+			{Name: "chunk", Type: rgoipc.TypeSpec{Type: rgoipc.TypeInt32}, Optional: true, Default: 1000},
+		},
+		ReturnType:  rgoipc.TypeSpec{Type: rgoipc.TypeInt32},
+		Description: "Stream the integers 1..n in batches of chunk rows",
+	})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "unmarshal error: %s\n", err)
-		sendError(sock, "", fmt.Sprintf("unmarshal error: %s", err))
-		return
+		die("Failed to register sequence function: %s", err)
 	}
 
-	switch msg.Type {
-	case rgoipc.MsgTypeManifest:
-		handleManifest(sock, registry)
-	case rgoipc.MsgTypeCall:
-		handleCall(sock, registry, msg)
-	default:
-		sendError(sock, "", "unknown message type")
+	err = registry.RegisterContext("newAccumulator", newAccumulatorHandler, rgoipc.FunctionSignature{
+		Args: []rgoipc.ArgSpec{},
+		// R sends a placeholder column for calls without arguments
+		DynamicArgs: true,
+		ReturnType:  rgoipc.TypeSpec{Type: rgoipc.TypeRecord, StructDef: &rgoipc.StructDef{Fields: []rgoipc.FieldDef{{Name: "handle", Type: rgoipc.TypeSpec{Type: rgoipc.TypeString}}}}},
+		Description: "Create a running sum and return its handle",
+	})
+	if err != nil {
+		die("Failed to register newAccumulator function: %s", err)
 	}
-}
 
-func handleManifest(sock mangos.Socket, registry *rgoipc.Registry) {
-	manifest, err := registry.Manifest()
+	err = registry.Register("accumulate", accumulateHandler, rgoipc.FunctionSignature{
+		Args: []rgoipc.ArgSpec{
+			{Name: "handle", Type: rgoipc.TypeSpec{Type: rgoipc.TypeString}},
+			{Name: "x", Type: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64, Nullable: true}},
+		},
+		ReturnType:  rgoipc.TypeSpec{Type: rgoipc.TypeRecord, StructDef: &rgoipc.StructDef{Fields: []rgoipc.FieldDef{{Name: "total", Type: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64}}}}},
+		Description: "Add x to the running sum of handle and return the total",
+	})
 	if err != nil {
-		sendError(sock, "", fmt.Sprintf("manifest error: %s", err))
-		return
+		die("Failed to register accumulate function: %s", err)
 	}
 
-	response := &rgoipc.RPCMessage{
-		Type:      rgoipc.MsgTypeManifest,
-		ArrowData: manifest,
-	}
-	sock.Send(response.Marshal())
-}
+	fmt.Println("Registered functions:", registry.List())
 
-func handleCall(sock mangos.Socket, registry *rgoipc.Registry, msg *rgoipc.RPCMessage) {
-	fn, ok := registry.Get(msg.FuncName)
-	if !ok {
-		sendError(sock, msg.FuncName, "function not found")
-		return
+	if *tokenFile != "" {
+		authorizer, err := rgoipc.LoadTokenFile(*tokenFile)
+		if err != nil {
+			die("can't load tokens: %s", err)
+		}
+		registry.SetAuthorizer(authorizer)
 	}
 
-	// Parse Arrow IPC input
-	reader, err := ipc.NewReader(bytes.NewReader(msg.ArrowData))
+	// A raw REP socket: the server reads it from a single receiver and
+	// routes every reply by the backtrace of its request
+	sock, err := xrep.NewSocket()
 	if err != nil {
-		sendError(sock, msg.FuncName, fmt.Sprintf("arrow read error: %s", err))
-		return
+		die("can't get new xrep socket: %s", err)
 	}
-	defer reader.Release()
 
-	if !reader.Next() {
-		sendError(sock, msg.FuncName, "no records in input")
-		return
+	// Check call inputs and results against the declared signatures
+	opts := []rgoipc.ServerOption{
+		rgoipc.WithValidation(rgoipc.ValidateInput | rgoipc.ValidateOutput),
+		rgoipc.WithHandles(handles),
+		rgoipc.WithLimits(limits),
 	}
-
-	inputRecord := reader.Record()
-	defer inputRecord.Release()
-
-	// Execute function
-	result, err := fn.Handler(inputRecord)
-	if err != nil {
-		sendError(sock, msg.FuncName, fmt.Sprintf("execution error: %s", err))
-		return
+	if *allowShutdown {
+		opts = append(opts, rgoipc.WithShutdownBuiltin())
 	}
-	defer result.Release()
-
-	// Serialize result
-	var buf bytes.Buffer
-	writer := ipc.NewWriter(&buf, ipc.WithSchema(result.Schema()))
-	defer writer.Close()
-
-	if err := writer.Write(result); err != nil {
-		sendError(sock, msg.FuncName, fmt.Sprintf("arrow write error: %s", err))
-		return
+	// The server tracks clients from when they connect, so it is created
+	// before the socket listens
+	server := rgoipc.NewServer(registry, sock, opts...)
+	if err = listen.Listen(sock); err != nil {
+		die("can't listen on rep socket: %s", err)
 	}
 
-	response := &rgoipc.RPCMessage{
-		Type:      rgoipc.MsgTypeResult,
-		FuncName:  msg.FuncName,
-		ArrowData: buf.Bytes(),
+	fmt.Printf("RPC server listening on %s\n", strings.Join(listen.URLs, ", "))
+
+	if *publishURL != "" {
+		pubSock, err := pub.NewSocket()
+		if err != nil {
+			die("can't get new pub socket: %s", err)
+		}
+		tlsConfig, err := listen.TLSConfig()
+		if err != nil {
+			die("can't load TLS config: %s", err)
+		}
+		if err = rgoipc.Listen(pubSock, tlsConfig, *publishURL); err != nil {
+			die("can't listen on pub socket: %s", err)
+		}
+		fmt.Printf("Publishing clock/tick events on %s\n", *publishURL)
+		go publishClock(rgoipc.NewPublisher(pubSock))
 	}
-	sock.Send(response.Marshal())
-}
 
-func sendError(sock mangos.Socket, funcName, errMsg string) {
-	response := &rgoipc.RPCMessage{
-		Type:     rgoipc.MsgTypeError,
-		FuncName: funcName,
-		ErrorMsg: errMsg,
+	if err := server.Serve(context.Background()); err != nil && err != rgoipc.ErrServerClosed {
+		die("rpc server error: %s", err)
 	}
-	sock.Send(response.Marshal())
 }
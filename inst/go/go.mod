@@ -4,13 +4,13 @@ go 1.22
 
 require (
 	github.com/apache/arrow/go/v18 v18.0.0-20241007013041-ab95a4d25142
+	github.com/google/flatbuffers v24.3.25+incompatible
 	go.nanomsg.org/mangos/v3 v3.4.3-0.20251129213113-0e615e77cd76
 )
 
 require (
 	github.com/Microsoft/go-winio v0.6.2 // indirect
 	github.com/goccy/go-json v0.10.3 // indirect
-	github.com/google/flatbuffers v24.3.25+incompatible // indirect
 	github.com/gorilla/websocket v1.5.3 // indirect
 	github.com/klauspost/compress v1.17.9 // indirect
 	github.com/klauspost/cpuid/v2 v2.2.8 // indirect
@@ -0,0 +1,247 @@
+package rgoipc
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+)
+
+// ScopeAdmin is the scope needed for the .shutdown built-in, when the
+// server has it, once the registry has an Authorizer
+const ScopeAdmin = "admin"
+
+// ScopeAll granted to a caller stands for every scope
+const ScopeAll = "*"
+
+// AuthRequest describes a request for an Authorizer. Calls and submissions
+// name the function they run; messages about a job or stream name the
+// function that started it. Other messages (manifest, job and handle lists,
+// handle releases, cancels by request ID) have no function.
+type AuthRequest struct {
+	Message  MessageType
+	Function string   // "" for messages that reach no function
+	Scopes   []string // FunctionSignature.Scopes of the function
+	Tags     []string // FunctionSignature.Tags of the function
+	Token    string   // API token from the message header, "" if none
+	Peer     *Peer    // verified TLS client, nil if none
+}
+
+// Authorizer decides whether a request may be served. A non-nil error
+// refuses it; the client gets a permission_denied error, unless the error
+// is an RPCError with a code of its own, and the server writes an audit
+// line. ctx is the request's context, so SessionFrom works.
+type Authorizer interface {
+	Authorize(ctx context.Context, req AuthRequest) error
+}
+
+// AuthorizerFunc adapts a function to the Authorizer interface
+type AuthorizerFunc func(ctx context.Context, req AuthRequest) error
+
+// Authorize calls f
+func (f AuthorizerFunc) Authorize(ctx context.Context, req AuthRequest) error {
+	return f(ctx, req)
+}
+
+// SetAuthorizer installs the Authorizer that servers of the registry ask
+// before serving every request, calls of built-in functions included.
+// Without one every request is allowed.
+func (r *Registry) SetAuthorizer(a Authorizer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.authorizer = a
+}
+
+// Authorizer returns the Authorizer of the registry, or nil
+func (r *Registry) Authorizer() Authorizer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.authorizer
+}
+
+// WithAuditLog sets the logger that receives a line for every call the
+// Authorizer refuses. The default is the server's logger.
+func WithAuditLog(logger *log.Logger) ServerOption {
+	return func(s *Server) {
+		s.audit = logger
+	}
+}
+
+// authorize asks the registry's Authorizer whether msg may reach fn, which
+// is nil for messages that reach no function
+func (s *Server) authorize(ctx context.Context, msg *RPCMessage, fn *RegisteredFunction) error {
+	a := s.registry.Authorizer()
+	if a == nil {
+		return nil
+	}
+	req := AuthRequest{
+		Message: msg.Type,
+		Token:   msg.Token,
+		Peer:    PeerFrom(ctx),
+	}
+	if fn != nil {
+		req.Function = fn.Name
+		req.Scopes = fn.Signature.Scopes
+		req.Tags = fn.Signature.Tags
+	}
+	err := a.Authorize(ctx, req)
+	if err == nil {
+		return nil
+	}
+
+	audit := s.audit
+	if audit == nil {
+		audit = s.logger
+	}
+	function, client, peer := "-", "-", "-"
+	if req.Function != "" {
+		function = req.Function
+	}
+	if sess := SessionFrom(ctx); sess != nil {
+		client = fmt.Sprintf("%d@%s", sess.ID, sess.Address)
+	}
+	if req.Peer != nil && len(req.Peer.Names()) > 0 {
+		peer = strings.Join(req.Peer.Names(), ",")
+	}
+	audit.Printf("audit: denied %s message=%d client=%s peer=%s token=%s request=%d: %s",
+		function, msg.Type, client, peer, tokenID(req.Token), msg.RequestID, err)
+
+	var rpcErr *RPCError
+	if errors.Is(err, ErrPermissionDenied) || errors.As(err, &rpcErr) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrPermissionDenied, err)
+}
+
+// principalOf names the client of msg for the ownership of jobs and
+// streams: its API token, hashed, or else the fingerprint of its verified
+// TLS certificate, since names need not be unique or even present. It is
+// "" for anonymous clients, whose session alone owns what they start.
+func principalOf(ctx context.Context, msg *RPCMessage) string {
+	if msg.Token != "" {
+		sum := sha256.Sum256([]byte(msg.Token))
+		return "token:" + hex.EncodeToString(sum[:])
+	}
+	if peer := PeerFrom(ctx); peer != nil && peer.Certificate != nil {
+		sum := sha256.Sum256(peer.Certificate.Raw)
+		return "peer:" + hex.EncodeToString(sum[:])
+	}
+	return ""
+}
+
+// tokenID identifies a token in logs without revealing it
+func tokenID(token string) string {
+	if token == "" {
+		return "-"
+	}
+	sum := sha256.Sum256([]byte(token))
+	return "sha256:" + hex.EncodeToString(sum[:4])
+}
+
+// StaticAuthorizer grants scopes to API tokens and TLS peers listed in a
+// token file. A call is allowed if the caller holds every scope of the
+// function, or ScopeAll; functions without scopes are open to everyone.
+type StaticAuthorizer struct {
+	tokens map[[sha256.Size]byte][]string // by token hash
+	peers  map[string][]string            // by peer name
+}
+
+// LoadTokenFile reads a token file (see ParseTokenFile)
+func LoadTokenFile(path string) (*StaticAuthorizer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	a, err := ParseTokenFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return a, nil
+}
+
+// ParseTokenFile reads one principal per line followed by the scopes it is
+// granted. A principal is an API token, the SHA-256 of one written as
+// sha256:<hex>, or peer:<name> for TLS clients whose certificate has that
+// common name or subject alternative name. Blank lines and text after #
+// are ignored:
+//
+//	# principal                 scopes
+//	s3cr3t-token                read write
+//	sha256:2bb80d53...          read
+//	peer:alice                  admin
+func ParseTokenFile(r io.Reader) (*StaticAuthorizer, error) {
+	a := &StaticAuthorizer{
+		tokens: make(map[[sha256.Size]byte][]string),
+		peers:  make(map[string][]string),
+	}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: %s has no scopes", line, fields[0])
+		}
+		principal, scopes := fields[0], fields[1:]
+		switch {
+		case strings.HasPrefix(principal, "peer:"):
+			name := strings.TrimPrefix(principal, "peer:")
+			a.peers[name] = append(a.peers[name], scopes...)
+		case strings.HasPrefix(principal, "sha256:"):
+			sum, err := hex.DecodeString(strings.TrimPrefix(principal, "sha256:"))
+			if err != nil || len(sum) != sha256.Size {
+				return nil, fmt.Errorf("line %d: bad token hash", line)
+			}
+			key := [sha256.Size]byte(sum)
+			a.tokens[key] = append(a.tokens[key], scopes...)
+		default:
+			key := sha256.Sum256([]byte(principal))
+			a.tokens[key] = append(a.tokens[key], scopes...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Scopes returns the scopes granted to a caller with token and peer
+func (a *StaticAuthorizer) Scopes(token string, peer *Peer) []string {
+	var scopes []string
+	if token != "" {
+		scopes = append(scopes, a.tokens[sha256.Sum256([]byte(token))]...)
+	}
+	if peer != nil {
+		for _, name := range peer.Names() {
+			scopes = append(scopes, a.peers[name]...)
+		}
+	}
+	return scopes
+}
+
+// Authorize allows the call if the caller holds every scope it needs
+func (a *StaticAuthorizer) Authorize(_ context.Context, req AuthRequest) error {
+	if len(req.Scopes) == 0 {
+		return nil
+	}
+	granted := a.Scopes(req.Token, req.Peer)
+	if slices.Contains(granted, ScopeAll) {
+		return nil
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(granted, scope) {
+			return fmt.Errorf("%w: %s needs scope %s", ErrPermissionDenied, req.Function, scope)
+		}
+	}
+	return nil
+}
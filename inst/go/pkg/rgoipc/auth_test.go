@@ -0,0 +1,222 @@
+package rgoipc_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+
+	"mangoro.local/pkg/rgoipc"
+)
+
+// syncBuffer is a bytes.Buffer safe for a server goroutine to write to
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestStaticAuthorizer(t *testing.T) {
+	hash := sha256.Sum256([]byte("hashed-token"))
+	a, err := rgoipc.ParseTokenFile(strings.NewReader(`
+# principal   scopes
+reader-token  read          # a comment
+writer-token  read write
+sha256:` + hex.EncodeToString(hash[:]) + ` write
+root-token    *
+peer:alice    admin
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := &rgoipc.Peer{CommonName: "alice"}
+
+	for _, tc := range []struct {
+		token  string
+		peer   *rgoipc.Peer
+		scopes []string
+		ok     bool
+	}{
+		{"", nil, nil, true},
+		{"", nil, []string{"read"}, false},
+		{"reader-token", nil, []string{"read"}, true},
+		{"reader-token", nil, []string{"read", "write"}, false},
+		{"writer-token", nil, []string{"read", "write"}, true},
+		{"hashed-token", nil, []string{"write"}, true},
+		{"root-token", nil, []string{rgoipc.ScopeAdmin}, true},
+		{"bogus", nil, []string{"read"}, false},
+		{"", alice, []string{rgoipc.ScopeAdmin}, true},
+		{"", &rgoipc.Peer{CommonName: "mallory"}, []string{rgoipc.ScopeAdmin}, false},
+	} {
+		err := a.Authorize(context.Background(), rgoipc.AuthRequest{Function: "f", Scopes: tc.scopes, Token: tc.token, Peer: tc.peer})
+		if (err == nil) != tc.ok {
+			t.Errorf("token %q peer %v scopes %v: %v", tc.token, tc.peer, tc.scopes, err)
+		}
+		if err != nil && !errors.Is(err, rgoipc.ErrPermissionDenied) {
+			t.Errorf("error %v is not ErrPermissionDenied", err)
+		}
+	}
+
+	if _, err := rgoipc.ParseTokenFile(strings.NewReader("lonely-token\n")); err == nil {
+		t.Error("parsed a token without scopes")
+	}
+	if _, err := rgoipc.ParseTokenFile(strings.NewReader("sha256:zz read\n")); err == nil {
+		t.Error("parsed a bad token hash")
+	}
+}
+
+func TestServerAuthorization(t *testing.T) {
+	authorizer, err := rgoipc.ParseTokenFile(strings.NewReader("reader-token read\nadmin-token admin\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := rgoipc.NewRegistry()
+	registry.Register("add", testAddHandler, rgoipc.FunctionSignature{
+		ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64},
+		Scopes:     []string{"read"},
+	})
+	registry.SetAuthorizer(authorizer)
+
+	var audit syncBuffer
+	url, _ := startTestServer(t, registry, rgoipc.WithAuditLog(log.New(&audit, "", 0)), rgoipc.WithShutdownBuiltin())
+	sock := dialTestClient(t, url)
+	input := float64Record(t, []string{"x", "y"}, []float64{1}, []float64{2})
+
+	reply := roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "add", ArrowData: input})
+	if reply.Error == nil || reply.Error.Code != rgoipc.CodePermissionDenied {
+		t.Errorf("call without a token: %v", reply.Error)
+	}
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeSubmit, FuncName: "add", ArrowData: input, Token: "wrong-token"})
+	if reply.Error == nil || reply.Error.Code != rgoipc.CodePermissionDenied {
+		t.Errorf("job with a wrong token: %v", reply.Error)
+	}
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "add", ArrowData: input, Token: "reader-token"})
+	if reply.Type != rgoipc.MsgTypeResult {
+		t.Errorf("call with a token: %v", reply.Error)
+	}
+
+	// Built-ins: .ping is open, .shutdown needs the admin scope
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: rgoipc.BuiltinPing})
+	if reply.Type != rgoipc.MsgTypeResult {
+		t.Errorf(".ping: %v", reply.Error)
+	}
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: rgoipc.BuiltinShutdown, Token: "reader-token"})
+	if reply.Error == nil || reply.Error.Code != rgoipc.CodePermissionDenied {
+		t.Errorf(".shutdown without the admin scope: %v", reply.Error)
+	}
+
+	lines := strings.Split(strings.TrimSpace(audit.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("audit log:\n%s", audit.String())
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "audit: denied ") {
+			t.Errorf("audit line %q", line)
+		}
+	}
+	if strings.Contains(audit.String(), "reader-token") || strings.Contains(audit.String(), "wrong-token") {
+		t.Error("audit log reveals a token")
+	}
+}
+
+func TestMessageToken(t *testing.T) {
+	msg := &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "add", Token: "s3cr3t", RequestID: 7}
+	decoded, err := rgoipc.UnmarshalRPCMessage(msg.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Token != "s3cr3t" || decoded.Flags&rgoipc.FlagToken == 0 || decoded.FuncName != "add" {
+		t.Errorf("decoded %+v", decoded)
+	}
+}
+
+func TestServerAuthorizesEveryMessage(t *testing.T) {
+	var mu sync.Mutex
+	seen := map[rgoipc.MessageType]string{}
+	registry := rgoipc.NewRegistry()
+	registry.RegisterStream("count", countHandler(5), rgoipc.FunctionSignature{ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeInt32}})
+	// Anonymous requests are refused, whatever they are for
+	registry.SetAuthorizer(rgoipc.AuthorizerFunc(func(_ context.Context, req rgoipc.AuthRequest) error {
+		mu.Lock()
+		seen[req.Message] = req.Function
+		mu.Unlock()
+		if req.Token == "" {
+			return rgoipc.ErrPermissionDenied
+		}
+		return nil
+	}))
+	url, _ := startTestServer(t, registry, rgoipc.WithAuditLog(log.New(&syncBuffer{}, "", 0)))
+	sock := dialTestClient(t, url)
+	other := dialTestClient(t, url)
+
+	for _, msg := range []*rgoipc.RPCMessage{
+		{Type: rgoipc.MsgTypeManifest},
+		{Type: rgoipc.MsgTypeJobList},
+		{Type: rgoipc.MsgTypeHandleList},
+		{Type: rgoipc.MsgTypeHandleRelease, FuncName: "h"},
+		{Type: rgoipc.MsgTypeCancel, RequestID: 3},
+	} {
+		reply := roundTrip(t, sock, msg)
+		if !errors.Is(reply.Error, rgoipc.ErrPermissionDenied) {
+			t.Errorf("anonymous message %d: %v", msg.Type, reply.Error)
+		}
+	}
+
+	// Jobs and streams belong to the token that started them, from any
+	// client, and are authorized against their function
+	reply := roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeSubmit, FuncName: "count", Token: "alice"})
+	if reply.Type != rgoipc.MsgTypeJobStatus {
+		t.Fatalf("submit: %v", reply.Error)
+	}
+	job := reply.FuncName
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeJobStatus, FuncName: job, Token: "bob"})
+	if !errors.Is(reply.Error, rgoipc.ErrJobNotFound) {
+		t.Errorf("job status for another token: %v", reply.Error)
+	}
+	reply = roundTrip(t, other, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeJobStatus, FuncName: job, Token: "alice"})
+	if reply.Type != rgoipc.MsgTypeJobStatus {
+		t.Errorf("job status from another client with the same token: %v", reply.Error)
+	}
+
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "count", Flags: rgoipc.FlagStream, Token: "alice"})
+	if reply.Type != rgoipc.MsgTypeResult {
+		t.Fatalf("streamed call: %v", reply.Error)
+	}
+	stream := reply.FuncName
+	for _, msg := range []*rgoipc.RPCMessage{
+		{Type: rgoipc.MsgTypeStreamNext, FuncName: stream, Token: "bob"},
+		{Type: rgoipc.MsgTypeCancel, FuncName: stream, Token: "bob"},
+		{Type: rgoipc.MsgTypeStreamNext, FuncName: stream},
+	} {
+		reply = roundTrip(t, sock, msg)
+		if !errors.Is(reply.Error, rgoipc.ErrInvalidMessage) {
+			t.Errorf("message %d for the stream of another principal: %v", msg.Type, reply.Error)
+		}
+	}
+	reply = roundTrip(t, other, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeStreamNext, FuncName: stream, Token: "alice"})
+	if reply.Type != rgoipc.MsgTypeResult {
+		t.Errorf("stream next from another client with the same token: %v", reply.Error)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if seen[rgoipc.MsgTypeJobStatus] != "count" || seen[rgoipc.MsgTypeStreamNext] != "count" || seen[rgoipc.MsgTypeManifest] != "" {
+		t.Errorf("authorized functions: %v", seen)
+	}
+}
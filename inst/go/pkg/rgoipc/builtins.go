@@ -0,0 +1,308 @@
+package rgoipc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow/go/v18/arrow"
+)
+
+// BuiltinPrefix starts the names of the functions every Server provides.
+// Registries refuse user functions with such names.
+const BuiltinPrefix = "."
+
+// Built-in functions. Their results are one-row records unless noted; counts
+// and sizes are doubles, which R reads as numeric.
+const (
+	BuiltinPing      = ".ping"      // status "ok" and the server's uptime
+	BuiltinVersion   = ".version"   // Go, mangos, arrow-go and protocol versions
+	BuiltinStats     = ".stats"     // uptime, goroutines, memory and server counters
+	BuiltinFunctions = ".functions" // one row per function with its call counts
+	BuiltinDescribe  = ".describe"  // one row per argument of the function name
+	BuiltinSession   = ".session"   // the calling client's session ID and address
+	BuiltinShutdown  = ".shutdown"  // replies, then closes the server; see WithShutdownBuiltin
+)
+
+// WithShutdownBuiltin lets clients close the server with .shutdown. Without
+// it the built-in does not exist. Once the registry has an Authorizer, it
+// also needs ScopeAdmin.
+func WithShutdownBuiltin() ServerOption {
+	return func(s *Server) {
+		s.shutdownBuiltin = true
+	}
+}
+
+// Modules whose versions .version reports
+const (
+	mangosModule  = "go.nanomsg.org/mangos/v3"
+	arrowGoModule = "github.com/apache/arrow/go/v18"
+)
+
+// newBuiltins registers the built-in functions of s
+func newBuiltins(s *Server) *Registry {
+	r := NewRegistry()
+	r.builtin = true
+
+	noArgs := func(description string, returns ...FieldDef) FunctionSignature {
+		return FunctionSignature{
+			Args: []ArgSpec{},
+			// R sends a placeholder column for calls without arguments
+			DynamicArgs: true,
+			ReturnType:  TypeSpec{Type: TypeRecord, StructDef: &StructDef{Fields: returns}},
+			Description: description,
+		}
+	}
+	mustRegister := func(name string, fn FunctionHandler, sig FunctionSignature) {
+		if err := r.Register(name, fn, sig); err != nil {
+			panic(err)
+		}
+	}
+
+	mustRegister(BuiltinPing, s.builtinPing, noArgs("Check that the server is alive",
+		builtinField("status", TypeString),
+		builtinField("uptime", TypeFloat64)))
+	mustRegister(BuiltinVersion, s.builtinVersion, noArgs("Versions of Go, the libraries and the protocol",
+		builtinField("go", TypeString),
+		builtinField("mangos", TypeString),
+		builtinField("arrow_go", TypeString),
+		builtinField("protocol_version", TypeInt32),
+		builtinField("manifest_version", TypeInt32),
+		builtinField("os", TypeString),
+		builtinField("arch", TypeString)))
+	mustRegister(BuiltinStats, s.builtinStats, noArgs("Uptime, goroutines, memory and server counters",
+		builtinField("uptime", TypeFloat64),
+		builtinField("goroutines", TypeFloat64),
+		builtinField("heap_alloc", TypeFloat64),
+		builtinField("heap_sys", TypeFloat64),
+		builtinField("total_alloc", TypeFloat64),
+		builtinField("sys", TypeFloat64),
+		builtinField("num_gc", TypeFloat64),
+		builtinField("workers", TypeFloat64),
+		builtinField("streams", TypeFloat64),
+		builtinField("jobs", TypeFloat64),
+		builtinField("sessions", TypeFloat64),
+		builtinField("handles", TypeFloat64)))
+	mustRegister(BuiltinFunctions, s.builtinFunctions, noArgs("The functions of the server with their call counts",
+		builtinField("name", TypeString),
+		builtinField("description", TypeString),
+		builtinField("builtin", TypeBool),
+		builtinField("streaming", TypeBool),
+		builtinField("calls", TypeFloat64),
+		builtinField("errors", TypeFloat64),
+		builtinField("panics", TypeFloat64)))
+	mustRegister(BuiltinDescribe, s.builtinDescribe, FunctionSignature{
+		Args: []ArgSpec{{Name: "name", Type: TypeSpec{Type: TypeString}}},
+		ReturnType: TypeSpec{Type: TypeRecord, StructDef: &StructDef{Fields: []FieldDef{
+			builtinField("arg", TypeString),
+			builtinField("type", TypeString),
+			builtinField("nullable", TypeBool),
+			builtinField("optional", TypeBool),
+			{Name: "default", Type: TypeSpec{Type: TypeString, Nullable: true}},
+		}}},
+		Description: "The arguments of a function, with their defaults as JSON",
+	})
+	if err := r.RegisterContext(BuiltinSession, s.builtinSession, noArgs("The session of the calling client",
+		builtinField("id", TypeFloat64),
+		builtinField("address", TypeString))); err != nil {
+		panic(err)
+	}
+	if s.shutdownBuiltin {
+		shutdown := noArgs("Close the server once this call is answered", builtinField("status", TypeString))
+		shutdown.Scopes = []string{ScopeAdmin}
+		mustRegister(BuiltinShutdown, s.builtinShutdown, shutdown)
+	}
+	return r
+}
+
+func builtinField(name string, t ArrowType) FieldDef {
+	return FieldDef{Name: name, Type: TypeSpec{Type: t}}
+}
+
+// function returns the built-in or registered function name
+func (s *Server) function(name string) (*RegisteredFunction, bool) {
+	if strings.HasPrefix(name, BuiltinPrefix) {
+		return s.builtins.Get(name)
+	}
+	return s.registry.Get(name)
+}
+
+func (s *Server) uptime() float64 {
+	return time.Since(s.started).Seconds()
+}
+
+func (s *Server) builtinPing(arrow.Record) (arrow.Record, error) {
+	return NewRecordBuilder().
+		Add("status", []string{"ok"}).
+		Add("uptime", []float64{s.uptime()}).
+		NewRecord()
+}
+
+func (s *Server) builtinVersion(arrow.Record) (arrow.Record, error) {
+	return NewRecordBuilder().
+		Add("go", []string{runtime.Version()}).
+		Add("mangos", []string{moduleVersion(mangosModule)}).
+		Add("arrow_go", []string{moduleVersion(arrowGoModule)}).
+		Add("protocol_version", []int32{int32(ProtocolVersion)}).
+		Add("manifest_version", []int32{ManifestVersion}).
+		Add("os", []string{runtime.GOOS}).
+		Add("arch", []string{runtime.GOARCH}).
+		NewRecord()
+}
+
+// moduleVersion is the version of a module the binary was built with, or
+// "" when the build carries no module information
+func moduleVersion(path string) string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	for _, dep := range info.Deps {
+		if dep.Path != path {
+			continue
+		}
+		if dep.Replace != nil {
+			return dep.Replace.Version
+		}
+		return dep.Version
+	}
+	return ""
+}
+
+func (s *Server) builtinStats(arrow.Record) (arrow.Record, error) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	s.mu.Lock()
+	streams, jobs, sessions := len(s.streams), len(s.jobs), len(s.sessions)
+	s.mu.Unlock()
+	handles := 0
+	if s.handles != nil {
+		handles = len(s.handles.List())
+	}
+
+	return NewRecordBuilder().
+		Add("uptime", []float64{s.uptime()}).
+		Add("goroutines", []float64{float64(runtime.NumGoroutine())}).
+		Add("heap_alloc", []float64{float64(mem.HeapAlloc)}).
+		Add("heap_sys", []float64{float64(mem.HeapSys)}).
+		Add("total_alloc", []float64{float64(mem.TotalAlloc)}).
+		Add("sys", []float64{float64(mem.Sys)}).
+		Add("num_gc", []float64{float64(mem.NumGC)}).
+		Add("workers", []float64{float64(s.workers)}).
+		Add("streams", []float64{float64(streams)}).
+		Add("jobs", []float64{float64(jobs)}).
+		Add("sessions", []float64{float64(sessions)}).
+		Add("handles", []float64{float64(handles)}).
+		NewRecord()
+}
+
+// builtinFunctions lists the registered functions, then the built-in ones
+func (s *Server) builtinFunctions(arrow.Record) (arrow.Record, error) {
+	var (
+		names, descriptions        []string
+		builtin, streaming         []bool
+		calls, errorCounts, panics []float64
+	)
+	for _, r := range []*Registry{s.registry, s.builtins} {
+		list := r.List()
+		sort.Strings(list)
+		for _, name := range list {
+			fn, ok := r.Get(name)
+			if !ok {
+				continue
+			}
+			stats := fn.Stats()
+			names = append(names, name)
+			descriptions = append(descriptions, fn.Signature.Description)
+			builtin = append(builtin, r == s.builtins)
+			streaming = append(streaming, fn.streaming())
+			calls = append(calls, float64(stats.Calls))
+			errorCounts = append(errorCounts, float64(stats.Errors))
+			panics = append(panics, float64(stats.Panics))
+		}
+	}
+	return NewRecordBuilder().
+		Add("name", names).
+		Add("description", descriptions).
+		Add("builtin", builtin).
+		Add("streaming", streaming).
+		Add("calls", calls).
+		Add("errors", errorCounts).
+		Add("panics", panics).
+		NewRecord()
+}
+
+func (s *Server) builtinDescribe(input arrow.Record) (arrow.Record, error) {
+	name, err := ScalarArg(input, "name", "")
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := s.function(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrFunctionNotFound, name)
+	}
+
+	n := len(fn.Signature.Args)
+	var (
+		args, types        = make([]string, n), make([]string, n)
+		nullable, optional = make([]bool, n), make([]bool, n)
+		defaults           = make([]*string, n)
+	)
+	for i, arg := range fn.Signature.Args {
+		args[i] = arg.Name
+		types[i] = string(arg.Type.Type)
+		nullable[i] = fn.InputSchema.Field(i).Nullable
+		optional[i] = arg.Optional
+		if arg.Default != nil {
+			def, err := json.Marshal(arg.Default)
+			if err != nil {
+				return nil, fmt.Errorf("default of arg %s: %w", arg.Name, err)
+			}
+			s := string(def)
+			defaults[i] = &s
+		}
+	}
+	return NewRecordBuilder().
+		Add("arg", args).
+		Add("type", types).
+		Add("nullable", nullable).
+		Add("optional", optional).
+		Add("default", defaults).
+		NewRecord()
+}
+
+// builtinSession returns the session ID that the topics of the client's
+// progress events contain
+func (s *Server) builtinSession(ctx context.Context, _ arrow.Record) (arrow.Record, error) {
+	var id float64
+	var address string
+	if sess := SessionFrom(ctx); sess != nil {
+		id, address = float64(sess.ID), sess.Address
+	}
+	return NewRecordBuilder().
+		Add("id", []float64{id}).
+		Add("address", []string{address}).
+		NewRecord()
+}
+
+// builtinShutdown only answers; serveMessage closes the server shortly
+// after the reply is sent
+func (s *Server) builtinShutdown(arrow.Record) (arrow.Record, error) {
+	s.logger.Printf("shutdown requested by a client")
+	return NewRecordBuilder().Add("status", []string{"ok"}).NewRecord()
+}
+
+// shutdownGrace is how long the server keeps serving after answering
+// .shutdown
+const shutdownGrace = 100 * time.Millisecond
+
+// shutdownAfter reports whether reply answers a call to .shutdown
+func shutdownAfter(reply *RPCMessage) bool {
+	return reply.Type == MsgTypeResult && reply.FuncName == BuiltinShutdown
+}
@@ -0,0 +1,155 @@
+package rgoipc_test
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	"mangoro.local/pkg/rgoipc"
+
+	"github.com/apache/arrow/go/v18/arrow"
+	"go.nanomsg.org/mangos/v3"
+)
+
+// callBuiltin calls a built-in function and returns its result
+func callBuiltin(t *testing.T, sock mangos.Socket, name string, input []byte) arrow.Record {
+	t.Helper()
+
+	reply := roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: name, ArrowData: input})
+	if reply.Type != rgoipc.MsgTypeResult {
+		t.Fatalf("%s: %v", name, reply.Error)
+	}
+	rec, err := rgoipc.ReadArrowRecord(reply.ArrowData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(rec.Release)
+	return rec
+}
+
+func TestServerBuiltins(t *testing.T) {
+	registry := rgoipc.NewRegistry()
+	registry.Register("add", testAddHandler, rgoipc.FunctionSignature{
+		Args: []rgoipc.ArgSpec{
+			{Name: "x", Type: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64}},
+			{Name: "y", Type: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64}, Optional: true, Default: 0},
+		},
+		ReturnType:  rgoipc.TypeSpec{Type: rgoipc.TypeFloat64},
+		Description: "Add two vectors",
+	})
+	if err := registry.Register(".mine", testAddHandler, rgoipc.FunctionSignature{}); err == nil {
+		t.Error("registered a function with a reserved name")
+	}
+	url, _ := startTestServer(t, registry, rgoipc.WithValidation(rgoipc.ValidateInput|rgoipc.ValidateOutput))
+	sock := dialTestClient(t, url)
+
+	if status, _ := rgoipc.Column[string](callBuiltin(t, sock, rgoipc.BuiltinPing, nil), "status"); status[0] != "ok" {
+		t.Errorf(".ping status = %v", status)
+	}
+
+	version := callBuiltin(t, sock, rgoipc.BuiltinVersion, nil)
+	if goVersion, _ := rgoipc.Column[string](version, "go"); goVersion[0] != runtime.Version() {
+		t.Errorf(".version go = %v", goVersion)
+	}
+	if protocol, _ := rgoipc.Column[int32](version, "protocol_version"); protocol[0] != int32(rgoipc.ProtocolVersion) {
+		t.Errorf(".version protocol_version = %v", protocol)
+	}
+
+	if goroutines, _ := rgoipc.Column[float64](callBuiltin(t, sock, rgoipc.BuiltinStats, nil), "goroutines"); goroutines[0] < 1 {
+		t.Errorf(".stats goroutines = %v", goroutines)
+	}
+
+	// Call counts per function
+	input := float64Record(t, []string{"x", "y"}, []float64{1}, []float64{2})
+	roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "add", ArrowData: input})
+	roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "add", ArrowData: input})
+	functions := callBuiltin(t, sock, rgoipc.BuiltinFunctions, nil)
+	names, _ := rgoipc.Column[string](functions, "name")
+	calls, _ := rgoipc.Column[float64](functions, "calls")
+	builtin, _ := rgoipc.Column[bool](functions, "builtin")
+	if names[0] != "add" || calls[0] != 2 || builtin[0] {
+		t.Errorf(".functions: first row %v %v %v", names[0], calls[0], builtin[0])
+	}
+	if len(names) != 7 || !builtin[len(builtin)-1] {
+		t.Errorf(".functions lists %v", names)
+	}
+
+	args := callBuiltin(t, sock, rgoipc.BuiltinDescribe, testStringRecord(t, "name", "add"))
+	argNames, _ := rgoipc.Column[string](args, "arg")
+	defaults, _ := rgoipc.Column[*string](args, "default")
+	if len(argNames) != 2 || argNames[1] != "y" || defaults[0] != nil || *defaults[1] != "0" {
+		t.Errorf(".describe add: %v %v", argNames, defaults)
+	}
+	reply := roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: rgoipc.BuiltinDescribe, ArrowData: testStringRecord(t, "name", "nope")})
+	if reply.Error == nil || reply.Error.Code != rgoipc.CodeFunctionNotFound {
+		t.Errorf(".describe of an unknown function: %v", reply.Error)
+	}
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: ".nope"})
+	if reply.Error == nil || reply.Error.Code != rgoipc.CodeFunctionNotFound {
+		t.Errorf("unknown built-in: %v", reply.Error)
+	}
+
+	// The manifest only lists the registered functions
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeManifest})
+	manifest, err := rgoipc.ParseManifest(reply.ArrowData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Functions) != 1 {
+		t.Errorf("manifest lists %d functions", len(manifest.Functions))
+	}
+}
+
+func TestServerShutdownBuiltin(t *testing.T) {
+	// .shutdown is opt-in
+	url, _ := startTestServer(t, rgoipc.NewRegistry())
+	reply := roundTrip(t, dialTestClient(t, url), &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: rgoipc.BuiltinShutdown})
+	if !errors.Is(reply.Error, rgoipc.ErrFunctionNotFound) {
+		t.Errorf(".shutdown without WithShutdownBuiltin: %v", reply.Error)
+	}
+
+	url, _ = startTestServer(t, rgoipc.NewRegistry(), rgoipc.WithShutdownBuiltin())
+	sock := dialTestClient(t, url)
+
+	// Only a direct call closes the server, so it cannot be submitted
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeSubmit, FuncName: rgoipc.BuiltinShutdown})
+	if !errors.Is(reply.Error, rgoipc.ErrInvalidMessage) {
+		t.Errorf(".shutdown as a job: %v", reply.Error)
+	}
+
+	if status, _ := rgoipc.Column[string](callBuiltin(t, sock, rgoipc.BuiltinShutdown, nil), "status"); status[0] != "ok" {
+		t.Errorf(".shutdown status = %v", status)
+	}
+	// The server closes shortly after: requests go unanswered
+	sock.SetOption(mangos.OptionSendDeadline, 100*time.Millisecond)
+	sock.SetOption(mangos.OptionRecvDeadline, 100*time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if err := sock.Send((&rgoipc.RPCMessage{Type: rgoipc.MsgTypeManifest}).Marshal()); err != nil {
+			break
+		}
+		if _, err := sock.Recv(); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server still answers after .shutdown")
+		}
+	}
+}
+
+// testStringRecord is a one-row record with a string column
+func testStringRecord(t *testing.T, name, value string) []byte {
+	t.Helper()
+
+	rec, err := rgoipc.NewRecordBuilder().Add(name, []string{value}).NewRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rec.Release()
+	data, err := rgoipc.WriteArrowRecord(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
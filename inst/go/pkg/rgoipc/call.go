@@ -0,0 +1,169 @@
+package rgoipc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+
+	"github.com/apache/arrow/go/v18/arrow"
+)
+
+// Call runs the handler on input; the batches of a streaming function are
+// concatenated into one record. A panic in the handler is recovered and
+// returned as an RPCError with CodeHandlerPanic and the handler's stack, so
+// one bad call cannot take the whole server down.
+func (fn *RegisteredFunction) Call(input arrow.Record) (arrow.Record, error) {
+	return fn.CallContext(context.Background(), input)
+}
+
+// CallContext is Call with a context, which ContextHandler, StreamHandler
+// and ReaderHandler functions receive. When ctx ends before the handler
+// returns, CallContext returns an ErrCancelled or ErrDeadlineExceeded error
+// right away; a handler that ignores ctx keeps running in the background
+// and its late result is released. A Server replies at once but keeps the
+// worker of the request until such a handler returns.
+func (fn *RegisteredFunction) CallContext(ctx context.Context, input arrow.Record) (arrow.Record, error) {
+	if ctx.Done() == nil {
+		return fn.call(ctx, input)
+	}
+	if ctx.Err() != nil {
+		return nil, contextError(ctx)
+	}
+
+	type outcome struct {
+		result arrow.Record
+		err    error
+	}
+	done := make(chan outcome, 1)
+	input.Retain()
+	go func() {
+		defer input.Release()
+		result, err := fn.call(ctx, input)
+		done <- outcome{result, err}
+	}()
+
+	select {
+	case o := <-done:
+		return o.result, o.err
+	case <-ctx.Done():
+		release := holdWorker(ctx)
+		go func() {
+			defer release()
+			if o := <-done; o.result != nil {
+				o.result.Release()
+			}
+		}()
+		return nil, contextError(ctx)
+	}
+}
+
+// workerHold counts the handlers a request abandoned while they run
+type workerHold struct {
+	mu   sync.Mutex
+	wg   sync.WaitGroup
+	done bool // wait was called; later handlers are not counted
+}
+
+// workerHoldKey is the context key of the workerHold of a request
+type workerHoldKey struct{}
+
+// holdWorker counts an abandoned handler against the request of ctx, if
+// any, and returns the function to call when it returns
+func holdWorker(ctx context.Context) (release func()) {
+	h, ok := ctx.Value(workerHoldKey{}).(*workerHold)
+	if !ok {
+		return func() {}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.done {
+		return func() {}
+	}
+	h.wg.Add(1)
+	return h.wg.Done
+}
+
+// wait blocks until the abandoned handlers counted so far return
+func (h *workerHold) wait() {
+	h.mu.Lock()
+	h.done = true
+	h.mu.Unlock()
+	h.wg.Wait()
+}
+
+// call runs the handler of any kind of function, recovering panics
+func (fn *RegisteredFunction) call(ctx context.Context, input arrow.Record) (result arrow.Record, err error) {
+	if fn.streaming() {
+		return fn.collect(ctx, input) // CallStream recovers and counts
+	}
+
+	defer fn.stats.count(&err)
+	defer func() {
+		if r := recover(); r != nil {
+			result = nil
+			err = fn.recovered(r)
+		}
+	}()
+	return fn.callRecord(ctx, input)
+}
+
+// callRecord runs the handler of a function returning a single record
+func (fn *RegisteredFunction) callRecord(ctx context.Context, input arrow.Record) (arrow.Record, error) {
+	if fn.ContextHandler != nil {
+		return fn.ContextHandler(ctx, input)
+	}
+	return fn.Handler(input)
+}
+
+// contextError describes why ctx ended, as an error wrapping ErrCancelled
+// or ErrDeadlineExceeded
+func contextError(ctx context.Context) error {
+	cause := context.Cause(ctx)
+	switch {
+	case errors.Is(cause, ErrCancelled), errors.Is(cause, ErrDeadlineExceeded):
+		return cause
+	case errors.Is(cause, context.DeadlineExceeded):
+		return fmt.Errorf("%w: %w", ErrDeadlineExceeded, cause)
+	default:
+		return fmt.Errorf("%w: %w", ErrCancelled, cause)
+	}
+}
+
+// Stats returns a snapshot of the function's counters
+func (fn *RegisteredFunction) Stats() FunctionStats {
+	return FunctionStats{
+		Calls:  fn.stats.calls.Load(),
+		Errors: fn.stats.errors.Load(),
+		Panics: fn.stats.panics.Load(),
+	}
+}
+
+// recovered turns a panic recovered from the handler of fn into an error.
+// Allocations over the call's limit (see LimitedAllocator) give their limit
+// error; anything else counts as a panic.
+func (fn *RegisteredFunction) recovered(r interface{}) error {
+	if err, ok := r.(error); ok && errors.Is(err, ErrLimitExceeded) {
+		return err
+	}
+	fn.stats.panics.Add(1)
+	return panicError(fn.Name, r, debug.Stack())
+}
+
+// panicError describes a recovered panic value
+func panicError(name string, r interface{}, stack []byte) *RPCError {
+	out := &RPCError{
+		Code:    CodeHandlerPanic,
+		Message: fmt.Sprintf("panic in %s: %v", name, r),
+		Causes:  []string{ErrHandlerPanic.Error()},
+		Stack:   string(stack),
+		cause:   ErrHandlerPanic,
+	}
+	if err, ok := r.(error); ok {
+		out.Causes = append(out.Causes, err.Error())
+		out.Causes = append(out.Causes, errorChain(err)...)
+		out.cause = fmt.Errorf("%w: %w", ErrHandlerPanic, err)
+	}
+	return out
+}
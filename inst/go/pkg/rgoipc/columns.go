@@ -0,0 +1,221 @@
+package rgoipc
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/apache/arrow/go/v18/arrow"
+	"github.com/apache/arrow/go/v18/arrow/array"
+	"github.com/apache/arrow/go/v18/arrow/memory"
+)
+
+// ColumnByName returns the column called name. A missing column is an
+// invalid_schema error. The column is owned by rec.
+func ColumnByName(rec arrow.Record, name string) (arrow.Array, error) {
+	idx := rec.Schema().FieldIndices(name)
+	if len(idx) == 0 {
+		return nil, NewError(CodeInvalidSchema, "missing column %s", name).WithDetail(name, "missing column")
+	}
+	return rec.Column(idx[0]), nil
+}
+
+// Column returns column name as Go values. T is any type accepted by
+// RegisterFunc: float64, int32, int, int64, string, bool, []byte,
+// time.Time, arrow.Date32 or Factor, or *T / Optional[T] of these to allow
+// nulls. Columns of other types (durations, lists, structs, ...) are read
+// with ColumnByName. The column is converted like ValidateInput does, so
+// Column[float64] also reads an R integer column.
+func Column[T any](rec arrow.Record, name string) ([]T, error) {
+	col, err := ColumnByName(rec, name)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := newValueCodec(reflect.TypeOf((*T)(nil)).Elem())
+	if err != nil {
+		return nil, err
+	}
+	converted, err := codec.convert(col, memory.DefaultAllocator)
+	if err != nil {
+		return nil, NewError(CodeInvalidSchema, "column %s: %s", name, err).WithDetail(name, err.Error())
+	}
+	defer converted.Release()
+	return codec.slice(converted).Interface().([]T), nil
+}
+
+// ScalarArg returns the first value of column name, for arguments that R
+// sends as a length-one vector. def is returned when the column is missing,
+// has no rows or its first value is NA.
+func ScalarArg[T any](rec arrow.Record, name string, def T) (T, error) {
+	col, err := ColumnByName(rec, name)
+	if err != nil || col.Len() == 0 || col.IsNull(0) {
+		return def, nil
+	}
+	first := array.NewSlice(col, 0, 1)
+	defer first.Release()
+
+	codec, err := newValueCodec(reflect.TypeOf((*T)(nil)).Elem())
+	if err != nil {
+		return def, err
+	}
+	converted, err := codec.convert(first, memory.DefaultAllocator)
+	if err != nil {
+		return def, NewError(CodeInvalidSchema, "column %s: %s", name, err).WithDetail(name, err.Error())
+	}
+	defer converted.Release()
+	return codec.value(converted, 0).Interface().(T), nil
+}
+
+// CopyArray returns a deep copy of arr with its own buffers. It works for
+// every Arrow type, nested ones included, and compacts sliced arrays.
+func CopyArray(arr arrow.Array) (arrow.Array, error) {
+	return copyArray(arr, memory.DefaultAllocator)
+}
+
+// copyArray is CopyArray allocating with mem
+func copyArray(arr arrow.Array, mem memory.Allocator) (arrow.Array, error) {
+	return array.Concatenate([]arrow.Array{arr}, mem)
+}
+
+// RecordBuilder builds a multi-column result from Go slices, Go structs or
+// existing Arrow arrays:
+//
+//	rec, err := rgoipc.NewRecordBuilder().
+//		Add("status", []string{"ok"}).
+//		Add("value", []rgoipc.Optional[float64]{rgoipc.Some(1.5)}).
+//		NewRecord()
+//
+// The first error is kept and returned by NewRecord; later calls are
+// no-ops. Columns are allocated with memory.DefaultAllocator unless
+// UseAllocator says otherwise.
+type RecordBuilder struct {
+	mem    memory.Allocator
+	fields []arrow.Field
+	cols   []arrow.Array
+	rows   int
+	err    error
+}
+
+// NewRecordBuilder creates an empty RecordBuilder
+func NewRecordBuilder() *RecordBuilder {
+	return &RecordBuilder{mem: memory.DefaultAllocator, rows: -1}
+}
+
+// UseAllocator allocates the columns added from now on with mem. Handlers
+// pass Allocator(ctx), so that their results count against the server's
+// MaxAllocation.
+func (b *RecordBuilder) UseAllocator(mem memory.Allocator) *RecordBuilder {
+	b.mem = mem
+	return b
+}
+
+// Add appends a column built from a slice of any type accepted by Column.
+// The column is nullable if the element type is *T or Optional[T]. Columns
+// of other Arrow types are added with AddArray.
+func (b *RecordBuilder) Add(name string, values interface{}) *RecordBuilder {
+	if b.err != nil {
+		return b
+	}
+	v := reflect.ValueOf(values)
+	if v.Kind() != reflect.Slice {
+		b.err = fmt.Errorf("column %s: expected a slice, got %T", name, values)
+		return b
+	}
+	col, codec, err := buildColumn(v, b.mem)
+	if err != nil {
+		b.err = fmt.Errorf("column %s: %w", name, err)
+		return b
+	}
+	return b.add(arrow.Field{Name: name, Type: codec.dataType, Nullable: codec.nullable()}, col)
+}
+
+// AddArray appends a deep copy of arr (see CopyArray)
+func (b *RecordBuilder) AddArray(name string, arr arrow.Array) *RecordBuilder {
+	if b.err != nil {
+		return b
+	}
+	col, err := copyArray(arr, b.mem)
+	if err != nil {
+		b.err = fmt.Errorf("column %s: %w", name, err)
+		return b
+	}
+	return b.add(arrow.Field{Name: name, Type: col.DataType(), Nullable: true}, col)
+}
+
+// AddStructs appends one column per exported field of a slice of structs.
+// The column name is the field name, or the name in an `rgoipc:"name"` tag;
+// `rgoipc:"-"` skips the field.
+func (b *RecordBuilder) AddStructs(rows interface{}) *RecordBuilder {
+	if b.err != nil {
+		return b
+	}
+	v := reflect.ValueOf(rows)
+	if v.Kind() != reflect.Slice || v.Type().Elem().Kind() != reflect.Struct {
+		b.err = fmt.Errorf("expected a slice of structs, got %T", rows)
+		return b
+	}
+
+	st := v.Type().Elem()
+	for i := 0; i < st.NumField(); i++ {
+		f := st.Field(i)
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("rgoipc"); ok {
+			name = tag
+		}
+		if !f.IsExported() || name == "-" {
+			continue
+		}
+
+		values := reflect.MakeSlice(reflect.SliceOf(f.Type), v.Len(), v.Len())
+		for row := 0; row < v.Len(); row++ {
+			values.Index(row).Set(v.Index(row).Field(i))
+		}
+		b.Add(name, values.Interface())
+	}
+	return b
+}
+
+func (b *RecordBuilder) add(field arrow.Field, col arrow.Array) *RecordBuilder {
+	if b.rows >= 0 && col.Len() != b.rows {
+		b.err = fmt.Errorf("column %s has %d rows, expected %d", field.Name, col.Len(), b.rows)
+		col.Release()
+		return b
+	}
+	b.rows = col.Len()
+	b.fields = append(b.fields, field)
+	b.cols = append(b.cols, col)
+	return b
+}
+
+// NewRecord returns the record, or the first error of the builder calls.
+// The builder is reset either way.
+func (b *RecordBuilder) NewRecord() (arrow.Record, error) {
+	defer b.Release()
+	if b.err != nil {
+		return nil, b.err
+	}
+	return array.NewRecord(arrow.NewSchema(b.fields, nil), b.cols, int64(max(b.rows, 0))), nil
+}
+
+// Release frees the columns added so far without building a record
+func (b *RecordBuilder) Release() {
+	for _, c := range b.cols {
+		c.Release()
+	}
+	*b = RecordBuilder{mem: b.mem, rows: -1}
+}
+
+// buildColumn converts a Go slice to an Arrow array allocated with mem
+func buildColumn(values reflect.Value, mem memory.Allocator) (arrow.Array, *valueCodec, error) {
+	codec, err := newValueCodec(values.Type().Elem())
+	if err != nil {
+		return nil, nil, err
+	}
+	builder := array.NewBuilder(mem, codec.dataType)
+	defer builder.Release()
+	for i := 0; i < values.Len(); i++ {
+		if err := codec.append(builder, values.Index(i)); err != nil {
+			return nil, nil, fmt.Errorf("row %d: %w", i+1, err)
+		}
+	}
+	return builder.NewArray(), codec, nil
+}
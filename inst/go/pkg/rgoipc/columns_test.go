@@ -0,0 +1,171 @@
+package rgoipc_test
+
+import (
+	"errors"
+	"time"
+	"testing"
+
+	"mangoro.local/pkg/rgoipc"
+
+	"github.com/apache/arrow/go/v18/arrow"
+	"github.com/apache/arrow/go/v18/arrow/array"
+	"github.com/apache/arrow/go/v18/arrow/memory"
+)
+
+func TestColumnAndScalarArg(t *testing.T) {
+	pool := memory.NewGoAllocator()
+	nb := array.NewInt32Builder(pool)
+	nb.AppendValues([]int32{3, 0}, []bool{true, false})
+	n := nb.NewArray()
+	defer n.Release()
+	sb := array.NewStringBuilder(pool)
+	sb.AppendValues([]string{"-", "-"}, nil)
+	sep := sb.NewArray()
+	defer sep.Release()
+
+	rec := array.NewRecord(arrow.NewSchema([]arrow.Field{
+		{Name: "n", Type: arrow.PrimitiveTypes.Int32, Nullable: true},
+		{Name: "sep", Type: arrow.BinaryTypes.String},
+	}, nil), []arrow.Array{n, sep}, 2)
+	defer rec.Release()
+
+	// An R integer column read as nullable doubles
+	values, err := rgoipc.Column[rgoipc.Optional[float64]](rec, "n")
+	if err != nil {
+		t.Fatalf("Column: %v", err)
+	}
+	if len(values) != 2 || values[0] != rgoipc.Some(3.0) || values[1].Valid {
+		t.Errorf("got %v", values)
+	}
+
+	if _, err := rgoipc.Column[int](rec, "n"); !errors.Is(err, rgoipc.ErrInvalidSchema) {
+		t.Errorf("expected invalid_schema for NA in []int, got %v", err)
+	}
+	if _, err := rgoipc.Column[string](rec, "missing"); !errors.Is(err, rgoipc.ErrInvalidSchema) {
+		t.Errorf("expected invalid_schema for a missing column, got %v", err)
+	}
+
+	if got, err := rgoipc.ScalarArg(rec, "sep", ","); err != nil || got != "-" {
+		t.Errorf("ScalarArg(sep) = %q, %v", got, err)
+	}
+	if got, err := rgoipc.ScalarArg(rec, "collapse", ","); err != nil || got != "," {
+		t.Errorf("ScalarArg(collapse) = %q, %v; want the default", got, err)
+	}
+}
+
+func TestRecordBuilder(t *testing.T) {
+	type row struct {
+		Name   string
+		Score  *float64 `rgoipc:"score"`
+		secret int
+		Skip   bool `rgoipc:"-"`
+	}
+	score := 1.5
+	rows := []row{{Name: "a", Score: &score}, {Name: "b"}}
+
+	rec, err := rgoipc.NewRecordBuilder().
+		AddStructs(rows).
+		Add("rank", []int{1, 2}).
+		NewRecord()
+	if err != nil {
+		t.Fatalf("NewRecord: %v", err)
+	}
+	defer rec.Release()
+
+	want := arrow.NewSchema([]arrow.Field{
+		{Name: "Name", Type: arrow.BinaryTypes.String},
+		{Name: "score", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
+		{Name: "rank", Type: arrow.PrimitiveTypes.Int32},
+	}, nil)
+	if !rec.Schema().Equal(want) || rec.NumRows() != 2 {
+		t.Fatalf("schema %s with %d rows, want %s", rec.Schema(), rec.NumRows(), want)
+	}
+	scores := rec.Column(1).(*array.Float64)
+	if scores.Value(0) != 1.5 || !scores.IsNull(1) {
+		t.Errorf("scores: %v", scores)
+	}
+
+	_, err = rgoipc.NewRecordBuilder().
+		Add("a", []float64{1, 2}).
+		Add("b", []float64{1}).
+		NewRecord()
+	if err == nil {
+		t.Error("expected an error for columns of different lengths")
+	}
+}
+
+func TestRecordBuilderCopiesNestedArrays(t *testing.T) {
+	pool := memory.NewGoAllocator()
+	st := arrow.StructOf(
+		arrow.Field{Name: "name", Type: arrow.BinaryTypes.String},
+		arrow.Field{Name: "tags", Type: arrow.ListOf(arrow.BinaryTypes.String)},
+	)
+	b := array.NewStructBuilder(pool, st)
+	names := b.FieldBuilder(0).(*array.StringBuilder)
+	tags := b.FieldBuilder(1).(*array.ListBuilder)
+	for _, name := range []string{"a", "b", "c"} {
+		b.Append(true)
+		names.Append(name)
+		tags.Append(true)
+		tags.ValueBuilder().(*array.StringBuilder).Append(name + name)
+	}
+	people := b.NewArray()
+	b.Release()
+
+	// A slice of the column, released before the copy is read
+	sliced := array.NewSlice(people, 1, 3)
+	people.Release()
+	rec, err := rgoipc.NewRecordBuilder().AddArray("person", sliced).NewRecord()
+	sliced.Release()
+	if err != nil {
+		t.Fatalf("NewRecord: %v", err)
+	}
+	defer rec.Release()
+
+	col := rec.Column(0).(*array.Struct)
+	if col.Len() != 2 || col.Field(0).(*array.String).Value(0) != "b" {
+		t.Errorf("copied column: %v", col)
+	}
+	if got := col.Field(1).(*array.List).ListValues().(*array.String).Value(1); got != "cc" {
+		t.Errorf("nested list value: %q", got)
+	}
+}
+
+func TestRecordBuilderTypedVectors(t *testing.T) {
+	when := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	rec, err := rgoipc.NewRecordBuilder().
+		Add("raw", [][]byte{{1, 2}, {}}).
+		Add("when", []time.Time{when, when.Add(time.Hour)}).
+		Add("day", []rgoipc.Optional[arrow.Date32]{rgoipc.Some(arrow.Date32FromTime(when)), rgoipc.None[arrow.Date32]()}).
+		Add("level", []rgoipc.Factor{"low", "low"}).
+		NewRecord()
+	if err != nil {
+		t.Fatalf("NewRecord: %v", err)
+	}
+	defer rec.Release()
+
+	for i, want := range []arrow.Type{arrow.BINARY, arrow.TIMESTAMP, arrow.DATE32, arrow.DICTIONARY} {
+		if got := rec.Column(i).DataType().ID(); got != want {
+			t.Errorf("column %d: %s, want %s", i, got, want)
+		}
+	}
+
+	raw, err := rgoipc.Column[[]byte](rec, "raw")
+	if err != nil || len(raw) != 2 || len(raw[0]) != 2 || raw[0][1] != 2 {
+		t.Errorf("Column[[]byte] = %v, %v", raw, err)
+	}
+	if got, err := rgoipc.ScalarArg(rec, "when", time.Time{}); err != nil || !got.Equal(when) {
+		t.Errorf("ScalarArg[time.Time] = %v, %v", got, err)
+	}
+	days, err := rgoipc.Column[*arrow.Date32](rec, "day")
+	if err != nil || *days[0] != arrow.Date32FromTime(when) || days[1] != nil {
+		t.Errorf("Column[*arrow.Date32] = %v, %v", days, err)
+	}
+	// A factor reads as levels, or as plain strings
+	if levels, err := rgoipc.Column[rgoipc.Factor](rec, "level"); err != nil || levels[1] != "low" {
+		t.Errorf("Column[Factor] = %v, %v", levels, err)
+	}
+	if levels, err := rgoipc.Column[string](rec, "level"); err != nil || levels[0] != "low" {
+		t.Errorf("Column[string] of a factor = %v, %v", levels, err)
+	}
+}
@@ -0,0 +1,141 @@
+package rgoipc_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"mangoro.local/pkg/rgoipc"
+
+	"github.com/apache/arrow/go/v18/arrow"
+	"go.nanomsg.org/mangos/v3"
+)
+
+// waitHandler blocks until its call is cancelled, announcing on started
+// that it runs
+func waitHandler(started chan<- struct{}) rgoipc.ContextHandler {
+	return func(ctx context.Context, _ arrow.Record) (arrow.Record, error) {
+		if started != nil {
+			started <- struct{}{}
+		}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+}
+
+func TestServerDeadlines(t *testing.T) {
+	stuck := make(chan struct{})
+	var unstick sync.Once
+
+	registry := rgoipc.NewRegistry()
+	registry.RegisterContext("wait", waitHandler(nil), rgoipc.FunctionSignature{
+		ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeDynamic},
+		Timeout:    50 * time.Millisecond,
+	})
+	// A handler without a context cannot be stopped, only abandoned, and
+	// keeps its worker until it returns
+	registry.Register("stuck", func(arrow.Record) (arrow.Record, error) {
+		<-stuck
+		return nil, errors.New("too late")
+	}, rgoipc.FunctionSignature{ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeDynamic}})
+	registry.RegisterStream("stuckStream", func(context.Context, arrow.Record, rgoipc.RecordWriter) error {
+		<-stuck
+		return errors.New("too late")
+	}, rgoipc.FunctionSignature{ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeDynamic}})
+
+	url, _ := startTestServer(t, registry, rgoipc.WithWorkers(1), rgoipc.WithLogger(log.New(io.Discard, "", 0)))
+	t.Cleanup(func() { unstick.Do(func() { close(stuck) }) }) // before the server's
+	sock := dialTestClient(t, url)
+
+	reply := roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "wait"})
+	if reply.Error == nil || reply.Error.Code != rgoipc.CodeDeadlineExceeded {
+		t.Errorf("function timeout: expected deadline_exceeded, got %v", reply.Error)
+	}
+
+	// Waiting for the first chunk of a stream stops at the deadline
+	start := time.Now()
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "stuckStream", Flags: rgoipc.FlagStream, Timeout: 50 * time.Millisecond})
+	if reply.Error == nil || reply.Error.Code != rgoipc.CodeDeadlineExceeded {
+		t.Errorf("stream deadline: expected deadline_exceeded, got %v", reply.Error)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("stream deadline took %s", elapsed)
+	}
+
+	start = time.Now()
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "stuck", Timeout: 50 * time.Millisecond})
+	if reply.Error == nil || reply.Error.Code != rgoipc.CodeDeadlineExceeded {
+		t.Errorf("client deadline: expected deadline_exceeded, got %v", reply.Error)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("client deadline took %s", elapsed)
+	}
+
+	// The only worker is held by the abandoned handler until it returns
+	sock.SetOption(mangos.OptionRecvDeadline, 100*time.Millisecond)
+	if err := sock.Send((&rgoipc.RPCMessage{Type: rgoipc.MsgTypeManifest}).Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sock.Recv(); err != mangos.ErrRecvTimeout {
+		t.Errorf("request served while the abandoned handler runs: %v", err)
+	}
+	unstick.Do(func() { close(stuck) })
+	sock.SetOption(mangos.OptionRecvDeadline, 5*time.Second)
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeManifest})
+	if reply.Type != rgoipc.MsgTypeManifest {
+		t.Errorf("server stuck after an abandoned call: %q", reply.ErrorMsg)
+	}
+}
+
+func TestServerCancel(t *testing.T) {
+	started := make(chan struct{}, 1)
+	registry := rgoipc.NewRegistry()
+	registry.RegisterContext("wait", waitHandler(started), rgoipc.FunctionSignature{
+		ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeDynamic},
+	})
+	url, _ := startTestServer(t, registry, rgoipc.WithWorkers(2))
+	caller := dialTestClient(t, url)
+	other := dialTestClient(t, url)
+
+	// The cancel comes from a second REQ context of the calling socket:
+	// request IDs only identify calls within one client
+	canceller, err := caller.OpenContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { canceller.Close() })
+	canceller.SetOption(mangos.OptionRecvDeadline, 5*time.Second)
+
+	replies := make(chan *rgoipc.RPCMessage, 1)
+	go func() {
+		replies <- roundTrip(t, caller, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "wait", RequestID: 42})
+	}()
+	<-started
+
+	reply := roundTrip(t, other, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCancel, RequestID: 42})
+	if !errors.Is(reply.Error, rgoipc.ErrInvalidMessage) {
+		t.Errorf("another client cancelled request 42: %v", reply.Error)
+	}
+
+	ack := roundTrip(t, canceller, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCancel, RequestID: 42})
+	if ack.Type != rgoipc.MsgTypeCancel || ack.RequestID != 42 {
+		t.Errorf("cancel not acknowledged: type %d, %q", ack.Type, ack.ErrorMsg)
+	}
+	select {
+	case reply := <-replies:
+		if reply.Error == nil || reply.Error.Code != rgoipc.CodeCancelled || reply.RequestID != 42 {
+			t.Errorf("expected a cancelled reply to request 42, got %v", reply.Error)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelled call did not return")
+	}
+
+	reply = roundTrip(t, canceller, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCancel, RequestID: 42})
+	if !errors.Is(reply.Error, rgoipc.ErrInvalidMessage) {
+		t.Errorf("cancelling a finished call: %v", reply.Error)
+	}
+}
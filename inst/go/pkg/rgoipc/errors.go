@@ -1,6 +1,9 @@
 package rgoipc
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	// ErrFunctionNotFound is returned when a function is not registered
@@ -14,4 +17,188 @@ var (
 
 	// ErrExecutionFailed is returned when function execution fails
 	ErrExecutionFailed = errors.New("function execution failed")
+
+	// ErrHandlerPanic is returned when a handler panicked and was recovered
+	ErrHandlerPanic = errors.New("handler panicked")
+
+	// ErrOutputMismatch is returned when a handler result does not match
+	// the declared return type
+	ErrOutputMismatch = errors.New("output does not match the declared return type")
+
+	// ErrCancelled is returned when a call was cancelled by the client
+	// (MsgTypeCancel) or by the server shutting down
+	ErrCancelled = errors.New("call cancelled")
+
+	// ErrDeadlineExceeded is returned when a call ran past its timeout
+	ErrDeadlineExceeded = errors.New("deadline exceeded")
+
+	// ErrJobNotFound is returned for unknown or expired job IDs
+	ErrJobNotFound = errors.New("job not found")
+
+	// ErrJobPending is returned when the result of an unfinished job is
+	// fetched
+	ErrJobPending = errors.New("job not finished")
+
+	// ErrHandleNotFound is returned for unknown, released or expired
+	// handle IDs
+	ErrHandleNotFound = errors.New("handle not found")
+
+	// ErrPermissionDenied is returned when the server's Authorizer refuses
+	// a call
+	ErrPermissionDenied = errors.New("permission denied")
+
+	// ErrLimitExceeded is returned when a request goes over one of the
+	// server's Limits
+	ErrLimitExceeded = errors.New("limit exceeded")
+)
+
+// ErrorCode is the machine-readable kind of an error reply
+type ErrorCode string
+
+const (
+	CodeFunctionNotFound ErrorCode = "function_not_found" // ErrFunctionNotFound
+	CodeInvalidMessage   ErrorCode = "invalid_message"    // ErrInvalidMessage
+	CodeInvalidSchema    ErrorCode = "invalid_schema"     // ErrInvalidSchema
+	CodeExecutionFailed  ErrorCode = "execution_failed"   // ErrExecutionFailed
+	CodeHandlerPanic     ErrorCode = "handler_panic"      // ErrHandlerPanic
+	CodeOutputMismatch   ErrorCode = "output_mismatch"    // ErrOutputMismatch
+	CodeCancelled        ErrorCode = "cancelled"          // ErrCancelled
+	CodeDeadlineExceeded ErrorCode = "deadline_exceeded"  // ErrDeadlineExceeded
+	CodeJobNotFound      ErrorCode = "job_not_found"      // ErrJobNotFound
+	CodeJobPending       ErrorCode = "job_pending"        // ErrJobPending
+	CodeHandleNotFound   ErrorCode = "handle_not_found"   // ErrHandleNotFound
+	CodePermissionDenied ErrorCode = "permission_denied"  // ErrPermissionDenied
+	CodeLimitExceeded    ErrorCode = "limit_exceeded"     // ErrLimitExceeded
+	CodeInternal         ErrorCode = "internal"           // anything else
 )
+
+// codeSentinels maps codes to the sentinel errors they stand for.
+// The first sentinel found in an error chain decides its code.
+var codeSentinels = []struct {
+	code ErrorCode
+	err  error
+}{
+	{CodeHandlerPanic, ErrHandlerPanic},
+	{CodeDeadlineExceeded, ErrDeadlineExceeded},
+	{CodeCancelled, ErrCancelled},
+	{CodeOutputMismatch, ErrOutputMismatch},
+	{CodeFunctionNotFound, ErrFunctionNotFound},
+	{CodeJobNotFound, ErrJobNotFound},
+	{CodeJobPending, ErrJobPending},
+	{CodeHandleNotFound, ErrHandleNotFound},
+	{CodePermissionDenied, ErrPermissionDenied},
+	{CodeLimitExceeded, ErrLimitExceeded},
+	{CodeInvalidMessage, ErrInvalidMessage},
+	{CodeInvalidSchema, ErrInvalidSchema},
+	{CodeExecutionFailed, ErrExecutionFailed},
+}
+
+// RPCError is the structured form of an error reply. It travels as JSON in
+// the error section of v2 messages (see FlagErrorDetail); v1 clients only
+// get Message.
+//
+// Handlers can return an RPCError, directly or wrapped, to choose the code
+// and attach details.
+type RPCError struct {
+	Code    ErrorCode         `json:"code"`
+	Message string            `json:"message"`
+	Causes  []string          `json:"causes,omitempty"`  // wrapped errors, outermost first
+	Details map[string]string `json:"details,omitempty"` // free-form key/value context
+	Stack   string            `json:"stack,omitempty"`   // handler stack trace, if it panicked
+
+	cause error // local error chain, not serialized
+}
+
+// NewError creates an RPCError with a formatted message
+func NewError(code ErrorCode, format string, args ...interface{}) *RPCError {
+	return &RPCError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// WithDetail adds a key/value detail and returns e
+func (e *RPCError) WithDetail(key, value string) *RPCError {
+	if e.Details == nil {
+		e.Details = make(map[string]string)
+	}
+	e.Details[key] = value
+	return e
+}
+
+func (e *RPCError) Error() string {
+	return e.Message
+}
+
+// Unwrap returns the local error the RPCError was built from, if any
+func (e *RPCError) Unwrap() error {
+	return e.cause
+}
+
+// Is reports whether target is the sentinel matching e.Code, so that
+// errors.Is(err, ErrFunctionNotFound) also holds for decoded replies
+func (e *RPCError) Is(target error) bool {
+	for _, cs := range codeSentinels {
+		if cs.code == e.Code {
+			return cs.err == target
+		}
+	}
+	return false
+}
+
+// AsRPCError converts err into an RPCError. The message is err.Error(),
+// the causes are the messages of the wrapped errors, and the code comes from
+// the first sentinel or RPCError found in the chain (CodeInternal if none).
+func AsRPCError(err error) *RPCError {
+	if err == nil {
+		return nil
+	}
+
+	out := &RPCError{
+		Code:    CodeInternal,
+		Message: err.Error(),
+		Causes:  errorChain(err),
+		cause:   err,
+	}
+
+	var inner *RPCError
+	if errors.As(err, &inner) {
+		out.Code = inner.Code
+		out.Stack = inner.Stack
+		for k, v := range inner.Details {
+			out.WithDetail(k, v)
+		}
+		return out
+	}
+
+	for _, cs := range codeSentinels {
+		if errors.Is(err, cs.err) {
+			out.Code = cs.code
+			break
+		}
+	}
+	return out
+}
+
+// errorChain lists the messages of the errors wrapped by err, depth first.
+// An RPCError in the chain contributes its own Causes instead, since its
+// local cause does not survive the wire.
+func errorChain(err error) []string {
+	var chain []string
+	var walk func(error)
+	walk = func(e error) {
+		switch u := e.(type) {
+		case *RPCError:
+			chain = append(chain, u.Causes...)
+		case interface{ Unwrap() error }:
+			if next := u.Unwrap(); next != nil {
+				chain = append(chain, next.Error())
+				walk(next)
+			}
+		case interface{ Unwrap() []error }:
+			for _, next := range u.Unwrap() {
+				chain = append(chain, next.Error())
+				walk(next)
+			}
+		}
+	}
+	walk(err)
+	return chain
+}
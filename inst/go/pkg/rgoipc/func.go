@@ -0,0 +1,505 @@
+package rgoipc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/apache/arrow/go/v18/arrow"
+	"github.com/apache/arrow/go/v18/arrow/array"
+	"github.com/apache/arrow/go/v18/arrow/memory"
+)
+
+// Optional is a nullable value (an R NA when Valid is false) for functions
+// registered with RegisterFunc
+type Optional[T any] struct {
+	Value T
+	Valid bool
+}
+
+// Some returns a valid Optional holding v
+func Some[T any](v T) Optional[T] {
+	return Optional[T]{Value: v, Valid: true}
+}
+
+// None returns a null Optional
+func None[T any]() Optional[T] {
+	return Optional[T]{}
+}
+
+// Factor is a string sent to R as a factor level. The levels of a result
+// column are its distinct values in order of appearance.
+type Factor string
+
+func (Optional[T]) optionalElem() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
+
+// optionalValue is implemented by every Optional[T]
+type optionalValue interface {
+	optionalElem() reflect.Type
+}
+
+var (
+	errorType    = reflect.TypeOf((*error)(nil)).Elem()
+	optionalType = reflect.TypeOf((*optionalValue)(nil)).Elem()
+	bytesType    = reflect.TypeOf([]byte(nil))
+	timeType     = reflect.TypeOf(time.Time{})
+	date32Type   = reflect.TypeOf(arrow.Date32(0))
+	factorType   = reflect.TypeOf(Factor(""))
+)
+
+// FuncOption configures a function registered with RegisterFunc
+type FuncOption func(*funcOptions)
+
+type funcOptions struct {
+	argNames    []string
+	description string
+	tags        []string
+}
+
+// WithArgNames names the arguments, in order. Go reflection cannot see
+// parameter names, so they default to arg1, arg2, ...
+func WithArgNames(names ...string) FuncOption {
+	return func(o *funcOptions) {
+		o.argNames = names
+	}
+}
+
+// WithDescription sets FunctionSignature.Description
+func WithDescription(description string) FuncOption {
+	return func(o *funcOptions) {
+		o.description = description
+	}
+}
+
+// WithTags sets FunctionSignature.Tags
+func WithTags(tags ...string) FuncOption {
+	return func(o *funcOptions) {
+		o.tags = tags
+	}
+}
+
+// RegisterFunc registers a plain Go function, deriving its signature from
+// the Go types and generating the Arrow conversion. Two forms are accepted:
+//
+//	func(x, y []float64) []float64            // vector: whole columns at once
+//	func(x, y float64) (float64, error)       // scalar: called once per row
+//
+// Arguments and results may be float64, int32, int (sent as int32), int64,
+// string, bool, []byte (binary, an R raw vector), time.Time (a microsecond
+// timestamp, R POSIXct; any unit is read), arrow.Date32 (R Date) or Factor
+// (an R factor; character columns are read too). Other Arrow types, such
+// as durations, lists and structs, need a plain FunctionHandler. *T and
+// Optional[T] make them nullable: a nil pointer or an invalid Optional is
+// an R NA. A null value in a plain T argument is
+// rejected with an invalid_schema error. Either form may return an error as
+// its last result.
+//
+// Input columns are matched to the arguments by name, as ValidateInput does,
+// and converted like it (an R integer column is accepted for a float64
+// argument, for example). The result is a single "result" column. fn must
+// be a non-nil function.
+func RegisterFunc(r *Registry, name string, fn interface{}, opts ...FuncOption) error {
+	var o funcOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	rf, err := reflectFunc(fn)
+	if err != nil {
+		return fmt.Errorf("function %s: %w", name, err)
+	}
+
+	sig := FunctionSignature{
+		Args:        make([]ArgSpec, len(rf.args)),
+		ReturnType:  rf.result.typeSpec(),
+		Vectorized:  true,
+		Description: o.description,
+		Tags:        o.tags,
+	}
+	if o.argNames != nil && len(o.argNames) != len(rf.args) {
+		return fmt.Errorf("function %s: %d argument names for %d arguments", name, len(o.argNames), len(rf.args))
+	}
+	for i, arg := range rf.args {
+		argName := fmt.Sprintf("arg%d", i+1)
+		if o.argNames != nil {
+			argName = o.argNames[i]
+		}
+		sig.Args[i] = ArgSpec{
+			Name: argName,
+			Type: arg.typeSpec(),
+		}
+	}
+
+	rf.names = make([]string, len(sig.Args))
+	for i, arg := range sig.Args {
+		rf.names[i] = arg.Name
+	}
+	return r.RegisterContext(name, rf.call, sig)
+}
+
+// wrapKind is how a Go type represents nulls
+type wrapKind uint8
+
+const (
+	wrapNone     wrapKind = iota // T: no nulls
+	wrapPointer                  // *T: nil is null
+	wrapOptional                 // Optional[T]: !Valid is null
+)
+
+// valueCodec converts between one Arrow column and Go values of one type
+type valueCodec struct {
+	goType   reflect.Type // as declared: T, *T or Optional[T]
+	base     reflect.Type // T
+	wrap     wrapKind
+	spec     TypeSpec // without Nullable
+	dataType arrow.DataType
+}
+
+func newValueCodec(t reflect.Type) (*valueCodec, error) {
+	c := &valueCodec{goType: t, base: t}
+	switch {
+	case t.Kind() == reflect.Pointer:
+		c.wrap, c.base = wrapPointer, t.Elem()
+	case t.Implements(optionalType):
+		c.wrap, c.base = wrapOptional, reflect.Zero(t).Interface().(optionalValue).optionalElem()
+	}
+
+	// Named types first: they share their kind with the plain ones
+	switch c.base {
+	case bytesType:
+		c.spec.Type = TypeBinary
+	case timeType:
+		c.spec = TypeSpec{Type: TypeTimestamp, Unit: arrow.Microsecond}
+	case date32Type:
+		c.spec.Type = TypeDate32
+	case factorType:
+		c.spec.Type = TypeDictionary
+	default:
+		switch c.base.Kind() {
+		case reflect.Float64:
+			c.spec.Type = TypeFloat64
+		case reflect.Int32, reflect.Int:
+			c.spec.Type = TypeInt32
+		case reflect.Int64:
+			c.spec.Type = TypeInt64
+		case reflect.String:
+			c.spec.Type = TypeString
+		case reflect.Bool:
+			c.spec.Type = TypeBool
+		default:
+			return nil, fmt.Errorf("unsupported type %s", t)
+		}
+	}
+	c.dataType, _ = arrowTypeToDataType(c.spec)
+	return c, nil
+}
+
+func (c *valueCodec) nullable() bool {
+	return c.wrap != wrapNone
+}
+
+// typeSpec returns the declared type of an argument or result
+func (c *valueCodec) typeSpec() TypeSpec {
+	spec := c.spec
+	spec.Nullable = c.nullable()
+	return spec
+}
+
+// convert returns col as the type value reads, rejecting nulls unless the
+// Go type can hold them: c.dataType, any timestamp for time.Time and string
+// for Factor. Conversions allocate with mem. The caller owns the returned
+// array.
+func (c *valueCodec) convert(col arrow.Array, mem memory.Allocator) (arrow.Array, error) {
+	var err error
+	switch {
+	case c.spec.Type == TypeTimestamp && col.DataType().ID() == arrow.TIMESTAMP:
+		col.Retain()
+	case c.spec.Type == TypeDictionary:
+		col, err = coerceColumn(col, arrow.BinaryTypes.String, mem)
+	default:
+		col, err = coerceColumn(col, c.dataType, mem)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !c.nullable() && col.NullN() > 0 {
+		col.Release()
+		return nil, fmt.Errorf("%d null values but %s cannot hold NA", col.NullN(), c.goType)
+	}
+	return col, nil
+}
+
+// slice returns the values of col, as returned by convert, as a []c.goType
+func (c *valueCodec) slice(col arrow.Array) reflect.Value {
+	s := reflect.MakeSlice(reflect.SliceOf(c.goType), col.Len(), col.Len())
+	for i := 0; i < col.Len(); i++ {
+		s.Index(i).Set(c.value(col, i))
+	}
+	return s
+}
+
+// value returns row i of col, which has type c.dataType, as a c.goType
+func (c *valueCodec) value(col arrow.Array, i int) reflect.Value {
+	null := col.IsNull(i)
+	var v reflect.Value
+	if !null {
+		switch a := col.(type) {
+		case *array.Float64:
+			v = reflect.ValueOf(a.Value(i))
+		case *array.Int32:
+			v = reflect.ValueOf(a.Value(i))
+		case *array.Int64:
+			v = reflect.ValueOf(a.Value(i))
+		case *array.String:
+			v = reflect.ValueOf(a.Value(i))
+		case *array.Boolean:
+			v = reflect.ValueOf(a.Value(i))
+		case *array.Binary:
+			// Value points into the column's buffer, which the caller frees
+			v = reflect.ValueOf(bytes.Clone(a.Value(i)))
+		case *array.Timestamp:
+			v = reflect.ValueOf(a.Value(i).ToTime(a.DataType().(*arrow.TimestampType).Unit))
+		case *array.Date32:
+			v = reflect.ValueOf(a.Value(i))
+		}
+		v = v.Convert(c.base)
+	}
+
+	switch c.wrap {
+	case wrapPointer:
+		if null {
+			return reflect.Zero(c.goType)
+		}
+		p := reflect.New(c.base)
+		p.Elem().Set(v)
+		return p
+	case wrapOptional:
+		o := reflect.New(c.goType).Elem()
+		if !null {
+			o.Field(0).Set(v)
+			o.Field(1).SetBool(true)
+		}
+		return o
+	default:
+		return v
+	}
+}
+
+// append adds the c.goType value v to b
+func (c *valueCodec) append(b array.Builder, v reflect.Value) error {
+	switch c.wrap {
+	case wrapPointer:
+		if v.IsNil() {
+			b.AppendNull()
+			return nil
+		}
+		v = v.Elem()
+	case wrapOptional:
+		if !v.Field(1).Bool() {
+			b.AppendNull()
+			return nil
+		}
+		v = v.Field(0)
+	}
+
+	switch b := b.(type) {
+	case *array.Float64Builder:
+		b.Append(v.Float())
+	case *array.Int32Builder:
+		n := v.Int()
+		if n < math.MinInt32 || n > math.MaxInt32 {
+			return fmt.Errorf("result %d does not fit in a 32-bit integer", n)
+		}
+		b.Append(int32(n))
+	case *array.Int64Builder:
+		b.Append(v.Int())
+	case *array.StringBuilder:
+		b.Append(v.String())
+	case *array.BooleanBuilder:
+		b.Append(v.Bool())
+	case *array.BinaryBuilder:
+		b.Append(v.Bytes())
+	case *array.TimestampBuilder:
+		b.Append(arrow.Timestamp(v.Interface().(time.Time).UnixMicro()))
+	case *array.Date32Builder:
+		b.Append(arrow.Date32(v.Int()))
+	case *array.BinaryDictionaryBuilder:
+		return b.AppendString(v.String())
+	}
+	return nil
+}
+
+// reflectedFunc is a Go function adapted to FunctionHandler
+type reflectedFunc struct {
+	fn       reflect.Value
+	vector   bool
+	args     []*valueCodec
+	result   *valueCodec
+	hasError bool
+	names    []string
+}
+
+func reflectFunc(fn interface{}) (*reflectedFunc, error) {
+	v := reflect.ValueOf(fn)
+	if !v.IsValid() {
+		return nil, fmt.Errorf("expected a function, got nil")
+	}
+	t := v.Type()
+	if t.Kind() != reflect.Func {
+		return nil, fmt.Errorf("expected a function, got %s", t)
+	}
+	if v.IsNil() {
+		return nil, fmt.Errorf("expected a function, got a nil %s", t)
+	}
+	if t.IsVariadic() {
+		return nil, fmt.Errorf("variadic functions are not supported")
+	}
+
+	rf := &reflectedFunc{fn: v}
+	switch {
+	case t.NumOut() == 1:
+	case t.NumOut() == 2 && t.Out(1) == errorType:
+		rf.hasError = true
+	default:
+		return nil, fmt.Errorf("expected one result and an optional error, got %s", t)
+	}
+
+	// The result decides the form; every argument must follow it
+	out := t.Out(0)
+	rf.vector = out.Kind() == reflect.Slice && out != bytesType
+	elem := func(t reflect.Type) (reflect.Type, error) {
+		if !rf.vector {
+			return t, nil
+		}
+		if t.Kind() != reflect.Slice || t == bytesType {
+			return nil, fmt.Errorf("vector functions take slices only, got %s", t)
+		}
+		return t.Elem(), nil
+	}
+
+	rt, err := elem(out)
+	if err != nil {
+		return nil, err
+	}
+	if rf.result, err = newValueCodec(rt); err != nil {
+		return nil, fmt.Errorf("result: %w", err)
+	}
+
+	rf.args = make([]*valueCodec, t.NumIn())
+	for i := range rf.args {
+		at, err := elem(t.In(i))
+		if err != nil {
+			return nil, err
+		}
+		if rf.args[i], err = newValueCodec(at); err != nil {
+			return nil, fmt.Errorf("argument %d: %w", i+1, err)
+		}
+	}
+	return rf, nil
+}
+
+// columns converts the input columns, matched by name, to the argument
+// types
+func (rf *reflectedFunc) columns(input arrow.Record, mem memory.Allocator) ([]arrow.Array, error) {
+	cols := make([]arrow.Array, len(rf.args))
+	for i, arg := range rf.args {
+		col, err := rf.column(input, i, arg, mem)
+		if err != nil {
+			for _, c := range cols[:i] {
+				c.Release()
+			}
+			return nil, NewError(CodeInvalidSchema, "argument %s: %s", rf.names[i], err).WithDetail(rf.names[i], err.Error())
+		}
+		cols[i] = col
+	}
+	return cols, nil
+}
+
+// column converts the input column of argument i
+func (rf *reflectedFunc) column(input arrow.Record, i int, arg *valueCodec, mem memory.Allocator) (arrow.Array, error) {
+	switch idx := input.Schema().FieldIndices(rf.names[i]); len(idx) {
+	case 0:
+		return nil, fmt.Errorf("missing column")
+	case 1:
+		return arg.convert(input.Column(idx[0]), mem)
+	default:
+		return nil, fmt.Errorf("duplicate column")
+	}
+}
+
+// call is the ContextHandler of the function. It allocates with
+// Allocator(ctx), so the server's MaxAllocation covers it.
+func (rf *reflectedFunc) call(ctx context.Context, input arrow.Record) (arrow.Record, error) {
+	mem := Allocator(ctx)
+	cols, err := rf.columns(input, mem)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, c := range cols {
+			c.Release()
+		}
+	}()
+
+	b := array.NewBuilder(mem, rf.result.dataType)
+	defer b.Release()
+
+	if rf.vector {
+		err = rf.callVector(cols, b)
+	} else {
+		err = rf.callScalar(cols, int(input.NumRows()), b)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := b.NewArray()
+	defer result.Release()
+	schema := arrow.NewSchema([]arrow.Field{{Name: "result", Type: rf.result.dataType, Nullable: rf.result.nullable()}}, nil)
+	return array.NewRecord(schema, []arrow.Array{result}, int64(result.Len())), nil
+}
+
+func (rf *reflectedFunc) callVector(cols []arrow.Array, b array.Builder) error {
+	in := make([]reflect.Value, len(cols))
+	for i, arg := range rf.args {
+		in[i] = arg.slice(cols[i])
+	}
+
+	out := rf.fn.Call(in)
+	if rf.hasError && !out[1].IsNil() {
+		return out[1].Interface().(error)
+	}
+	for row := 0; row < out[0].Len(); row++ {
+		if err := rf.result.append(b, out[0].Index(row)); err != nil {
+			return fmt.Errorf("row %d: %w", row+1, err)
+		}
+	}
+	return nil
+}
+
+// callScalar calls the function once per row. Without arguments the
+// function is called once.
+func (rf *reflectedFunc) callScalar(cols []arrow.Array, rows int, b array.Builder) error {
+	if len(cols) == 0 {
+		rows = 1
+	}
+	in := make([]reflect.Value, len(cols))
+	for row := 0; row < rows; row++ {
+		for i, arg := range rf.args {
+			in[i] = arg.value(cols[i], row)
+		}
+		out := rf.fn.Call(in)
+		if rf.hasError && !out[1].IsNil() {
+			return fmt.Errorf("row %d: %w", row+1, out[1].Interface().(error))
+		}
+		if err := rf.result.append(b, out[0]); err != nil {
+			return fmt.Errorf("row %d: %w", row+1, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package rgoipc_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"mangoro.local/pkg/rgoipc"
+
+	"github.com/apache/arrow/go/v18/arrow"
+	"github.com/apache/arrow/go/v18/arrow/array"
+	"github.com/apache/arrow/go/v18/arrow/memory"
+)
+
+func callFunc(t *testing.T, registry *rgoipc.Registry, name string, cols ...arrow.Array) (arrow.Record, error) {
+	t.Helper()
+	fn, ok := registry.Get(name)
+	if !ok {
+		t.Fatalf("%s not registered", name)
+	}
+	fields := make([]arrow.Field, len(cols))
+	for i, c := range cols {
+		fields[i] = arrow.Field{Name: fn.Signature.Args[i].Name, Type: c.DataType(), Nullable: true}
+	}
+	rows := int64(0)
+	if len(cols) > 0 {
+		rows = int64(cols[0].Len())
+	}
+	input := array.NewRecord(arrow.NewSchema(fields, nil), cols, rows)
+	defer input.Release()
+	return fn.Call(input)
+}
+
+func float64Array(values []float64, valid []bool) arrow.Array {
+	b := array.NewFloat64Builder(memory.NewGoAllocator())
+	defer b.Release()
+	b.AppendValues(values, valid)
+	return b.NewArray()
+}
+
+func TestRegisterFuncVector(t *testing.T) {
+	registry := rgoipc.NewRegistry()
+	err := rgoipc.RegisterFunc(registry, "add", func(x, y []float64) []float64 {
+		out := make([]float64, len(x))
+		for i := range x {
+			out[i] = x[i] + y[i]
+		}
+		return out
+	}, rgoipc.WithArgNames("x", "y"), rgoipc.WithDescription("Add two numeric vectors"))
+	if err != nil {
+		t.Fatalf("RegisterFunc: %v", err)
+	}
+
+	fn, _ := registry.Get("add")
+	if fn.Signature.Args[1].Name != "y" || fn.Signature.Args[1].Type.Type != rgoipc.TypeFloat64 ||
+		fn.Signature.Args[1].Type.Nullable || fn.Signature.Description != "Add two numeric vectors" {
+		t.Errorf("derived signature: %+v", fn.Signature)
+	}
+
+	// y arrives as an R integer column
+	x := float64Array([]float64{1.5, 2.5}, nil)
+	defer x.Release()
+	yb := array.NewInt32Builder(memory.NewGoAllocator())
+	yb.AppendValues([]int32{1, 2}, nil)
+	y := yb.NewArray()
+	defer y.Release()
+
+	result, err := callFunc(t, registry, "add", x, y)
+	if err != nil {
+		t.Fatalf("call: %v", err)
+	}
+	defer result.Release()
+	got := result.Column(0).(*array.Float64).Float64Values()
+	if len(got) != 2 || got[0] != 2.5 || got[1] != 4.5 {
+		t.Errorf("got %v", got)
+	}
+
+	withNA := float64Array([]float64{1, 0}, []bool{true, false})
+	defer withNA.Release()
+	_, err = callFunc(t, registry, "add", withNA, x)
+	if !errors.Is(err, rgoipc.ErrInvalidSchema) || !strings.Contains(err.Error(), "argument x") {
+		t.Errorf("expected invalid_schema for NA in non-nullable x, got %v", err)
+	}
+}
+
+func TestRegisterFuncBindsByName(t *testing.T) {
+	registry := rgoipc.NewRegistry()
+	err := rgoipc.RegisterFunc(registry, "sub", func(x, y float64) float64 {
+		return x - y
+	}, rgoipc.WithArgNames("x", "y"))
+	if err != nil {
+		t.Fatalf("RegisterFunc: %v", err)
+	}
+	fn, _ := registry.Get("sub")
+
+	one := float64Array([]float64{1}, nil)
+	defer one.Release()
+	ten := float64Array([]float64{10}, nil)
+	defer ten.Release()
+	call := func(names ...string) (arrow.Record, error) {
+		fields := make([]arrow.Field, len(names))
+		for i, name := range names {
+			fields[i] = arrow.Field{Name: name, Type: arrow.PrimitiveTypes.Float64}
+		}
+		input := array.NewRecord(arrow.NewSchema(fields, nil), []arrow.Array{one, ten}[:len(names)], 1)
+		defer input.Release()
+		return fn.Call(input)
+	}
+
+	// Columns sent in another order than the arguments
+	result, err := call("y", "x")
+	if err != nil {
+		t.Fatalf("call: %v", err)
+	}
+	defer result.Release()
+	if got := result.Column(0).(*array.Float64).Value(0); got != 9 {
+		t.Errorf("sub(x = 10, y = 1) = %v", got)
+	}
+
+	for _, names := range [][]string{{"x", "z"}, {"x", "x"}} {
+		if _, err := call(names...); !errors.Is(err, rgoipc.ErrInvalidSchema) {
+			t.Errorf("columns %v: expected invalid_schema, got %v", names, err)
+		}
+	}
+}
+
+func TestRegisterFuncScalarNullable(t *testing.T) {
+	registry := rgoipc.NewRegistry()
+	err := rgoipc.RegisterFunc(registry, "label", func(n *float64, s rgoipc.Optional[string]) (rgoipc.Optional[string], error) {
+		if n == nil || !s.Valid {
+			return rgoipc.None[string](), nil
+		}
+		if *n < 0 {
+			return rgoipc.None[string](), errors.New("negative count")
+		}
+		return rgoipc.Some(strings.Repeat(s.Value, int(*n))), nil
+	}, rgoipc.WithArgNames("n", "s"))
+	if err != nil {
+		t.Fatalf("RegisterFunc: %v", err)
+	}
+
+	fn, _ := registry.Get("label")
+	if !fn.Signature.Args[0].Type.Nullable || fn.Signature.Args[1].Type.Type != rgoipc.TypeString ||
+		!fn.Signature.ReturnType.Nullable {
+		t.Errorf("derived signature: %+v", fn.Signature)
+	}
+
+	n := float64Array([]float64{2, 0, 1}, []bool{true, false, true})
+	defer n.Release()
+	sb := array.NewStringBuilder(memory.NewGoAllocator())
+	sb.AppendValues([]string{"ab", "x", ""}, []bool{true, true, false})
+	s := sb.NewArray()
+	defer s.Release()
+
+	result, err := callFunc(t, registry, "label", n, s)
+	if err != nil {
+		t.Fatalf("call: %v", err)
+	}
+	defer result.Release()
+	col := result.Column(0).(*array.String)
+	if col.Value(0) != "abab" || !col.IsNull(1) || !col.IsNull(2) {
+		t.Errorf("got %v", col)
+	}
+
+	neg := float64Array([]float64{1, -1}, nil)
+	defer neg.Release()
+	s2 := array.NewSlice(s, 0, 2)
+	defer s2.Release()
+	if _, err := callFunc(t, registry, "label", neg, s2); err == nil || err.Error() != "row 2: negative count" {
+		t.Errorf("expected row error, got %v", err)
+	}
+}
+
+func TestRegisterFuncRejectsSignatures(t *testing.T) {
+	registry := rgoipc.NewRegistry()
+	for name, fn := range map[string]interface{}{
+		"not a function": 42,
+		"mixed forms":    func(x []float64, y float64) []float64 { return x },
+		"map argument":   func(m map[string]int) int { return 0 },
+		"two results":    func(x int) (int, int) { return x, x },
+	} {
+		if err := rgoipc.RegisterFunc(registry, "f", fn); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	var nilFunc func(x int) int
+	for name, fn := range map[string]interface{}{"nil": nil, "nil function": nilFunc} {
+		if err := rgoipc.RegisterFunc(registry, "f", fn); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if err := rgoipc.RegisterFunc(registry, "f", func(x, y int) int { return x }, rgoipc.WithArgNames("x")); err == nil {
+		t.Error("expected an error for too few argument names")
+	}
+}
+
+func TestRegisterFuncTypedVectors(t *testing.T) {
+	registry := rgoipc.NewRegistry()
+	err := rgoipc.RegisterFunc(registry, "checksum", func(b []byte) int32 {
+		sum := int32(0)
+		for _, v := range b {
+			sum += int32(v)
+		}
+		return sum
+	}, rgoipc.WithArgNames("b"))
+	if err != nil {
+		t.Fatalf("RegisterFunc: %v", err)
+	}
+	err = rgoipc.RegisterFunc(registry, "day", func(ts []time.Time) []arrow.Date32 {
+		out := make([]arrow.Date32, len(ts))
+		for i, v := range ts {
+			out[i] = arrow.Date32FromTime(v)
+		}
+		return out
+	}, rgoipc.WithArgNames("ts"))
+	if err != nil {
+		t.Fatalf("RegisterFunc: %v", err)
+	}
+
+	fn, _ := registry.Get("day")
+	if arg := fn.Signature.Args[0].Type; arg.Type != rgoipc.TypeTimestamp || arg.Unit != arrow.Microsecond ||
+		fn.Signature.ReturnType.Type != rgoipc.TypeDate32 {
+		t.Errorf("derived signature: %+v", fn.Signature)
+	}
+
+	bb := array.NewBinaryBuilder(memory.NewGoAllocator(), arrow.BinaryTypes.Binary)
+	bb.AppendValues([][]byte{{1, 2, 3}}, nil)
+	b := bb.NewArray()
+	defer b.Release()
+	result, err := callFunc(t, registry, "checksum", b)
+	if err != nil {
+		t.Fatalf("checksum: %v", err)
+	}
+	if got := result.Column(0).(*array.Int32).Value(0); got != 6 {
+		t.Errorf("checksum = %d", got)
+	}
+	result.Release()
+
+	// R sends POSIXct in seconds or microseconds, with a time zone
+	tb := array.NewTimestampBuilder(memory.NewGoAllocator(), &arrow.TimestampType{Unit: arrow.Second, TimeZone: "UTC"})
+	tb.Append(86400 * 3)
+	ts := tb.NewArray()
+	defer ts.Release()
+	result, err = callFunc(t, registry, "day", ts)
+	if err != nil {
+		t.Fatalf("day: %v", err)
+	}
+	defer result.Release()
+	if got := result.Column(0).(*array.Date32).Value(0); got != 3 {
+		t.Errorf("day = %d", got)
+	}
+}
@@ -0,0 +1,301 @@
+package rgoipc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/apache/arrow/go/v18/arrow"
+)
+
+// HandleStore keeps Go objects alive between calls: a parsed index, a
+// fitted model, an open database. A handler stores the object and returns
+// its handle ID to R as a string; later calls pass the ID back to get the
+// object:
+//
+//	handles := rgoipc.NewHandleStore(time.Hour)
+//
+//	// in "open"
+//	id := handles.New(db)
+//	return rgoipc.NewRecordBuilder().Add("handle", []string{id}).NewRecord()
+//
+//	// in "query"
+//	db, err := rgoipc.HandleArg[*sql.DB](handles, input, "handle")
+//
+// Handles are reference counted. New returns a handle with one reference,
+// Retain adds one and Release drops one; the object is forgotten, and
+// closed if it is an io.Closer, when the last reference goes or when it has
+// not been used for the idle timeout.
+type HandleStore struct {
+	idle time.Duration
+
+	mu      sync.Mutex
+	handles map[string]*handle
+}
+
+// HandleInfo describes a live handle. It is the JSON body of
+// MsgTypeHandleList replies.
+type HandleInfo struct {
+	ID       string     `json:"id"`
+	Type     string     `json:"type"` // Go type of the object
+	Refs     int        `json:"refs"`
+	Created  time.Time  `json:"created"`
+	LastUsed time.Time  `json:"last_used"`
+	Expires  *time.Time `json:"expires,omitempty"` // unless used again
+}
+
+type handle struct {
+	info  HandleInfo
+	value any
+	timer *time.Timer
+}
+
+// NewHandleStore creates an empty store whose handles expire after idle
+// without use; zero means never
+func NewHandleStore(idle time.Duration) *HandleStore {
+	return &HandleStore{
+		idle:    idle,
+		handles: make(map[string]*handle),
+	}
+}
+
+// New stores value and returns its handle ID, with one reference
+func (s *HandleStore) New(value any) string {
+	now := time.Now()
+	h := &handle{
+		info: HandleInfo{
+			ID:       randomID(),
+			Type:     fmt.Sprintf("%T", value),
+			Refs:     1,
+			Created:  now,
+			LastUsed: now,
+		},
+		value: value,
+	}
+	if s.idle > 0 {
+		h.timer = time.AfterFunc(s.idle, func() {
+			s.expire(h)
+		})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handles[h.info.ID] = h
+	return h.info.ID
+}
+
+// Get returns the object of a handle and resets its idle timer
+func (s *HandleStore) Get(id string) (any, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, err := s.touch(id)
+	if err != nil {
+		return nil, err
+	}
+	return h.value, nil
+}
+
+// Retain adds a reference to a handle
+func (s *HandleStore) Retain(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, err := s.touch(id)
+	if err != nil {
+		return err
+	}
+	h.info.Refs++
+	return nil
+}
+
+// Release drops a reference to a handle. Dropping the last one forgets the
+// object and closes it if it is an io.Closer; the error is that of Close.
+func (s *HandleStore) Release(id string) error {
+	s.mu.Lock()
+	h, err := s.touch(id)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	h.info.Refs--
+	if h.info.Refs > 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	s.remove(h)
+	s.mu.Unlock()
+	return closeHandle(h)
+}
+
+// List describes the live handles, oldest first
+func (s *HandleStore) List() []HandleInfo {
+	s.mu.Lock()
+	infos := make([]HandleInfo, 0, len(s.handles))
+	for _, h := range s.handles {
+		info := h.info
+		if s.idle > 0 {
+			expires := info.LastUsed.Add(s.idle)
+			info.Expires = &expires
+		}
+		infos = append(infos, info)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(infos, func(i, k int) bool {
+		return infos[i].Created.Before(infos[k].Created)
+	})
+	return infos
+}
+
+// Close forgets every handle, closing the objects that are io.Closers, and
+// returns the first error
+func (s *HandleStore) Close() error {
+	s.mu.Lock()
+	handles := make([]*handle, 0, len(s.handles))
+	for _, h := range s.handles {
+		s.remove(h)
+		handles = append(handles, h)
+	}
+	s.mu.Unlock()
+
+	var first error
+	for _, h := range handles {
+		if err := closeHandle(h); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// touch looks a handle up and marks it used. s.mu must be held.
+func (s *HandleStore) touch(id string) (*handle, error) {
+	h, ok := s.handles[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrHandleNotFound, id)
+	}
+	h.info.LastUsed = time.Now()
+	if h.timer != nil {
+		h.timer.Reset(s.idle)
+	}
+	return h, nil
+}
+
+// remove forgets a handle. s.mu must be held.
+func (s *HandleStore) remove(h *handle) {
+	delete(s.handles, h.info.ID)
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+}
+
+// expire forgets a handle whose idle timer fired, unless it was used in the
+// meantime
+func (s *HandleStore) expire(h *handle) {
+	s.mu.Lock()
+	if s.handles[h.info.ID] != h || time.Since(h.info.LastUsed) < s.idle {
+		s.mu.Unlock()
+		return
+	}
+	s.remove(h)
+	s.mu.Unlock()
+	closeHandle(h)
+}
+
+func closeHandle(h *handle) error {
+	if c, ok := h.value.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// GetHandle returns the object of a handle as a T
+func GetHandle[T any](s *HandleStore, id string) (T, error) {
+	var zero T
+	value, err := s.Get(id)
+	if err != nil {
+		return zero, err
+	}
+	v, ok := value.(T)
+	if !ok {
+		return zero, NewError(CodeInvalidSchema, "handle %s holds a %T, not a %T", id, value, zero)
+	}
+	return v, nil
+}
+
+// HandleArg returns the object of the handle whose ID is the first value of
+// the string column name of rec
+func HandleArg[T any](s *HandleStore, rec arrow.Record, name string) (T, error) {
+	var zero T
+	id, err := ScalarArg(rec, name, "")
+	if err != nil {
+		return zero, err
+	}
+	if id == "" {
+		return zero, NewError(CodeInvalidSchema, "column %s: missing handle", name).WithDetail(name, "missing handle")
+	}
+	return GetHandle[T](s, id)
+}
+
+// WithHandles serves the handles of store to clients: MsgTypeHandleList
+// lists them and MsgTypeHandleRelease releases one. The store stays open
+// when the server closes.
+func WithHandles(store *HandleStore) ServerOption {
+	return func(s *Server) {
+		s.handles = store
+	}
+}
+
+// handleHandleRelease drops the reference to the handle named in msg that
+// the client's session owns, and acknowledges with a MsgTypeHandleRelease
+// reply. Handles the session does not own are not found.
+func (s *Server) handleHandleRelease(ctx context.Context, msg *RPCMessage) *RPCMessage {
+	sess := SessionFrom(ctx)
+	if s.handles == nil || sess == nil || !sess.disown(s.handles, msg.FuncName) {
+		return errorMessage(msg.FuncName, fmt.Errorf("%w: %s", ErrHandleNotFound, msg.FuncName))
+	}
+	if err := s.handles.Release(msg.FuncName); err != nil {
+		if errors.Is(err, ErrHandleNotFound) {
+			return errorMessage(msg.FuncName, err)
+		}
+		// The handle is gone all the same
+		s.logger.Printf("closing handle %s: %s", msg.FuncName, err)
+	}
+	return &RPCMessage{
+		Type:     MsgTypeHandleRelease,
+		FuncName: msg.FuncName,
+	}
+}
+
+// handleHandleList replies with the live handles that the client's session
+// owns, oldest first
+func (s *Server) handleHandleList(ctx context.Context) *RPCMessage {
+	infos := []HandleInfo{}
+	if sess := SessionFrom(ctx); s.handles != nil && sess != nil {
+		for _, info := range s.handles.List() {
+			if sess.owns(s.handles, info.ID) {
+				infos = append(infos, info)
+			}
+		}
+	}
+	data, err := json.Marshal(infos)
+	if err != nil {
+		return errorMessage("", err)
+	}
+	return &RPCMessage{
+		Type:      MsgTypeHandleList,
+		ArrowData: data,
+	}
+}
+
+// ParseHandleList decodes a MsgTypeHandleList reply
+func ParseHandleList(data []byte) ([]HandleInfo, error) {
+	var infos []HandleInfo
+	if err := json.Unmarshal(data, &infos); err != nil {
+		return nil, fmt.Errorf("%w: handle list: %w", ErrInvalidMessage, err)
+	}
+	return infos, nil
+}
@@ -0,0 +1,156 @@
+package rgoipc_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"mangoro.local/pkg/rgoipc"
+
+	"github.com/apache/arrow/go/v18/arrow"
+)
+
+// closer records whether it was closed
+type closer struct{ closed chan struct{} }
+
+func (c *closer) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestHandleStore(t *testing.T) {
+	store := rgoipc.NewHandleStore(0)
+	c := &closer{closed: make(chan struct{})}
+	id := store.New(c)
+
+	got, err := rgoipc.GetHandle[*closer](store, id)
+	if err != nil || got != c {
+		t.Fatalf("GetHandle = %v, %v", got, err)
+	}
+	if _, err := rgoipc.GetHandle[string](store, id); !errors.Is(err, rgoipc.ErrInvalidSchema) {
+		t.Errorf("GetHandle with the wrong type: %v", err)
+	}
+
+	// The object lives until its last reference is released
+	if err := store.Retain(id); err != nil {
+		t.Fatal(err)
+	}
+	store.Release(id)
+	if infos := store.List(); len(infos) != 1 || infos[0].Refs != 1 || infos[0].Type != "*rgoipc_test.closer" {
+		t.Errorf("List = %+v", infos)
+	}
+	select {
+	case <-c.closed:
+		t.Fatal("closed while referenced")
+	default:
+	}
+	if err := store.Release(id); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-c.closed:
+	default:
+		t.Error("not closed after the last release")
+	}
+	if _, err := store.Get(id); !errors.Is(err, rgoipc.ErrHandleNotFound) {
+		t.Errorf("Get after release: %v", err)
+	}
+
+	// Unused handles expire
+	store = rgoipc.NewHandleStore(50 * time.Millisecond)
+	c = &closer{closed: make(chan struct{})}
+	store.New(c)
+	select {
+	case <-c.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle handle did not expire")
+	}
+	if infos := store.List(); len(infos) != 0 {
+		t.Errorf("expired handle listed: %+v", infos)
+	}
+}
+
+func TestServerHandles(t *testing.T) {
+	store := rgoipc.NewHandleStore(0)
+	registry := rgoipc.NewRegistry()
+	registry.RegisterContext("open", func(ctx context.Context, _ arrow.Record) (arrow.Record, error) {
+		id := store.New([]float64{1, 2, 3})
+		rgoipc.SessionFrom(ctx).Own(store, id)
+		return rgoipc.NewRecordBuilder().Add("handle", []string{id}).NewRecord()
+	}, rgoipc.FunctionSignature{ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeDynamic}})
+	registry.Register("sum", func(input arrow.Record) (arrow.Record, error) {
+		values, err := rgoipc.HandleArg[[]float64](store, input, "handle")
+		if err != nil {
+			return nil, err
+		}
+		total := 0.0
+		for _, v := range values {
+			total += v
+		}
+		return rgoipc.NewRecordBuilder().Add("result", []float64{total}).NewRecord()
+	}, rgoipc.FunctionSignature{ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeDynamic}})
+	url, _ := startTestServer(t, registry, rgoipc.WithHandles(store))
+	sock := dialTestClient(t, url)
+
+	reply := roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "open"})
+	rec, err := rgoipc.ReadArrowRecord(reply.ArrowData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handles, _ := rgoipc.Column[string](rec, "handle")
+	rec.Release()
+	id := handles[0]
+
+	input, err := rgoipc.NewRecordBuilder().Add("handle", []string{id}).NewRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer input.Release()
+	data, err := rgoipc.WriteArrowRecord(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "sum", ArrowData: data})
+	rec, err = rgoipc.ReadArrowRecord(reply.ArrowData)
+	if err != nil {
+		t.Fatalf("sum: %v", reply.Error)
+	}
+	if total, _ := rgoipc.Column[float64](rec, "result"); total[0] != 6 {
+		t.Errorf("sum through a handle = %v", total)
+	}
+	rec.Release()
+
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeHandleList})
+	infos, err := rgoipc.ParseHandleList(reply.ArrowData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].ID != id || infos[0].Type != "[]float64" {
+		t.Errorf("handle list: %+v", infos)
+	}
+
+	// Other clients neither see nor release the handle
+	other := dialTestClient(t, url)
+	reply = roundTrip(t, other, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeHandleList})
+	if infos, err := rgoipc.ParseHandleList(reply.ArrowData); err != nil || len(infos) != 0 {
+		t.Errorf("handle list of another client: %+v, %v", infos, err)
+	}
+	reply = roundTrip(t, other, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeHandleRelease, FuncName: id})
+	if !errors.Is(reply.Error, rgoipc.ErrHandleNotFound) {
+		t.Errorf("release by another client: %v", reply.Error)
+	}
+
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeHandleRelease, FuncName: id})
+	if reply.Type != rgoipc.MsgTypeHandleRelease {
+		t.Errorf("release: %v", reply.Error)
+	}
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "sum", ArrowData: data})
+	if reply.Error == nil || reply.Error.Code != rgoipc.CodeHandleNotFound {
+		t.Errorf("call with a released handle: expected handle_not_found, got %v", reply.Error)
+	}
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeHandleRelease, FuncName: id})
+	if !errors.Is(reply.Error, rgoipc.ErrHandleNotFound) {
+		t.Errorf("double release: %v", reply.Error)
+	}
+}
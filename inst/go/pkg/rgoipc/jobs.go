@@ -0,0 +1,370 @@
+package rgoipc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// JobState is the state of a job
+type JobState string
+
+const (
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+	JobCancelled JobState = "cancelled"
+)
+
+// JobInfo describes a job. It is the JSON body of MsgTypeJobStatus replies
+// and, as an array, of MsgTypeJobList replies.
+type JobInfo struct {
+	ID        string     `json:"id"`
+	Function  string     `json:"function"`
+	State     JobState   `json:"state"`
+	Progress  float64    `json:"progress"`       // fraction done, see Progress
+	Completed int64      `json:"done,omitempty"` // units of work done, see Progress
+	Total     int64      `json:"total,omitempty"`
+	Message   string     `json:"message,omitempty"`
+	Submitted time.Time  `json:"submitted"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	Expires   *time.Time `json:"expires,omitempty"` // when a finished job is discarded
+	Error     *RPCError  `json:"error,omitempty"`   // why the job failed or was cancelled
+}
+
+// Done reports whether the job has finished, successfully or not
+func (j JobInfo) Done() bool {
+	return j.State != JobRunning
+}
+
+// ParseJobInfo decodes a MsgTypeJobStatus reply
+func ParseJobInfo(data []byte) (*JobInfo, error) {
+	var info JobInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("%w: job status: %w", ErrInvalidMessage, err)
+	}
+	return &info, nil
+}
+
+// ParseJobList decodes a MsgTypeJobList reply
+func ParseJobList(data []byte) ([]JobInfo, error) {
+	var jobs []JobInfo
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return nil, fmt.Errorf("%w: job list: %w", ErrInvalidMessage, err)
+	}
+	return jobs, nil
+}
+
+// WithJobRetention sets how long finished jobs and their results are kept
+// for clients to fetch. The default is ten minutes.
+func WithJobRetention(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.jobRetention = d
+	}
+}
+
+// WithMaxJobs sets how many jobs may run at once. Submitting more fails
+// with a limit_exceeded error until one finishes. The default is 64; zero or
+// less is unlimited.
+func WithMaxJobs(n int) ServerOption {
+	return func(s *Server) {
+		s.maxJobs = n
+	}
+}
+
+// WithMaxFinishedJobs sets how many finished jobs, with their results, are
+// kept at once. Beyond that the oldest are discarded before they expire.
+// The default is 256; zero or less is unlimited.
+func WithMaxFinishedJobs(n int) ServerOption {
+	return func(s *Server) {
+		s.maxFinished = n
+	}
+}
+
+// job is a call running in the background. Its result is kept as an
+// Arrow IPC stream until it expires. Only the client that submitted it can
+// reach it.
+type job struct {
+	owner   owner
+	fn      *RegisteredFunction
+	mu      sync.Mutex
+	info    JobInfo
+	result  []byte
+	cancel  context.CancelCauseFunc
+	expiry  *time.Timer
+	removed bool // discarded before it finished; it keeps no result
+}
+
+func (j *job) snapshot() JobInfo {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.info
+}
+
+// handleSubmit starts a job and replies with its status
+func (s *Server) handleSubmit(parent context.Context, msg *RPCMessage) *RPCMessage {
+	fn, ok := s.function(msg.FuncName)
+	if !ok {
+		return errorMessage(msg.FuncName, fmt.Errorf("%w: %s", ErrFunctionNotFound, msg.FuncName))
+	}
+	if err := s.authorize(parent, msg, fn); err != nil {
+		return errorMessage(msg.FuncName, err)
+	}
+	run, err := s.prepareRun(msg, fn)
+	if err != nil {
+		return errorMessage(msg.FuncName, err)
+	}
+
+	j := &job{owner: ownerOf(parent, msg), fn: fn, info: JobInfo{
+		ID:        randomID(),
+		Function:  fn.Name,
+		State:     JobRunning,
+		Submitted: time.Now(),
+	}}
+	// Jobs outlive the submit request, so only the function's own timeout
+	// applies
+	ctx, cancel := context.WithCancelCause(parent)
+	stop := func() {}
+	if timeout := fn.Signature.Timeout; timeout > 0 {
+		var stopTimeout context.CancelFunc
+		ctx, stopTimeout = context.WithTimeoutCause(ctx, timeout, fmt.Errorf("%w after %s", ErrDeadlineExceeded, timeout))
+		stop = stopTimeout
+	}
+	j.cancel = func(cause error) {
+		cancel(cause)
+		stop()
+	}
+
+	s.mu.Lock()
+	if s.maxJobs > 0 && s.runningJobs >= s.maxJobs {
+		running := s.runningJobs
+		s.mu.Unlock()
+		j.cancel(nil)
+		return errorMessage(msg.FuncName, limitError("max_jobs", int64(running+1), int64(s.maxJobs)))
+	}
+	s.runningJobs++
+	s.jobs[j.info.ID] = j
+	s.mu.Unlock()
+
+	// Shutdown waits for jobs too. The submit request is itself in flight,
+	// so the wait group cannot be at zero here.
+	s.inflight.Add(1)
+	ctx = s.withProgress(ctx, ProgressEvent{Job: j.info.ID, RequestID: msg.RequestID, Function: fn.Name}, j)
+	go s.runJob(ctx, j, fn, run)
+
+	// Nobody can reach the job of an anonymous client once its session
+	// ends, so the job ends with it
+	if sess := SessionFrom(parent); sess != nil && j.owner.principal == "" {
+		sess.OnClose(func() {
+			j.cancel(fmt.Errorf("%w: the client disconnected", ErrCancelled))
+			s.removeJob(j.info.ID)
+		})
+	}
+	return jobStatus(j)
+}
+
+func (s *Server) runJob(ctx context.Context, j *job, fn *RegisteredFunction, run streamRun) {
+	defer s.inflight.Done()
+	defer j.cancel(nil)
+	defer func() {
+		s.mu.Lock()
+		s.runningJobs--
+		s.mu.Unlock()
+	}()
+
+	enc := newStreamEncoder(fn, s.validation&ValidateOutput != 0)
+	enc.ctx = ctx
+	err := run(ctx, enc)
+	if err == nil {
+		if err = enc.close(); err != nil {
+			err = fmt.Errorf("arrow write error: %w", err)
+		}
+	}
+
+	state := JobSucceeded
+	switch {
+	case err == nil:
+	case ctx.Err() != nil:
+		err = contextError(ctx)
+		state = JobFailed
+		if errors.Is(err, ErrCancelled) {
+			state = JobCancelled
+		}
+	default:
+		err = s.runError(err)
+		state = JobFailed
+	}
+
+	now := time.Now()
+	expires := now.Add(s.jobRetention)
+	j.mu.Lock()
+	j.info.State = state
+	j.info.Finished = &now
+	j.info.Expires = &expires
+	if err == nil {
+		j.info.Progress = 1
+	} else {
+		j.info.Error = AsRPCError(err)
+	}
+	if !j.removed {
+		if err == nil {
+			j.result = enc.take()
+		}
+		j.expiry = time.AfterFunc(s.jobRetention, func() {
+			s.removeJob(j.info.ID)
+		})
+	}
+	j.mu.Unlock()
+	s.trimFinishedJobs()
+}
+
+// trimFinishedJobs discards the oldest finished jobs beyond
+// maxFinishedJobs
+func (s *Server) trimFinishedJobs() {
+	if s.maxFinished <= 0 {
+		return
+	}
+	s.mu.Lock()
+	var finished []JobInfo
+	for _, j := range s.jobs {
+		if info := j.snapshot(); info.Done() {
+			finished = append(finished, info)
+		}
+	}
+	s.mu.Unlock()
+	if len(finished) <= s.maxFinished {
+		return
+	}
+
+	sort.Slice(finished, func(i, k int) bool {
+		return finished[i].Finished.Before(*finished[k].Finished)
+	})
+	for _, info := range finished[:len(finished)-s.maxFinished] {
+		s.removeJob(info.ID)
+	}
+}
+
+// job returns the job named in the name field of msg, once the Authorizer
+// has allowed msg to reach its function. The jobs of other clients are not
+// found.
+func (s *Server) job(ctx context.Context, msg *RPCMessage) (*job, error) {
+	s.mu.Lock()
+	j, ok := s.jobs[msg.FuncName]
+	s.mu.Unlock()
+	if !ok || !j.owner.matches(ownerOf(ctx, msg)) {
+		return nil, fmt.Errorf("%w: %s", ErrJobNotFound, msg.FuncName)
+	}
+	if err := s.authorize(ctx, msg, j.fn); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (s *Server) removeJob(id string) {
+	s.mu.Lock()
+	j, ok := s.jobs[id]
+	delete(s.jobs, id)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.expiry != nil {
+		j.expiry.Stop()
+	}
+	j.result = nil
+	j.removed = true
+}
+
+func (s *Server) handleJobStatus(ctx context.Context, msg *RPCMessage) *RPCMessage {
+	j, err := s.job(ctx, msg)
+	if err != nil {
+		return errorMessage(msg.FuncName, err)
+	}
+	return jobStatus(j)
+}
+
+// handleJobResult replies with the result of a finished job, which stays
+// available until the job expires
+func (s *Server) handleJobResult(ctx context.Context, msg *RPCMessage) *RPCMessage {
+	j, err := s.job(ctx, msg)
+	if err != nil {
+		return errorMessage(msg.FuncName, err)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	switch j.info.State {
+	case JobRunning:
+		return errorMessage(msg.FuncName, fmt.Errorf("%w: %s is %s", ErrJobPending, msg.FuncName, j.info.State))
+	case JobSucceeded:
+		return &RPCMessage{
+			Type:      MsgTypeResult,
+			FuncName:  msg.FuncName,
+			ArrowData: j.result,
+		}
+	default:
+		return errorMessage(msg.FuncName, j.info.Error)
+	}
+}
+
+// handleJobCancel cancels a running job, or discards a finished one and its
+// result. The reply is the status of the job at that point: a cancelled job
+// may still be running for a moment.
+func (s *Server) handleJobCancel(ctx context.Context, msg *RPCMessage) *RPCMessage {
+	j, err := s.job(ctx, msg)
+	if err != nil {
+		return errorMessage(msg.FuncName, err)
+	}
+	if j.snapshot().Done() {
+		s.removeJob(msg.FuncName)
+	} else {
+		j.cancel(fmt.Errorf("%w by the client", ErrCancelled))
+	}
+	return jobStatus(j)
+}
+
+// handleJobList replies with the jobs of the client, oldest first
+func (s *Server) handleJobList(ctx context.Context, msg *RPCMessage) *RPCMessage {
+	caller := ownerOf(ctx, msg)
+	s.mu.Lock()
+	jobs := make([]JobInfo, 0)
+	for _, j := range s.jobs {
+		if j.owner.matches(caller) {
+			jobs = append(jobs, j.snapshot())
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(jobs, func(i, k int) bool {
+		return jobs[i].Submitted.Before(jobs[k].Submitted)
+	})
+	data, err := json.Marshal(jobs)
+	if err != nil {
+		return errorMessage("", err)
+	}
+	return &RPCMessage{
+		Type:      MsgTypeJobList,
+		ArrowData: data,
+	}
+}
+
+// jobStatus builds a MsgTypeJobStatus reply
+func jobStatus(j *job) *RPCMessage {
+	info := j.snapshot()
+	data, err := json.Marshal(info)
+	if err != nil {
+		return errorMessage(info.ID, err)
+	}
+	return &RPCMessage{
+		Type:      MsgTypeJobStatus,
+		FuncName:  info.ID,
+		ArrowData: data,
+	}
+}
@@ -0,0 +1,222 @@
+package rgoipc_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"mangoro.local/pkg/rgoipc"
+
+	"github.com/apache/arrow/go/v18/arrow"
+	"go.nanomsg.org/mangos/v3"
+)
+
+// pollJob polls a job until cond holds
+func pollJob(t *testing.T, sock mangos.Socket, id string, cond func(*rgoipc.JobInfo) bool) *rgoipc.JobInfo {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		reply := roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeJobStatus, FuncName: id})
+		if reply.Type != rgoipc.MsgTypeJobStatus {
+			t.Fatalf("job status: %v", reply.Error)
+		}
+		info, err := rgoipc.ParseJobInfo(reply.ArrowData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cond(info) {
+			return info
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s stuck at %+v", id, info)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerJobs(t *testing.T) {
+	release := make(chan struct{})
+	registry := rgoipc.NewRegistry()
+	registry.RegisterStream("count", func(ctx context.Context, input arrow.Record, out rgoipc.RecordWriter) error {
+		rgoipc.ReportProgress(ctx, 0.5, "halfway")
+		<-release
+		return countHandler(5)(ctx, input, out)
+	}, rgoipc.FunctionSignature{ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeInt32}})
+	registry.RegisterContext("wait", waitHandler(nil), rgoipc.FunctionSignature{
+		ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeDynamic},
+	})
+	url, _ := startTestServer(t, registry, rgoipc.WithJobRetention(time.Second))
+	sock := dialTestClient(t, url)
+
+	reply := roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeSubmit, FuncName: "count"})
+	if reply.Type != rgoipc.MsgTypeJobStatus {
+		t.Fatalf("submit: %v", reply.Error)
+	}
+	id := reply.FuncName
+
+	info := pollJob(t, sock, id, func(info *rgoipc.JobInfo) bool { return info.Progress > 0 })
+	if info.State != rgoipc.JobRunning || info.Message != "halfway" || info.Function != "count" {
+		t.Errorf("running job: %+v", info)
+	}
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeJobResult, FuncName: id})
+	if reply.Error == nil || reply.Error.Code != rgoipc.CodeJobPending {
+		t.Errorf("result of a running job: expected job_pending, got %v", reply.Error)
+	}
+
+	close(release)
+	info = pollJob(t, sock, id, (*rgoipc.JobInfo).Done)
+	if info.State != rgoipc.JobSucceeded || info.Progress != 1 || info.Expires == nil {
+		t.Errorf("finished job: %+v", info)
+	}
+	// The result can be fetched more than once until the job expires
+	for i := 0; i < 2; i++ {
+		reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeJobResult, FuncName: id})
+		if reply.Type != rgoipc.MsgTypeResult {
+			t.Fatalf("job result: %v", reply.Error)
+		}
+		if batches, values := readStream(t, reply.ArrowData); batches != 3 || len(values) != 5 {
+			t.Errorf("job result: got %d batches %v", batches, values)
+		}
+	}
+
+	// Cancelling a running job
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeSubmit, FuncName: "wait"})
+	waiting := reply.FuncName
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeJobList})
+	jobs, err := rgoipc.ParseJobList(reply.ArrowData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || jobs[0].ID != id || jobs[1].ID != waiting {
+		t.Errorf("job list: %+v", jobs)
+	}
+	roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeJobCancel, FuncName: waiting})
+	info = pollJob(t, sock, waiting, (*rgoipc.JobInfo).Done)
+	if info.State != rgoipc.JobCancelled || info.Error == nil || info.Error.Code != rgoipc.CodeCancelled {
+		t.Errorf("cancelled job: %+v", info)
+	}
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeJobResult, FuncName: waiting})
+	if !errors.Is(reply.Error, rgoipc.ErrCancelled) {
+		t.Errorf("result of a cancelled job: %v", reply.Error)
+	}
+
+	// Cancelling a finished job discards it
+	roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeJobCancel, FuncName: waiting})
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeJobStatus, FuncName: waiting})
+	if reply.Error == nil || reply.Error.Code != rgoipc.CodeJobNotFound {
+		t.Errorf("discarded job: expected job_not_found, got %v", reply.Error)
+	}
+
+	// Finished jobs expire
+	time.Sleep(1500 * time.Millisecond)
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeJobResult, FuncName: id})
+	if !errors.Is(reply.Error, rgoipc.ErrJobNotFound) {
+		t.Errorf("expired job: %v", reply.Error)
+	}
+}
+
+func TestServerJobOwner(t *testing.T) {
+	registry := rgoipc.NewRegistry()
+	registry.RegisterContext("wait", waitHandler(nil), rgoipc.FunctionSignature{
+		ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeDynamic},
+	})
+	url, _ := startTestServer(t, registry, rgoipc.WithMaxJobs(1))
+	owner := dialTestClient(t, url)
+	other := dialTestClient(t, url)
+
+	reply := roundTrip(t, owner, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeSubmit, FuncName: "wait"})
+	if reply.Type != rgoipc.MsgTypeJobStatus {
+		t.Fatalf("submit: %v", reply.Error)
+	}
+	id := reply.FuncName
+
+	// Only one job may run at once
+	reply = roundTrip(t, other, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeSubmit, FuncName: "wait"})
+	if reply.Error == nil || reply.Error.Code != rgoipc.CodeLimitExceeded || reply.Error.Details["limit"] != "max_jobs" {
+		t.Errorf("submit over max_jobs: %v", reply.Error)
+	}
+
+	// Other clients neither see nor reach the job
+	for _, typ := range []rgoipc.MessageType{rgoipc.MsgTypeJobStatus, rgoipc.MsgTypeJobResult, rgoipc.MsgTypeJobCancel} {
+		reply = roundTrip(t, other, &rgoipc.RPCMessage{Type: typ, FuncName: id})
+		if !errors.Is(reply.Error, rgoipc.ErrJobNotFound) {
+			t.Errorf("message %d for the job of another client: %v", typ, reply.Error)
+		}
+	}
+	reply = roundTrip(t, other, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeJobList})
+	if jobs, err := rgoipc.ParseJobList(reply.ArrowData); err != nil || len(jobs) != 0 {
+		t.Errorf("job list of another client: %+v, %v", jobs, err)
+	}
+	if info := pollJob(t, owner, id, func(*rgoipc.JobInfo) bool { return true }); info.State != rgoipc.JobRunning {
+		t.Errorf("job after another client's cancel: %+v", info)
+	}
+
+	roundTrip(t, owner, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeJobCancel, FuncName: id})
+	pollJob(t, owner, id, (*rgoipc.JobInfo).Done)
+
+	// Built-in functions run as jobs too
+	reply = roundTrip(t, other, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeSubmit, FuncName: rgoipc.BuiltinPing})
+	if reply.Type != rgoipc.MsgTypeJobStatus {
+		t.Fatalf("submit %s: %v", rgoipc.BuiltinPing, reply.Error)
+	}
+	info := pollJob(t, other, reply.FuncName, (*rgoipc.JobInfo).Done)
+	if info.State != rgoipc.JobSucceeded {
+		t.Errorf("%s job: %+v", rgoipc.BuiltinPing, info)
+	}
+}
+
+func TestServerJobsOfDisconnectedClients(t *testing.T) {
+	started := make(chan struct{}, 1)
+	registry := rgoipc.NewRegistry()
+	registry.RegisterContext("wait", waitHandler(started), rgoipc.FunctionSignature{
+		ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeDynamic},
+	})
+	url, _ := startTestServer(t, registry, rgoipc.WithMaxFinishedJobs(2))
+	sock := dialTestClient(t, url)
+
+	// The job of an anonymous client ends with its session
+	reply := roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeSubmit, FuncName: "wait"})
+	if reply.Type != rgoipc.MsgTypeJobStatus {
+		t.Fatalf("submit: %v", reply.Error)
+	}
+	<-started
+	sock.Close()
+	stats := dialTestClient(t, url)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		jobs, _ := rgoipc.Column[float64](callBuiltin(t, stats, rgoipc.BuiltinStats, nil), "jobs")
+		if jobs[0] == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the job of a disconnected client is still kept")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Only the newest finished jobs are kept
+	var ids []string
+	for i := 0; i < 4; i++ {
+		reply := roundTrip(t, stats, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeSubmit, FuncName: rgoipc.BuiltinPing})
+		ids = append(ids, reply.FuncName)
+		pollJob(t, stats, reply.FuncName, (*rgoipc.JobInfo).Done)
+	}
+	// The last job is trimmed after it reports being done
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		reply = roundTrip(t, stats, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeJobList})
+		jobs, err := rgoipc.ParseJobList(reply.ArrowData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(jobs) == 2 && jobs[0].ID == ids[2] && jobs[1].ID == ids[3] {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("finished jobs kept: %+v", jobs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
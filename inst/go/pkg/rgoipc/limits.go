@@ -0,0 +1,368 @@
+package rgoipc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/apache/arrow/go/v18/arrow"
+	"github.com/apache/arrow/go/v18/arrow/array"
+	"github.com/apache/arrow/go/v18/arrow/memory"
+	flatbuffers "github.com/google/flatbuffers/go"
+	"go.nanomsg.org/mangos/v3"
+)
+
+// Limits bound the resources a single request may use. Going over one
+// fails the request with a limit_exceeded error. Zero fields are unlimited.
+type Limits struct {
+	// MaxMessageSize bounds the size of a request in bytes. It is also set
+	// as the socket's mangos.OptionMaxRecvSize, so that stream transports
+	// (ipc, tcp, tls+tcp) drop larger messages, and their connection,
+	// before buffering them.
+	MaxMessageSize int
+	// MaxColumns and MaxRows bound the input of a call, over all of its
+	// batches
+	MaxColumns int
+	MaxRows    int64
+	// MaxAllocation bounds the memory, in bytes, that the Arrow reader
+	// holds at once for the input of a call, and that handlers allocate
+	// through Allocator(ctx)
+	MaxAllocation int64
+}
+
+// WithLimits sets the resource limits of every request
+func WithLimits(limits Limits) ServerOption {
+	return func(s *Server) {
+		s.limits = limits
+	}
+}
+
+// AddFlags registers -max-message-size, -max-columns, -max-rows and
+// -max-allocation on fs
+func (l *Limits) AddFlags(fs *flag.FlagSet) {
+	fs.IntVar(&l.MaxMessageSize, "max-message-size", l.MaxMessageSize, "maximum request size in `bytes` (0: unlimited)")
+	fs.IntVar(&l.MaxColumns, "max-columns", l.MaxColumns, "maximum input columns of a call (0: unlimited)")
+	fs.Int64Var(&l.MaxRows, "max-rows", l.MaxRows, "maximum input rows of a call (0: unlimited)")
+	fs.Int64Var(&l.MaxAllocation, "max-allocation", l.MaxAllocation, "maximum Arrow memory of a call in `bytes` (0: unlimited)")
+}
+
+// applyLimits passes the message size limit on to the socket
+func (s *Server) applyLimits() {
+	if s.limits.MaxMessageSize > 0 {
+		if err := s.sock.SetOption(mangos.OptionMaxRecvSize, s.limits.MaxMessageSize); err != nil {
+			s.logger.Printf("can't set the maximum message size: %s", err)
+		}
+	}
+}
+
+// limitError is the error for a request over a limit
+func limitError(limit string, value, max int64) *RPCError {
+	return NewError(CodeLimitExceeded, "%s: %d exceeds the limit of %d", limit, value, max).
+		WithDetail("limit", limit).
+		WithDetail("value", fmt.Sprint(value)).
+		WithDetail("max", fmt.Sprint(max))
+}
+
+// checkMessage checks the size of a request
+func (l Limits) checkMessage(size int) error {
+	if l.MaxMessageSize > 0 && size > l.MaxMessageSize {
+		return limitError("max_message_size", int64(size), int64(l.MaxMessageSize))
+	}
+	return nil
+}
+
+// allocator returns the allocator for one call
+func (l Limits) allocator() memory.Allocator {
+	if l.MaxAllocation > 0 {
+		return NewLimitedAllocator(memory.DefaultAllocator, l.MaxAllocation)
+	}
+	return memory.DefaultAllocator
+}
+
+// LimitedAllocator is a memory.Allocator that fails allocations that would
+// take the bytes it has outstanding over a limit. memory.Allocator cannot
+// return errors, so it panics with a limit_exceeded *RPCError. The Arrow
+// IPC reader and the server recover such panics and return the error.
+type LimitedAllocator struct {
+	mem   memory.Allocator
+	limit int64
+	used  atomic.Int64
+}
+
+// NewLimitedAllocator wraps mem with a limit of limit bytes
+func NewLimitedAllocator(mem memory.Allocator, limit int64) *LimitedAllocator {
+	return &LimitedAllocator{mem: mem, limit: limit}
+}
+
+// Allocated returns the bytes allocated and not freed yet
+func (a *LimitedAllocator) Allocated() int64 {
+	return a.used.Load()
+}
+
+func (a *LimitedAllocator) reserve(size int64) {
+	if used := a.used.Add(size); size > 0 && used > a.limit {
+		a.used.Add(-size)
+		panic(limitError("max_allocation", used, a.limit))
+	}
+}
+
+// Allocate implements memory.Allocator
+func (a *LimitedAllocator) Allocate(size int) []byte {
+	a.reserve(int64(size))
+	return a.mem.Allocate(size)
+}
+
+// Reallocate implements memory.Allocator
+func (a *LimitedAllocator) Reallocate(size int, b []byte) []byte {
+	a.reserve(int64(size - len(b)))
+	return a.mem.Reallocate(size, b)
+}
+
+// Free implements memory.Allocator
+func (a *LimitedAllocator) Free(b []byte) {
+	a.used.Add(-int64(len(b)))
+	a.mem.Free(b)
+}
+
+// recoverLimit stores the limit error of a LimitedAllocator panic in *err.
+// Other panics carry on. It must be deferred itself.
+func recoverLimit(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if e, ok := r.(error); ok && errors.Is(e, ErrLimitExceeded) {
+		*err = e
+		return
+	}
+	panic(r)
+}
+
+// allocatorKey is the context key of the allocator of a call
+type allocatorKey struct{}
+
+// Allocator returns the allocator of the call ctx belongs to, which counts
+// against the server's Limits.MaxAllocation, or memory.DefaultAllocator
+// outside of calls. Handlers that build large results use it:
+//
+//	b := array.NewFloat64Builder(rgoipc.Allocator(ctx))
+func Allocator(ctx context.Context) memory.Allocator {
+	if mem, ok := ctx.Value(allocatorKey{}).(memory.Allocator); ok {
+		return mem
+	}
+	return memory.DefaultAllocator
+}
+
+func withAllocator(ctx context.Context, mem memory.Allocator) context.Context {
+	return context.WithValue(ctx, allocatorKey{}, mem)
+}
+
+// limitedReader fails once the batches read exceed the row limit
+type limitedReader struct {
+	array.RecordReader
+	limits Limits
+	rows   int64
+	err    error
+}
+
+// limitReader checks the columns of reader and bounds its rows
+func limitReader(reader array.RecordReader, limits Limits) (array.RecordReader, error) {
+	if max := limits.MaxColumns; max > 0 && reader.Schema().NumFields() > max {
+		return nil, limitError("max_columns", int64(reader.Schema().NumFields()), int64(max))
+	}
+	if limits.MaxRows <= 0 {
+		return reader, nil
+	}
+	return &limitedReader{RecordReader: reader, limits: limits}, nil
+}
+
+func (r *limitedReader) Next() bool {
+	if r.err != nil || !r.RecordReader.Next() {
+		return false
+	}
+	r.rows += r.Record().NumRows()
+	if r.rows > r.limits.MaxRows {
+		r.err = limitError("max_rows", r.rows, r.limits.MaxRows)
+		return false
+	}
+	return true
+}
+
+func (r *limitedReader) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.RecordReader.Err()
+}
+
+const (
+	ipcContinuation = 0xFFFFFFFF // starts the messages of an Arrow IPC stream
+
+	ipcMaxDecompressed = 256 << 20 // bytes of the compressed buffers of a batch once decompressed
+)
+
+// checkIPCFraming walks the messages of an Arrow IPC stream and checks that
+// their metadata and bodies fit in data, and that the buffers of compressed
+// batches decompress to at most ipcMaxDecompressed bytes. The IPC reader
+// allocates what the length fields and the uncompressed sizes of buffers
+// ask for before reading, so a corrupt or hostile one would otherwise
+// allocate up to 2 GiB, or more, whatever the limits of the server.
+func checkIPCFraming(data []byte) (err error) {
+	defer func() {
+		// flatbuffers does not check offsets
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: corrupt Arrow IPC message metadata", ErrInvalidMessage)
+		}
+	}()
+
+	for len(data) >= 4 {
+		n := binary.LittleEndian.Uint32(data)
+		data = data[4:]
+		if n == ipcContinuation {
+			if len(data) < 4 {
+				return fmt.Errorf("%w: truncated Arrow IPC message", ErrInvalidMessage)
+			}
+			n = binary.LittleEndian.Uint32(data)
+			data = data[4:]
+		}
+		if n == 0 {
+			return nil // end of stream
+		}
+		if uint64(n) > uint64(len(data)) || n < 8 {
+			return fmt.Errorf("%w: Arrow IPC metadata of %d bytes in %d remaining", ErrInvalidMessage, n, len(data))
+		}
+		meta := data[:n]
+		data = data[n:]
+
+		message := flatbuffers.Table{Bytes: meta, Pos: flatbuffers.GetUOffsetT(meta)}
+		body := messageBodyLength(message)
+		if body < 0 || uint64(body) > uint64(len(data)) {
+			return fmt.Errorf("%w: Arrow IPC body of %d bytes in %d remaining", ErrInvalidMessage, body, len(data))
+		}
+		if err := checkDecompressedSize(message, data[:body]); err != nil {
+			return err
+		}
+		data = data[body:]
+	}
+	return nil
+}
+
+// Fields of the Arrow IPC flatbuffers, as vtable offsets
+const (
+	fieldMessageHeaderType  = 4 + 2*1 // Message.header_type
+	fieldMessageHeader      = 4 + 2*2 // Message.header
+	fieldMessageBodyLength  = 4 + 2*3 // Message.bodyLength
+	fieldDictionaryData     = 4 + 2*1 // DictionaryBatch.data
+	fieldBatchBuffers       = 4 + 2*2 // RecordBatch.buffers
+	fieldBatchCompression   = 4 + 2*3 // RecordBatch.compression
+	headerDictionaryBatch   = 2       // MessageHeader.DictionaryBatch
+	headerRecordBatch       = 3       // MessageHeader.RecordBatch
+	ipcBufferSize           = 16      // Buffer struct: offset and length
+	ipcUncompressedPrefix   = 8       // int64 uncompressed size of a compressed buffer
+	ipcUncompressedVerbatim = -1      // the prefix of a buffer left uncompressed
+)
+
+// messageBodyLength reads the bodyLength field of an Arrow IPC Message
+func messageBodyLength(message flatbuffers.Table) int64 {
+	if off := message.Offset(fieldMessageBodyLength); off != 0 {
+		return message.GetInt64(message.Pos + flatbuffers.UOffsetT(off))
+	}
+	return 0
+}
+
+// checkDecompressedSize checks the uncompressed sizes that prefix the
+// buffers of a compressed record or dictionary batch against
+// ipcMaxDecompressed
+func checkDecompressedSize(message flatbuffers.Table, body []byte) error {
+	off := message.Offset(fieldMessageHeaderType)
+	if off == 0 {
+		return nil
+	}
+	headerType := message.GetByte(message.Pos + flatbuffers.UOffsetT(off))
+	if headerType != headerRecordBatch && headerType != headerDictionaryBatch {
+		return nil
+	}
+	off = message.Offset(fieldMessageHeader)
+	if off == 0 {
+		return nil
+	}
+	var batch flatbuffers.Table
+	message.Union(&batch, flatbuffers.UOffsetT(off))
+	if headerType == headerDictionaryBatch {
+		off := batch.Offset(fieldDictionaryData)
+		if off == 0 {
+			return nil
+		}
+		batch = flatbuffers.Table{Bytes: batch.Bytes, Pos: batch.Indirect(batch.Pos + flatbuffers.UOffsetT(off))}
+	}
+	if batch.Offset(fieldBatchCompression) == 0 {
+		return nil
+	}
+
+	off = batch.Offset(fieldBatchBuffers)
+	if off == 0 {
+		return nil
+	}
+	vec := batch.Vector(flatbuffers.UOffsetT(off))
+	var total int64
+	for i := 0; i < batch.VectorLen(flatbuffers.UOffsetT(off)); i++ {
+		pos := vec + flatbuffers.UOffsetT(i*ipcBufferSize)
+		offset, length := batch.GetInt64(pos), batch.GetInt64(pos+8)
+		if length == 0 {
+			continue
+		}
+		if offset < 0 || length < ipcUncompressedPrefix || uint64(offset) > uint64(len(body)) || uint64(length) > uint64(len(body))-uint64(offset) {
+			return fmt.Errorf("%w: Arrow IPC buffer of %d bytes at %d in a body of %d", ErrInvalidMessage, length, offset, len(body))
+		}
+		size := int64(binary.LittleEndian.Uint64(body[offset:]))
+		if size == ipcUncompressedVerbatim {
+			continue
+		}
+		if size < 0 || size > ipcMaxDecompressed-total {
+			return fmt.Errorf("%w: Arrow IPC batch decompresses to more than %d bytes", ErrInvalidMessage, ipcMaxDecompressed)
+		}
+		total += size
+	}
+	return nil
+}
+
+// inputReader returns a reader over the input of a call that allocates
+// from mem and keeps within the server's limits
+func (s *Server) inputReader(data []byte, mem memory.Allocator) (array.RecordReader, error) {
+	reader, err := newRecordReader(data, mem)
+	if err != nil {
+		return nil, inputError(err)
+	}
+	limited, err := limitReader(reader, s.limits)
+	if err != nil {
+		reader.Release()
+		return nil, err
+	}
+	return limited, nil
+}
+
+// readInput reads the input of a call into one record, like inputReader
+func (s *Server) readInput(data []byte, mem memory.Allocator) (arrow.Record, error) {
+	reader, err := s.inputReader(data, mem)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Release()
+	rec, err := readAll(reader, mem)
+	if err != nil {
+		return nil, inputError(err)
+	}
+	return rec, nil
+}
+
+// inputError wraps an error reading the input of a call. Limit errors,
+// which the Arrow reader recovers from the allocator, keep their code.
+func inputError(err error) error {
+	if errors.Is(err, ErrLimitExceeded) {
+		return err
+	}
+	return fmt.Errorf("%w: arrow read error: %w", ErrInvalidMessage, err)
+}
@@ -0,0 +1,237 @@
+package rgoipc_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"runtime"
+	"testing"
+
+	"mangoro.local/pkg/rgoipc"
+
+	"github.com/apache/arrow/go/v18/arrow"
+	"github.com/apache/arrow/go/v18/arrow/array"
+	"github.com/apache/arrow/go/v18/arrow/ipc"
+	"github.com/apache/arrow/go/v18/arrow/memory"
+)
+
+func TestServerLimits(t *testing.T) {
+	registry := rgoipc.NewRegistry()
+	registry.Register("add", testAddHandler, rgoipc.FunctionSignature{
+		ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64},
+	})
+	registry.RegisterContext("big", func(ctx context.Context, _ arrow.Record) (arrow.Record, error) {
+		b := array.NewFloat64Builder(rgoipc.Allocator(ctx))
+		defer b.Release()
+		b.AppendValues(make([]float64, 1<<20), nil)
+		return nil, errors.New("allocated past the limit")
+	}, rgoipc.FunctionSignature{ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64}})
+
+	url, _ := startTestServer(t, registry, rgoipc.WithLimits(rgoipc.Limits{
+		MaxMessageSize: 4096,
+		MaxColumns:     2,
+		MaxRows:        50,
+		MaxAllocation:  64 << 10,
+	}))
+	sock := dialTestClient(t, url)
+	call := func(name string, input []byte) *rgoipc.RPCMessage {
+		return roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: name, ArrowData: input})
+	}
+	expectLimit := func(reply *rgoipc.RPCMessage, limit string) {
+		t.Helper()
+		if reply.Error == nil || reply.Error.Code != rgoipc.CodeLimitExceeded || reply.Error.Details["limit"] != limit {
+			t.Errorf("%s: got %v", limit, reply.Error)
+		}
+	}
+
+	if reply := call("add", float64Record(t, []string{"x", "y"}, []float64{1}, []float64{2})); reply.Type != rgoipc.MsgTypeResult {
+		t.Fatalf("call within the limits: %v", reply.Error)
+	}
+	expectLimit(call("add", float64Record(t, []string{"x", "y", "z"}, []float64{1}, []float64{2}, []float64{3})), "max_columns")
+	expectLimit(call("add", float64Record(t, []string{"x", "y"}, make([]float64, 60), make([]float64, 60))), "max_rows")
+	expectLimit(call("add", float64Record(t, []string{"x", "y"}, make([]float64, 1000), make([]float64, 1000))), "max_message_size")
+	expectLimit(call("big", nil), "max_allocation")
+
+	if fn, _ := registry.Get("big"); fn.Stats().Panics != 0 {
+		t.Errorf("an allocation over the limit counted as a panic: %+v", fn.Stats())
+	}
+}
+
+func TestServerAllocationLimit(t *testing.T) {
+	registry := rgoipc.NewRegistry()
+	registry.Register("add", testAddHandler, rgoipc.FunctionSignature{
+		ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64},
+	})
+	url, _ := startTestServer(t, registry, rgoipc.WithLimits(rgoipc.Limits{MaxAllocation: 1024}))
+	sock := dialTestClient(t, url)
+
+	// The Arrow reader allocates the input body from the call's allocator
+	input := float64Record(t, []string{"x", "y"}, make([]float64, 500), make([]float64, 500))
+	reply := roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "add", ArrowData: input})
+	if reply.Error == nil || reply.Error.Code != rgoipc.CodeLimitExceeded {
+		t.Errorf("input over the allocation limit: %v", reply.Error)
+	}
+}
+
+func TestArrowReaderFraming(t *testing.T) {
+	data := float64Record(t, []string{"x"}, []float64{1, 2, 3})
+	if _, err := rgoipc.ReadArrowRecord(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// A metadata length past the end of the message
+	bad := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint32(bad[4:], 0x7fffffff)
+	if _, err := rgoipc.ReadArrowRecord(bad); !errors.Is(err, rgoipc.ErrInvalidMessage) {
+		t.Errorf("huge metadata length: %v", err)
+	}
+
+	// A truncated body
+	if _, err := rgoipc.ReadArrowRecord(data[:len(data)-20]); !errors.Is(err, rgoipc.ErrInvalidMessage) {
+		t.Errorf("truncated body: %v", err)
+	}
+}
+
+func TestLimitedAllocator(t *testing.T) {
+	mem := rgoipc.NewLimitedAllocator(memory.NewGoAllocator(), 1024)
+	b := mem.Allocate(512)
+	b = mem.Reallocate(1000, b)
+	if mem.Allocated() != 1000 {
+		t.Errorf("allocated %d, want 1000", mem.Allocated())
+	}
+
+	func() {
+		defer func() {
+			err, _ := recover().(error)
+			if !errors.Is(err, rgoipc.ErrLimitExceeded) {
+				t.Errorf("allocation over the limit: %v", err)
+			}
+		}()
+		mem.Allocate(100)
+	}()
+
+	mem.Free(b)
+	if mem.Allocated() != 0 {
+		t.Errorf("allocated %d after free", mem.Allocated())
+	}
+}
+
+func TestServerAllocationCoversConversions(t *testing.T) {
+	registry := rgoipc.NewRegistry()
+	registry.Register("first", func(input arrow.Record) (arrow.Record, error) {
+		first := array.NewSlice(input.Column(0), 0, 1)
+		defer first.Release()
+		return rgoipc.NewRecordBuilder().AddArray("result", first).NewRecord()
+	}, rgoipc.FunctionSignature{
+		Args:       []rgoipc.ArgSpec{{Name: "x", Type: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64}}},
+		ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64},
+	})
+	if err := rgoipc.RegisterFunc(registry, "double", func(x float64) float64 { return 2 * x }, rgoipc.WithArgNames("x")); err != nil {
+		t.Fatal(err)
+	}
+	url, _ := startTestServer(t, registry,
+		rgoipc.WithValidation(rgoipc.ValidateInput),
+		rgoipc.WithLimits(rgoipc.Limits{MaxAllocation: 64 << 10}))
+	sock := dialTestClient(t, url)
+
+	// The input fits, but not once converted from R integers to doubles
+	rec, err := rgoipc.NewRecordBuilder().Add("x", make([]int32, 6000)).NewRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, err := rgoipc.WriteArrowRecord(rec)
+	rec.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"first", "double"} {
+		reply := roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: name, ArrowData: input})
+		if reply.Error == nil || reply.Error.Code != rgoipc.CodeLimitExceeded || reply.Error.Details["limit"] != "max_allocation" {
+			t.Errorf("%s: conversion over the allocation limit: %v", name, reply.Error)
+		}
+	}
+}
+
+func TestServerMessageSizeBeforeDecoding(t *testing.T) {
+	url, _ := startTestServer(t, rgoipc.NewRegistry(), rgoipc.WithLimits(rgoipc.Limits{MaxMessageSize: 1024}))
+	sock := dialTestClient(t, url)
+
+	// An oversized request is refused as such, even if it does not decode
+	data := (&rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "add", RequestID: 5}).Marshal()
+	data = append(data[:16], make([]byte, 2048)...)
+	if err := sock.Send(data); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := sock.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := rgoipc.UnmarshalRPCMessage(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.RequestID != 5 || reply.Error == nil || reply.Error.Details["limit"] != "max_message_size" {
+		t.Errorf("oversized request: %d %v", reply.RequestID, reply.Error)
+	}
+}
+
+func TestRecordBuilderAllocator(t *testing.T) {
+	mem := rgoipc.NewLimitedAllocator(memory.NewGoAllocator(), 1024)
+	defer func() {
+		err, _ := recover().(error)
+		if !errors.Is(err, rgoipc.ErrLimitExceeded) {
+			t.Errorf("column over the limit: %v", err)
+		}
+	}()
+	rgoipc.NewRecordBuilder().UseAllocator(mem).Add("x", make([]float64, 1000))
+}
+
+func TestServerCompressedInput(t *testing.T) {
+	registry := rgoipc.NewRegistry()
+	registry.Register("add", testAddHandler, rgoipc.FunctionSignature{
+		ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64},
+	})
+	url, _ := startTestServer(t, registry)
+	sock := dialTestClient(t, url)
+
+	rec, err := rgoipc.NewRecordBuilder().Add("x", []float64{1, 2, 3}).Add("y", []float64{4, 5, 6}).NewRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rec.Release()
+	var buf bytes.Buffer
+	w := ipc.NewWriter(&buf, ipc.WithSchema(rec.Schema()), ipc.WithLZ4())
+	if err := w.Write(rec); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	input := buf.Bytes()
+
+	reply := roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "add", ArrowData: input})
+	if reply.Type != rgoipc.MsgTypeResult {
+		t.Fatalf("compressed input: %v", reply.Error)
+	}
+
+	// A buffer that claims to decompress to 1 GiB is refused before the
+	// reader allocates it, even without limits
+	frame := bytes.Index(input, []byte{0x04, 0x22, 0x4d, 0x18}) // LZ4 frame magic
+	if frame < 8 {
+		t.Fatal("no compressed buffer in the stream")
+	}
+	bad := append([]byte(nil), input...)
+	binary.LittleEndian.PutUint64(bad[frame-8:], 1<<30)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "add", ArrowData: bad})
+	runtime.ReadMemStats(&after)
+	if !errors.Is(reply.Error, rgoipc.ErrInvalidMessage) {
+		t.Errorf("oversized compressed buffer: %v", reply.Error)
+	}
+	if n := after.TotalAlloc - before.TotalAlloc; n > 64<<20 {
+		t.Errorf("oversized compressed buffer allocated %d bytes", n)
+	}
+}
@@ -0,0 +1,133 @@
+package rgoipc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.nanomsg.org/mangos/v3"
+
+	// Transports a server can listen on
+	_ "go.nanomsg.org/mangos/v3/transport/inproc"
+	_ "go.nanomsg.org/mangos/v3/transport/ipc"
+	_ "go.nanomsg.org/mangos/v3/transport/tcp"
+	_ "go.nanomsg.org/mangos/v3/transport/tlstcp"
+	_ "go.nanomsg.org/mangos/v3/transport/ws"
+	_ "go.nanomsg.org/mangos/v3/transport/wss"
+)
+
+// tlsSchemes are the URL schemes of the transports that need a tls.Config
+var tlsSchemes = map[string]bool{"tls+tcp": true, "wss": true}
+
+// Listen binds sock to every one of urls, so that one server can take
+// requests from local R sessions over ipc:// and from remote ones over
+// tcp:// or tls+tcp:// at the same time:
+//
+//	rgoipc.Listen(sock, tlsConfig, "ipc:///tmp/svc.ipc", "tls+tcp://0.0.0.0:5555")
+//
+// The schemes are ipc, inproc, tcp, tls+tcp, ws and wss. tlsConfig is used by
+// the tls+tcp and wss listeners and may be nil if there are none. Clients
+// that present a verified certificate on them get a Peer identity (see
+// PeerFrom). On error the listeners bound so far are left open; they close
+// with the socket.
+func Listen(sock mangos.Socket, tlsConfig *tls.Config, urls ...string) error {
+	if len(urls) == 0 {
+		return errors.New("no listen URL")
+	}
+	for _, url := range urls {
+		scheme, _, _ := strings.Cut(url, "://")
+		var options map[string]interface{}
+		if tlsSchemes[scheme] {
+			if tlsConfig == nil {
+				return fmt.Errorf("listen on %s: %s needs a TLS certificate", url, scheme)
+			}
+			options = map[string]interface{}{mangos.OptionTLSConfig: recordPeers(tlsConfig)}
+		}
+		if err := sock.ListenOptions(url, options); err != nil {
+			return fmt.Errorf("listen on %s: %w", url, err)
+		}
+	}
+	return nil
+}
+
+// LoadTLSConfig builds a server TLS configuration from a PEM certificate and
+// key. If caFile is not empty, its PEM certificates are trusted to verify
+// peers: they become the RootCAs and ClientCAs of the configuration.
+func LoadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load TLS certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("load TLS CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("load TLS CA: no certificates in %s", caFile)
+		}
+		config.RootCAs = pool
+		config.ClientCAs = pool
+	}
+	return config, nil
+}
+
+// ListenConfig collects the listen URLs and TLS files of a server command
+// from its command line:
+//
+//	var lc rgoipc.ListenConfig
+//	lc.AddFlags(flag.CommandLine)
+//	flag.Parse()
+//	lc.URLs = flag.Args()
+//	...
+//	err := lc.Listen(sock)
+type ListenConfig struct {
+	URLs       []string
+	CertFile   string
+	KeyFile    string
+	CAFile     string
+	ClientAuth bool // require client certificates signed by the CA
+}
+
+// AddFlags defines the -tls-cert, -tls-key, -tls-ca and -tls-client-auth
+// flags on fs
+func (c *ListenConfig) AddFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.CertFile, "tls-cert", "", "PEM `file` with the certificate for tls+tcp:// and wss:// URLs")
+	fs.StringVar(&c.KeyFile, "tls-key", "", "PEM `file` with the key of the certificate")
+	fs.StringVar(&c.CAFile, "tls-ca", "", "PEM `file` with the CA certificates that verify peers")
+	fs.BoolVar(&c.ClientAuth, "tls-client-auth", false, "require client certificates signed by the -tls-ca certificates")
+}
+
+// TLSConfig loads the configured certificate, or returns nil if there is
+// none
+func (c *ListenConfig) TLSConfig() (*tls.Config, error) {
+	if c.CertFile == "" && c.KeyFile == "" {
+		if c.CAFile != "" || c.ClientAuth {
+			return nil, errors.New("a TLS CA or client authentication needs a certificate and key")
+		}
+		return nil, nil
+	}
+	config, err := LoadTLSConfig(c.CertFile, c.KeyFile, c.CAFile)
+	if err != nil || !c.ClientAuth {
+		return config, err
+	}
+	return RequireClientCerts(config)
+}
+
+// Listen binds sock to the configured URLs
+func (c *ListenConfig) Listen(sock mangos.Socket) error {
+	tlsConfig, err := c.TLSConfig()
+	if err != nil {
+		return err
+	}
+	return Listen(sock, tlsConfig, c.URLs...)
+}
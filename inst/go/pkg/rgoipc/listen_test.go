@@ -0,0 +1,186 @@
+package rgoipc_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"mangoro.local/pkg/rgoipc"
+
+	"go.nanomsg.org/mangos/v3"
+	"go.nanomsg.org/mangos/v3/protocol/rep"
+	"go.nanomsg.org/mangos/v3/protocol/req"
+)
+
+// testCA issues certificates for TLS tests
+type testCA struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string // PEM of the CA certificate
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	ca := &testCA{dir: t.TempDir()}
+	ca.cert, ca.key, ca.file, _ = ca.create(t, "ca", &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "rgoipc test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	return ca
+}
+
+// issue creates a certificate for 127.0.0.1 named name and returns its
+// certificate and key files
+func (ca *testCA) issue(t *testing.T, name string) (string, string) {
+	t.Helper()
+
+	_, _, certFile, keyFile := ca.create(t, name, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+	})
+	return certFile, keyFile
+}
+
+func (ca *testCA) create(t *testing.T, name string, tmpl *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl.SerialNumber = serial
+	tmpl.NotBefore = time.Now().Add(-time.Minute)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	parent, signer := tmpl, key
+	if ca.cert != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(ca.dir, name+".pem")
+	keyFile := filepath.Join(ca.dir, name+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return cert, key, certFile, keyFile
+}
+
+func writePEM(t *testing.T, file, kind string, der []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// freeTCPAddr returns a local address that was free a moment ago
+func freeTCPAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestListenMultipleTransports(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, "server")
+	tlsConfig, err := rgoipc.LoadTLSConfig(certFile, keyFile, ca.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	urls := []string{
+		fmt.Sprintf("inproc://rgoipc-listen-%d", inprocSeq.Add(1)),
+		"tcp://" + freeTCPAddr(t),
+		"tls+tcp://" + freeTCPAddr(t),
+		"ws://" + freeTCPAddr(t) + "/rpc",
+	}
+	sock, err := rep.NewSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rgoipc.Listen(sock, tlsConfig, urls...); err != nil {
+		t.Fatal(err)
+	}
+	server := rgoipc.NewServer(rgoipc.NewRegistry(), sock)
+	errc := make(chan error, 1)
+	go func() { errc <- server.Serve(context.Background()) }()
+	t.Cleanup(func() {
+		server.Shutdown(context.Background())
+		<-errc
+	})
+
+	clientTLS := map[string]interface{}{mangos.OptionTLSConfig: &tls.Config{RootCAs: tlsConfig.RootCAs}}
+	for i, url := range urls {
+		client, err := req.NewSocket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		client.SetOption(mangos.OptionRecvDeadline, 5*time.Second)
+		var options map[string]interface{}
+		if i == 2 {
+			options = clientTLS
+		}
+		if err := client.DialOptions(url, options); err != nil {
+			t.Fatalf("dial %s: %v", url, err)
+		}
+		reply := roundTrip(t, client, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: rgoipc.BuiltinPing})
+		if reply.Type != rgoipc.MsgTypeResult {
+			t.Errorf("%s: %v", url, reply.Error)
+		}
+	}
+}
+
+func TestListenErrors(t *testing.T) {
+	sock, err := rep.NewSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+
+	if err := rgoipc.Listen(sock, nil); err == nil {
+		t.Error("Listen without URLs succeeded")
+	}
+	if err := rgoipc.Listen(sock, nil, "tls+tcp://"+freeTCPAddr(t)); err == nil {
+		t.Error("tls+tcp listener without a TLS configuration")
+	}
+	if err := rgoipc.Listen(sock, nil, "carrier-pigeon://home"); err == nil {
+		t.Error("listened on an unknown transport")
+	}
+	if _, err := rgoipc.LoadTLSConfig("missing.pem", "missing.key", ""); err == nil {
+		t.Error("loaded a missing certificate")
+	}
+}
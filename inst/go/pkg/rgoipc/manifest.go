@@ -0,0 +1,156 @@
+package rgoipc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/apache/arrow/go/v18/arrow"
+	"github.com/apache/arrow/go/v18/arrow/ipc"
+)
+
+// ManifestVersion is the version of the manifest format written by
+// Registry.Manifest. It is bumped on incompatible changes only; new optional
+// fields may appear without a bump.
+const ManifestVersion = 1
+
+// Manifest is the reply to a manifest request: a JSON document describing
+// every registered function
+type Manifest struct {
+	Version   int                `json:"manifest_version"`
+	Protocol  uint8              `json:"protocol_version"` // highest wire version the server speaks
+	Functions []FunctionManifest `json:"functions"`        // sorted by name
+}
+
+// FunctionManifest describes one function. The schemas are Arrow IPC
+// streams holding only a schema message (no record batch), base64-encoded
+// in JSON, so that any Arrow implementation can decode them; see
+// DecodeSchema. OutputSchema is omitted for TypeDynamic returns.
+type FunctionManifest struct {
+	Name         string            `json:"name"`
+	Description  string            `json:"description,omitempty"`
+	Tags         []string          `json:"tags,omitempty"`
+	Scopes       []string          `json:"scopes,omitempty"` // needed to call the function
+	Args         []ArgManifest     `json:"args"`
+	Returns      ArrowType         `json:"returns"`
+	Vectorized   bool              `json:"vectorized"`
+	Streaming    bool              `json:"streaming,omitempty"`  // may return several record batches
+	TimeoutMS    int64             `json:"timeout_ms,omitempty"` // default timeout of a call
+	DynamicArgs  bool              `json:"dynamic_args,omitempty"`
+	InputSchema  []byte            `json:"input_schema"`
+	OutputSchema []byte            `json:"output_schema,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+// ArgManifest describes one argument
+type ArgManifest struct {
+	Name     string          `json:"name"`
+	Type     ArrowType       `json:"type"`
+	Nullable bool            `json:"nullable"`
+	Optional bool            `json:"optional"`
+	Default  json.RawMessage `json:"default,omitempty"`
+	Levels   []string        `json:"levels,omitempty"` // allowed values of a dictionary (factor)
+}
+
+// BuildManifest describes the registered functions
+func (r *Registry) BuildManifest() (*Manifest, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	m := &Manifest{
+		Version:   ManifestVersion,
+		Protocol:  ProtocolVersion,
+		Functions: make([]FunctionManifest, 0, len(r.functions)),
+	}
+	for _, fn := range r.functions {
+		fm, err := fn.manifest()
+		if err != nil {
+			return nil, fmt.Errorf("function %s: %w", fn.Name, err)
+		}
+		m.Functions = append(m.Functions, fm)
+	}
+	sort.Slice(m.Functions, func(i, j int) bool {
+		return m.Functions[i].Name < m.Functions[j].Name
+	})
+	return m, nil
+}
+
+func (fn *RegisteredFunction) manifest() (FunctionManifest, error) {
+	sig := fn.Signature
+	fm := FunctionManifest{
+		Name:        fn.Name,
+		Description: sig.Description,
+		Tags:        sig.Tags,
+		Scopes:      sig.Scopes,
+		Args:        make([]ArgManifest, len(sig.Args)),
+		Returns:     sig.ReturnType.Type,
+		Vectorized:  sig.Vectorized,
+		DynamicArgs: sig.DynamicArgs,
+		Streaming:   fn.streaming(),
+		TimeoutMS:   fn.Signature.Timeout.Milliseconds(),
+		Metadata:    sig.Metadata,
+	}
+
+	for i, arg := range sig.Args {
+		fm.Args[i] = ArgManifest{
+			Name:     arg.Name,
+			Type:     arg.Type.Type,
+			Nullable: fn.InputSchema.Field(i).Nullable,
+			Optional: arg.Optional,
+			Levels:   arg.Type.Levels,
+		}
+		if arg.Default != nil {
+			def, err := json.Marshal(arg.Default)
+			if err != nil {
+				return fm, fmt.Errorf("default of arg %s: %w", arg.Name, err)
+			}
+			fm.Args[i].Default = def
+		}
+	}
+
+	var err error
+	if fm.InputSchema, err = EncodeSchema(fn.InputSchema); err != nil {
+		return fm, err
+	}
+	if fn.OutputSchema != nil {
+		if fm.OutputSchema, err = EncodeSchema(fn.OutputSchema); err != nil {
+			return fm, err
+		}
+	}
+	return fm, nil
+}
+
+// ParseManifest decodes a manifest reply
+func ParseManifest(data []byte) (*Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%w: manifest: %w", ErrInvalidMessage, err)
+	}
+	if m.Version != ManifestVersion {
+		return nil, fmt.Errorf("%w: unsupported manifest version %d", ErrInvalidMessage, m.Version)
+	}
+	return &m, nil
+}
+
+// EncodeSchema serializes schema as an Arrow IPC stream without record
+// batches
+func EncodeSchema(schema *arrow.Schema) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := ipc.NewWriter(&buf, ipc.WithSchema(schema))
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeSchema reads the schema of an Arrow IPC stream, such as the
+// InputSchema and OutputSchema of a FunctionManifest
+func DecodeSchema(data []byte) (*arrow.Schema, error) {
+	reader, err := NewArrowReader(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidSchema, err)
+	}
+	defer reader.Release()
+	return reader.Schema(), nil
+}
@@ -0,0 +1,71 @@
+package rgoipc_test
+
+import (
+	"testing"
+
+	"mangoro.local/pkg/rgoipc"
+)
+
+func TestManifest(t *testing.T) {
+	registry := rgoipc.NewRegistry()
+	registry.Register("scale", testAddHandler, rgoipc.FunctionSignature{
+		Args: []rgoipc.ArgSpec{
+			{Name: "x", Type: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64, Nullable: true}},
+			{Name: "factor", Type: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64}, Optional: true, Default: 2.5},
+		},
+		ReturnType:  rgoipc.TypeSpec{Type: rgoipc.TypeFloat64},
+		Vectorized:  true,
+		Description: "Scale a numeric vector",
+		Tags:        []string{"math"},
+	})
+	registry.Register("anything", testAddHandler, rgoipc.FunctionSignature{
+		DynamicArgs: true,
+		ReturnType:  rgoipc.TypeSpec{Type: rgoipc.TypeDynamic},
+	})
+
+	data, err := registry.Manifest()
+	if err != nil {
+		t.Fatalf("Manifest: %v", err)
+	}
+	m, err := rgoipc.ParseManifest(data)
+	if err != nil {
+		t.Fatalf("ParseManifest: %v", err)
+	}
+	if m.Version != rgoipc.ManifestVersion || m.Protocol != rgoipc.ProtocolVersion {
+		t.Errorf("versions: got %d/%d", m.Version, m.Protocol)
+	}
+	if len(m.Functions) != 2 || m.Functions[0].Name != "anything" || m.Functions[1].Name != "scale" {
+		t.Fatalf("functions not listed by name: %+v", m.Functions)
+	}
+
+	dynamic, scale := m.Functions[0], m.Functions[1]
+	if dynamic.OutputSchema != nil || !dynamic.DynamicArgs || dynamic.Returns != rgoipc.TypeDynamic {
+		t.Errorf("dynamic function described wrongly: %+v", dynamic)
+	}
+	if scale.Description != "Scale a numeric vector" || len(scale.Tags) != 1 || scale.Tags[0] != "math" {
+		t.Errorf("description/tags: %+v", scale)
+	}
+	if string(scale.Args[1].Default) != "2.5" || !scale.Args[1].Nullable || scale.Args[0].Default != nil {
+		t.Errorf("args: %+v", scale.Args)
+	}
+
+	fn, _ := registry.Get("scale")
+	input, err := rgoipc.DecodeSchema(scale.InputSchema)
+	if err != nil {
+		t.Fatalf("DecodeSchema: %v", err)
+	}
+	if !input.Equal(fn.InputSchema) {
+		t.Errorf("input schema %s, want %s", input, fn.InputSchema)
+	}
+	output, err := rgoipc.DecodeSchema(scale.OutputSchema)
+	if err != nil {
+		t.Fatalf("DecodeSchema: %v", err)
+	}
+	if !output.Equal(fn.OutputSchema) {
+		t.Errorf("output schema %s, want %s", output, fn.OutputSchema)
+	}
+
+	if _, err := rgoipc.ParseManifest([]byte(`{"manifest_version": 99}`)); err == nil {
+		t.Error("expected an error for an unknown manifest version")
+	}
+}
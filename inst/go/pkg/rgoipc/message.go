@@ -2,8 +2,14 @@ package rgoipc
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
 
 	"github.com/apache/arrow/go/v18/arrow"
+	"github.com/apache/arrow/go/v18/arrow/array"
 	"github.com/apache/arrow/go/v18/arrow/ipc"
 	"github.com/apache/arrow/go/v18/arrow/memory"
 )
@@ -12,99 +18,367 @@ import (
 type MessageType uint8
 
 const (
-	MsgTypeManifest MessageType = iota // Go → R: function list
-	MsgTypeCall                        // R → Go: function call
-	MsgTypeResult                      // Go → R: result
-	MsgTypeError                       // Go → R: error
+	MsgTypeManifest      MessageType = iota // Go → R: function list
+	MsgTypeCall                             // R → Go: function call
+	MsgTypeResult                           // Go → R: result
+	MsgTypeError                            // Go → R: error
+	MsgTypeStreamNext                       // R → Go: next chunk of a streamed result
+	MsgTypeCancel                           // R → Go: cancel a call or a stream
+	MsgTypeSubmit                           // R → Go: run a call as a job
+	MsgTypeJobStatus                        // R ↔ Go: status of a job
+	MsgTypeJobResult                        // R → Go: fetch the result of a job
+	MsgTypeJobCancel                        // R → Go: cancel or discard a job
+	MsgTypeJobList                          // R ↔ Go: list the jobs
+	MsgTypeHandleList                       // R ↔ Go: list the live handles
+	MsgTypeHandleRelease                    // R ↔ Go: release a handle
+	MsgTypeEvent                            // Go → R: record batch published on a topic
 )
 
+// Wire format versions understood by UnmarshalRPCMessage
+const (
+	ProtocolV1 uint8 = 1 // legacy layout without header
+	ProtocolV2 uint8 = 2 // magic, version, flags and request ID
+
+	// ProtocolVersion is the version written by Marshal by default
+	ProtocolVersion = ProtocolV2
+)
+
+// Header flags (v2 only)
+const (
+	// FlagErrorDetail marks an error section holding a JSON-encoded RPCError
+	// instead of plain text
+	FlagErrorDetail uint16 = 1 << 0
+	// FlagStream on a call asks for a streamed result of a streaming
+	// function, sent as chunks that the client pulls with
+	// MsgTypeStreamNext. Chunk replies carry it too, with the stream ID in
+	// FuncName.
+	FlagStream uint16 = 1 << 1
+	// FlagEndOfStream marks the last chunk of a streamed result
+	FlagEndOfStream uint16 = 1 << 2
+	// FlagDeadline marks a call whose header carries the client's timeout
+	// in milliseconds, as 8 bytes after the request ID
+	FlagDeadline uint16 = 1 << 3
+	// FlagToken marks a call whose header carries an API token for the
+	// server's Authorizer, as a length prefixed section after the timeout
+	FlagToken uint16 = 1 << 4
+)
+
+// Magic starts every v2 message. Its first byte is not a valid v1 message
+// type, which is how v1 and v2 messages are told apart.
+const Magic = "MGRO"
+
+// v2HeaderSize is magic + version + type + flags + request ID
+const v2HeaderSize = 4 + 1 + 1 + 2 + 8
+
 // RPCMessage wraps Arrow IPC data with metadata
 type RPCMessage struct {
 	Type      MessageType
 	FuncName  string
 	ArrowData []byte // Arrow IPC stream format
 	ErrorMsg  string // For error messages
+
+	// Version selects the wire layout; zero means ProtocolVersion.
+	// UnmarshalRPCMessage reports the version it decoded so that replies
+	// can be written in the layout the client understands.
+	Version uint8
+	// Flags marks optional header fields (v2 only). Marshal sets the flags
+	// that describe the other fields, such as FlagErrorDetail.
+	Flags uint16
+	// RequestID correlates a reply with its request (v2 only). Servers
+	// echo the ID of the call in MsgTypeResult and MsgTypeError replies.
+	RequestID uint64
+	// Error is the structured form of an error reply. In v2 it replaces
+	// ErrorMsg on the wire; v1 only carries its message.
+	Error *RPCError
+	// Timeout is how long the client waits for the reply to a call (v2
+	// only, see FlagDeadline). Zero means no client deadline.
+	Timeout time.Duration
+	// Token is the API token the client authenticates with (v2 only, see
+	// FlagToken)
+	Token string
 }
 
 // Marshal serializes RPC message to wire format
-// Format: [type:1byte][name_len:4bytes][name][error_len:4bytes][error][arrow_data]
+//
+// v2: [magic:4][version:1][type:1][flags:2][request_id:8][timeout_ms:8]?
+//
+//	[token_len:4][token]?[name_len:4][name][error_len:4][error][arrow_data]
+//
+// timeout_ms is only present with FlagDeadline, the token with FlagToken.
+//
+// v1: [type:1byte][name_len:4bytes][name][error_len:4bytes][error][arrow_data]
+//
+// All integers are big-endian.
 func (m *RPCMessage) Marshal() []byte {
-	nameBytes := []byte(m.FuncName)
-	nameLen := uint32(len(nameBytes))
-	errorBytes := []byte(m.ErrorMsg)
-	errorLen := uint32(len(errorBytes))
-
-	buf := make([]byte, 1+4+int(nameLen)+4+int(errorLen)+len(m.ArrowData))
-	pos := 0
-
-	// Type
-	buf[pos] = byte(m.Type)
-	pos++
-
-	// Function name length + name
-	buf[pos] = byte(nameLen >> 24)
-	buf[pos+1] = byte(nameLen >> 16)
-	buf[pos+2] = byte(nameLen >> 8)
-	buf[pos+3] = byte(nameLen)
-	pos += 4
-	copy(buf[pos:], nameBytes)
-	pos += len(nameBytes)
-
-	// Error length + error
-	buf[pos] = byte(errorLen >> 24)
-	buf[pos+1] = byte(errorLen >> 16)
-	buf[pos+2] = byte(errorLen >> 8)
-	buf[pos+3] = byte(errorLen)
-	pos += 4
-	copy(buf[pos:], errorBytes)
-	pos += len(errorBytes)
-
-	// Arrow data
-	copy(buf[pos:], m.ArrowData)
-
-	return buf
-}
-
-// UnmarshalRPCMessage deserializes RPC message from wire format
+	errorText := m.ErrorMsg
+	if errorText == "" && m.Error != nil {
+		errorText = m.Error.Message
+	}
+
+	if m.Version == ProtocolV1 {
+		buf := make([]byte, 0, 1+4+len(m.FuncName)+4+len(errorText)+len(m.ArrowData))
+		buf = append(buf, byte(m.Type))
+		return m.appendBody(buf, []byte(errorText))
+	}
+
+	flags := m.Flags &^ (FlagErrorDetail | FlagDeadline | FlagToken)
+	if m.Timeout > 0 {
+		flags |= FlagDeadline
+	}
+	if m.Token != "" {
+		flags |= FlagToken
+	}
+	errorBytes := []byte(errorText)
+	if m.Error != nil {
+		if detail, err := json.Marshal(m.Error); err == nil {
+			flags |= FlagErrorDetail
+			errorBytes = detail
+		}
+	}
+
+	buf := make([]byte, 0, v2HeaderSize+8+4+len(m.Token)+4+len(m.FuncName)+4+len(errorBytes)+len(m.ArrowData))
+	buf = append(buf, Magic...)
+	buf = append(buf, ProtocolV2, byte(m.Type))
+	buf = binary.BigEndian.AppendUint16(buf, flags)
+	buf = binary.BigEndian.AppendUint64(buf, m.RequestID)
+	if flags&FlagDeadline != 0 {
+		// Rounded up so that a sub-millisecond timeout is not lost
+		buf = binary.BigEndian.AppendUint64(buf, uint64((m.Timeout+time.Millisecond-1)/time.Millisecond))
+	}
+	if flags&FlagToken != 0 {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(m.Token)))
+		buf = append(buf, m.Token...)
+	}
+	return m.appendBody(buf, errorBytes)
+}
+
+// appendBody appends the sections shared by v1 and v2
+func (m *RPCMessage) appendBody(buf, errorBytes []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(m.FuncName)))
+	buf = append(buf, m.FuncName...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(errorBytes)))
+	buf = append(buf, errorBytes...)
+	return append(buf, m.ArrowData...)
+}
+
+// UnmarshalRPCMessage deserializes RPC message from wire format.
+// Both the v2 layout and the legacy v1 layout are accepted.
 func UnmarshalRPCMessage(data []byte) (*RPCMessage, error) {
+	if IsV2Message(data) {
+		return unmarshalV2(data)
+	}
+	return unmarshalV1(data)
+}
+
+// IsV2Message reports whether data starts with the v2 magic
+func IsV2Message(data []byte) bool {
+	return len(data) >= len(Magic) && string(data[:len(Magic)]) == Magic
+}
+
+func unmarshalV1(data []byte) (*RPCMessage, error) {
 	if len(data) < 9 { // minimum: 1 + 4 + 0 + 4 + 0
 		return nil, ErrInvalidMessage
 	}
 
-	msg := &RPCMessage{}
-	pos := 0
-
-	// Type
-	msg.Type = MessageType(data[pos])
-	pos++
+	msg := &RPCMessage{
+		Type:    MessageType(data[0]),
+		Version: ProtocolV1,
+	}
+	if err := msg.readBody(data[1:]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
 
-	// Function name
-	nameLen := uint32(data[pos])<<24 | uint32(data[pos+1])<<16 | uint32(data[pos+2])<<8 | uint32(data[pos+3])
-	pos += 4
-	if pos+int(nameLen) > len(data) {
+func unmarshalV2(data []byte) (*RPCMessage, error) {
+	if len(data) < v2HeaderSize+8 {
 		return nil, ErrInvalidMessage
 	}
-	msg.FuncName = string(data[pos : pos+int(nameLen)])
-	pos += int(nameLen)
 
-	// Error message
-	errorLen := uint32(data[pos])<<24 | uint32(data[pos+1])<<16 | uint32(data[pos+2])<<8 | uint32(data[pos+3])
-	pos += 4
-	if pos+int(errorLen) > len(data) {
-		return nil, ErrInvalidMessage
+	version := data[4]
+	if version != ProtocolV2 {
+		return nil, fmt.Errorf("%w: unsupported protocol version %d", ErrInvalidMessage, version)
 	}
-	msg.ErrorMsg = string(data[pos : pos+int(errorLen)])
-	pos += int(errorLen)
 
-	// Arrow data
-	msg.ArrowData = data[pos:]
+	msg := &RPCMessage{
+		Version:   version,
+		Type:      MessageType(data[5]),
+		Flags:     binary.BigEndian.Uint16(data[6:8]),
+		RequestID: binary.BigEndian.Uint64(data[8:16]),
+	}
+	body := data[v2HeaderSize:]
+	if msg.Flags&FlagDeadline != 0 {
+		if len(body) < 8+8 {
+			return nil, ErrInvalidMessage
+		}
+		ms := binary.BigEndian.Uint64(body)
+		if ms > uint64(math.MaxInt64/time.Millisecond) {
+			ms = uint64(math.MaxInt64 / time.Millisecond)
+		}
+		msg.Timeout = time.Duration(ms) * time.Millisecond
+		body = body[8:]
+	}
+	if msg.Flags&FlagToken != 0 {
+		token, rest, ok := readSection(body)
+		if !ok {
+			return nil, ErrInvalidMessage
+		}
+		msg.Token = string(token)
+		body = rest
+	}
+	if err := msg.readBody(body); err != nil {
+		return nil, err
+	}
 
+	if msg.Flags&FlagErrorDetail != 0 {
+		msg.Error = &RPCError{}
+		if err := json.Unmarshal([]byte(msg.ErrorMsg), msg.Error); err != nil {
+			return nil, fmt.Errorf("%w: bad error detail: %s", ErrInvalidMessage, err)
+		}
+		msg.ErrorMsg = msg.Error.Message
+	}
 	return msg, nil
 }
 
-// NewArrowReader creates an Arrow IPC reader from bytes
+// readBody decodes [name_len][name][error_len][error][arrow_data]
+func (m *RPCMessage) readBody(data []byte) error {
+	name, rest, ok := readSection(data)
+	if !ok {
+		return ErrInvalidMessage
+	}
+	errMsg, rest, ok := readSection(rest)
+	if !ok {
+		return ErrInvalidMessage
+	}
+
+	m.FuncName = string(name)
+	m.ErrorMsg = string(errMsg)
+	m.ArrowData = rest
+	return nil
+}
+
+// readSection splits a 4-byte length prefixed section off data
+func readSection(data []byte) (section, rest []byte, ok bool) {
+	if len(data) < 4 {
+		return nil, nil, false
+	}
+	n := binary.BigEndian.Uint32(data)
+	data = data[4:]
+	if uint64(n) > uint64(len(data)) {
+		return nil, nil, false
+	}
+	return data[:n], data[n:], true
+}
+
+// NewArrowReader creates an Arrow IPC reader from bytes. The length
+// fields of the stream are checked against len(data) first.
 func NewArrowReader(data []byte) (*ipc.Reader, error) {
-	return ipc.NewReader(bytes.NewReader(data), ipc.WithAllocator(memory.DefaultAllocator))
+	return newArrowReader(data, memory.DefaultAllocator)
+}
+
+// newArrowReader creates an Arrow IPC reader allocating from mem
+func newArrowReader(data []byte, mem memory.Allocator) (*ipc.Reader, error) {
+	if err := checkIPCFraming(data); err != nil {
+		return nil, err
+	}
+	return ipc.NewReader(bytes.NewReader(data), ipc.WithAllocator(mem))
+}
+
+// ReadArrowRecord decodes an Arrow IPC stream into one record, concatenating
+// its batches: R sends chunked streams (e.g. from
+// nanoarrow::basic_array_stream()) for large inputs.
+//
+// Empty input is handled the same way for every caller: an empty payload
+// yields a record with no columns and no rows, and a stream that carries a
+// schema but no batch yields a zero-row record with that schema. This is what
+// R sends for zero-argument calls and for empty data.frames.
+func ReadArrowRecord(data []byte) (arrow.Record, error) {
+	reader, err := NewRecordReader(data)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Release()
+	return readAll(reader, memory.DefaultAllocator)
+}
+
+// readAll reads the remaining batches of reader into one record,
+// allocating from mem to join them
+func readAll(reader array.RecordReader, mem memory.Allocator) (arrow.Record, error) {
+	var batches []arrow.Record
+	defer func() {
+		for _, b := range batches {
+			b.Release()
+		}
+	}()
+	for reader.Next() {
+		record := reader.Record()
+		record.Retain()
+		batches = append(batches, record)
+	}
+	if err := reader.Err(); err != nil {
+		return nil, err
+	}
+	return concatRecords(mem, reader.Schema(), batches)
+}
+
+// NewRecordReader returns a reader over the batches of an Arrow IPC stream.
+// An empty payload reads as a stream with no columns and no batches.
+func NewRecordReader(data []byte) (array.RecordReader, error) {
+	return newRecordReader(data, memory.DefaultAllocator)
+}
+
+func newRecordReader(data []byte, mem memory.Allocator) (array.RecordReader, error) {
+	if len(data) == 0 {
+		return array.NewRecordReader(arrow.NewSchema([]arrow.Field{}, nil), nil)
+	}
+	reader, err := newArrowReader(data, mem)
+	if err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+// concatRecords joins batches of the same schema into one record. A single
+// batch is returned as is (retained); no batch gives a zero-row record.
+func concatRecords(mem memory.Allocator, schema *arrow.Schema, batches []arrow.Record) (arrow.Record, error) {
+	switch len(batches) {
+	case 0:
+		builder := array.NewRecordBuilder(mem, schema)
+		defer builder.Release()
+		return builder.NewRecord(), nil
+	case 1:
+		batches[0].Retain()
+		return batches[0], nil
+	}
+
+	var rows int64
+	for i, b := range batches {
+		if !b.Schema().Equal(schema) {
+			return nil, fmt.Errorf("batch %d has schema %s, expected %s", i+1, b.Schema(), schema)
+		}
+		rows += b.NumRows()
+	}
+
+	cols := make([]arrow.Array, schema.NumFields())
+	defer func() {
+		for _, c := range cols {
+			if c != nil {
+				c.Release()
+			}
+		}
+	}()
+	for i := range cols {
+		chunks := make([]arrow.Array, len(batches))
+		for j, b := range batches {
+			chunks[j] = b.Column(i)
+		}
+		col, err := array.Concatenate(chunks, mem)
+		if err != nil {
+			return nil, err
+		}
+		cols[i] = col
+	}
+	return array.NewRecord(schema, cols, rows), nil
 }
 
 // WriteArrowRecord writes an Arrow record to bytes
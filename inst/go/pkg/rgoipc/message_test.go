@@ -0,0 +1,121 @@
+package rgoipc_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"mangoro.local/pkg/rgoipc"
+)
+
+func TestMessageV2RequestID(t *testing.T) {
+	msg := &rgoipc.RPCMessage{
+		Type:      rgoipc.MsgTypeError,
+		FuncName:  "add",
+		ErrorMsg:  "boom",
+		ArrowData: []byte{9, 8, 7},
+		RequestID: 0xdeadbeefcafe0001,
+	}
+
+	data := msg.Marshal()
+	if !bytes.HasPrefix(data, []byte(rgoipc.Magic)) {
+		t.Fatalf("v2 message does not start with magic: %v", data[:4])
+	}
+
+	decoded, err := rgoipc.UnmarshalRPCMessage(data)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+	if decoded.Version != rgoipc.ProtocolV2 {
+		t.Errorf("expected version 2, got %d", decoded.Version)
+	}
+	if decoded.RequestID != msg.RequestID {
+		t.Errorf("RequestID mismatch: expected %x, got %x", msg.RequestID, decoded.RequestID)
+	}
+	if decoded.Type != msg.Type || decoded.FuncName != msg.FuncName || decoded.ErrorMsg != msg.ErrorMsg {
+		t.Errorf("decoded %+v does not match %+v", decoded, msg)
+	}
+	if !bytes.Equal(decoded.ArrowData, msg.ArrowData) {
+		t.Errorf("ArrowData mismatch: %v", decoded.ArrowData)
+	}
+}
+
+func TestMessageDeadline(t *testing.T) {
+	msg := &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "add", RequestID: 3, Timeout: 1500 * time.Millisecond}
+
+	decoded, err := rgoipc.UnmarshalRPCMessage(msg.Marshal())
+	if err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+	if decoded.Flags&rgoipc.FlagDeadline == 0 || decoded.Timeout != msg.Timeout {
+		t.Errorf("timeout not carried: flags %b, timeout %s", decoded.Flags, decoded.Timeout)
+	}
+	if decoded.FuncName != "add" || decoded.RequestID != 3 {
+		t.Errorf("body misread after the timeout: %+v", decoded)
+	}
+
+	msg.Timeout = 0
+	if decoded, _ := rgoipc.UnmarshalRPCMessage(msg.Marshal()); decoded.Flags&rgoipc.FlagDeadline != 0 {
+		t.Errorf("FlagDeadline set without a timeout")
+	}
+}
+
+func TestMessageV1Compat(t *testing.T) {
+	// Layout written by mangoro_rpc_call_message() in R/mangoro-utils.R
+	data := []byte{1, 0, 0, 0, 3, 'a', 'd', 'd', 0, 0, 0, 0, 0xff}
+
+	decoded, err := rgoipc.UnmarshalRPCMessage(data)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal v1: %v", err)
+	}
+	if decoded.Version != rgoipc.ProtocolV1 || decoded.Type != rgoipc.MsgTypeCall || decoded.FuncName != "add" {
+		t.Errorf("unexpected v1 decode: %+v", decoded)
+	}
+	if !bytes.Equal(decoded.Marshal(), data) {
+		t.Errorf("v1 message does not re-marshal to the same bytes")
+	}
+}
+
+func TestMessageTruncated(t *testing.T) {
+	full := (&rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "add", ErrorMsg: "x"}).Marshal()
+	for n := 0; n < len(full); n++ {
+		if _, err := rgoipc.UnmarshalRPCMessage(full[:n]); !errors.Is(err, rgoipc.ErrInvalidMessage) {
+			t.Errorf("truncated to %d bytes: expected ErrInvalidMessage, got %v", n, err)
+		}
+	}
+
+	v1 := (&rgoipc.RPCMessage{Version: rgoipc.ProtocolV1, FuncName: "add"}).Marshal()
+	if _, err := rgoipc.UnmarshalRPCMessage(v1[:len(v1)-2]); !errors.Is(err, rgoipc.ErrInvalidMessage) {
+		t.Errorf("truncated v1: expected ErrInvalidMessage, got %v", err)
+	}
+}
+
+func TestMessageRPCErrorRoundTrip(t *testing.T) {
+	rpcErr := rgoipc.AsRPCError(errors.Join(rgoipc.ErrFunctionNotFound, errors.New("no such function: foo")))
+	rpcErr.WithDetail("function", "foo")
+	rpcErr.Stack = "goroutine 1 [running]:"
+
+	msg := &rgoipc.RPCMessage{Type: rgoipc.MsgTypeError, FuncName: "foo", Error: rpcErr}
+	decoded, err := rgoipc.UnmarshalRPCMessage(msg.Marshal())
+	if err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+
+	got := decoded.Error
+	if got == nil {
+		t.Fatal("structured error lost")
+	}
+	if decoded.Flags&rgoipc.FlagErrorDetail == 0 {
+		t.Error("FlagErrorDetail not set")
+	}
+	if got.Code != rgoipc.CodeFunctionNotFound || got.Message != rpcErr.Message || decoded.ErrorMsg != rpcErr.Message {
+		t.Errorf("decoded %+v, want %+v", got, rpcErr)
+	}
+	if len(got.Causes) != 2 || got.Details["function"] != "foo" || got.Stack != rpcErr.Stack {
+		t.Errorf("causes/details/stack not preserved: %+v", got)
+	}
+	if !errors.Is(got, rgoipc.ErrFunctionNotFound) || errors.Is(got, rgoipc.ErrExecutionFailed) {
+		t.Error("decoded error does not map back to its sentinel")
+	}
+}
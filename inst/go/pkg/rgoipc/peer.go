@@ -0,0 +1,186 @@
+package rgoipc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"go.nanomsg.org/mangos/v3"
+)
+
+// Peer is the identity of a client that presented a TLS certificate the
+// server verified. Handlers reach it with PeerFrom to decide what the caller
+// may do.
+type Peer struct {
+	CommonName     string
+	DNSNames       []string
+	EmailAddresses []string
+	URIs           []string
+	IPAddresses    []string
+	Certificate    *x509.Certificate // the client's leaf certificate
+}
+
+// Names returns the common name followed by the subject alternative names
+func (p *Peer) Names() []string {
+	var names []string
+	if p.CommonName != "" {
+		names = append(names, p.CommonName)
+	}
+	names = append(names, p.DNSNames...)
+	names = append(names, p.EmailAddresses...)
+	names = append(names, p.URIs...)
+	return append(names, p.IPAddresses...)
+}
+
+// PeerFrom returns the verified identity of the client whose request ctx
+// belongs to, or nil if the client did not connect over TLS with a
+// certificate
+func PeerFrom(ctx context.Context) *Peer {
+	if sess := SessionFrom(ctx); sess != nil {
+		return sess.Peer
+	}
+	return nil
+}
+
+func newPeer(cert *x509.Certificate) *Peer {
+	p := &Peer{
+		CommonName:     cert.Subject.CommonName,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		Certificate:    cert,
+	}
+	for _, u := range cert.URIs {
+		p.URIs = append(p.URIs, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		p.IPAddresses = append(p.IPAddresses, ip.String())
+	}
+	return p
+}
+
+// RequireClientCerts returns a copy of config that makes clients present a
+// certificate signed by one of config.ClientCAs, which LoadTLSConfig sets
+// from its CA file. Connections without one fail the TLS handshake.
+func RequireClientCerts(config *tls.Config) (*tls.Config, error) {
+	if config == nil || config.ClientCAs == nil {
+		return nil, errors.New("client certificates need a CA to verify them")
+	}
+	config = config.Clone()
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
+
+// The tls+tcp transport takes the connection state of a pipe before the
+// TLS handshake, so it never holds the client certificate. Listen therefore
+// records verified certificates itself, by connection addresses, and the
+// server picks them up when the pipe is attached.
+var verifiedPeers = struct {
+	sync.Mutex
+	m map[string]verifiedPeer
+}{m: make(map[string]verifiedPeer)}
+
+type verifiedPeer struct {
+	peer *Peer
+	at   time.Time
+}
+
+// verifiedPeerTTL bounds how long the certificate of a connection that
+// never became a pipe is kept
+const verifiedPeerTTL = time.Minute
+
+func connKey(local, remote net.Addr) string {
+	return local.String() + "|" + remote.String()
+}
+
+// recordPeers returns a copy of config that records the verified client
+// certificate of every connection
+func recordPeers(config *tls.Config) *tls.Config {
+	base := config.Clone()
+	wrapped := config.Clone()
+	wrapped.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		conf := base
+		if base.GetConfigForClient != nil {
+			c, err := base.GetConfigForClient(hello)
+			if err != nil {
+				return nil, err
+			}
+			if c != nil {
+				conf = c
+			}
+		}
+		conf = conf.Clone()
+		verify := conf.VerifyConnection
+		key := connKey(hello.Conn.LocalAddr(), hello.Conn.RemoteAddr())
+		conf.VerifyConnection = func(cs tls.ConnectionState) error {
+			if verify != nil {
+				if err := verify(cs); err != nil {
+					return err
+				}
+			}
+			if len(cs.VerifiedChains) > 0 {
+				storePeer(key, newPeer(cs.VerifiedChains[0][0]))
+			}
+			return nil
+		}
+		return conf, nil
+	}
+	return wrapped
+}
+
+func storePeer(key string, peer *Peer) {
+	now := time.Now()
+	verifiedPeers.Lock()
+	defer verifiedPeers.Unlock()
+	for k, v := range verifiedPeers.m {
+		if now.Sub(v.at) > verifiedPeerTTL {
+			delete(verifiedPeers.m, k)
+		}
+	}
+	verifiedPeers.m[key] = verifiedPeer{peer, now}
+}
+
+// pipePeer returns the verified identity of the client on p, or nil
+func pipePeer(p mangos.Pipe) *Peer {
+	if peer := takeVerifiedPeer(p); peer != nil {
+		return peer
+	}
+	// WebSocket pipes carry the state after the handshake, also when the
+	// listener was not set up by Listen
+	if v, err := p.GetOption(mangos.OptionTLSConnState); err == nil {
+		if cs, ok := v.(tls.ConnectionState); ok && len(cs.VerifiedChains) > 0 {
+			return newPeer(cs.VerifiedChains[0][0])
+		}
+	}
+	return nil
+}
+
+// takeVerifiedPeer removes and returns the identity recordPeers stored for
+// the connection of p
+func takeVerifiedPeer(p mangos.Pipe) *Peer {
+	local, err := p.GetOption(mangos.OptionLocalAddr)
+	if err != nil {
+		return nil
+	}
+	remote, err := p.GetOption(mangos.OptionRemoteAddr)
+	if err != nil {
+		return nil
+	}
+	la, ok1 := local.(net.Addr)
+	ra, ok2 := remote.(net.Addr)
+	if !ok1 || !ok2 {
+		return nil
+	}
+	key := connKey(la, ra)
+	verifiedPeers.Lock()
+	defer verifiedPeers.Unlock()
+	v, ok := verifiedPeers.m[key]
+	delete(verifiedPeers.m, key)
+	if !ok {
+		return nil
+	}
+	return v.peer
+}
@@ -0,0 +1,191 @@
+package rgoipc_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"mangoro.local/pkg/rgoipc"
+
+	"github.com/apache/arrow/go/v18/arrow"
+	"go.nanomsg.org/mangos/v3"
+	"go.nanomsg.org/mangos/v3/protocol/rep"
+	"go.nanomsg.org/mangos/v3/protocol/req"
+)
+
+func TestServerMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, "server")
+	tlsConfig, err := rgoipc.LoadTLSConfig(certFile, keyFile, ca.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig, err = rgoipc.RequireClientCerts(tlsConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	registry := rgoipc.NewRegistry()
+	registry.RegisterContext("whoami", func(ctx context.Context, _ arrow.Record) (arrow.Record, error) {
+		name := "anonymous"
+		if peer := rgoipc.PeerFrom(ctx); peer != nil {
+			name = peer.CommonName
+		}
+		return rgoipc.NewRecordBuilder().Add("name", []string{name}).NewRecord()
+	}, rgoipc.FunctionSignature{ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeString}})
+
+	urls := []string{"tls+tcp://" + freeTCPAddr(t), "wss://" + freeTCPAddr(t) + "/rpc"}
+	sock, err := rep.NewSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rgoipc.Listen(sock, tlsConfig, urls...); err != nil {
+		t.Fatal(err)
+	}
+	server := rgoipc.NewServer(registry, sock)
+	errc := make(chan error, 1)
+	go func() { errc <- server.Serve(context.Background()) }()
+	t.Cleanup(func() {
+		server.Shutdown(context.Background())
+		<-errc
+	})
+
+	aliceCert, aliceKey := ca.issue(t, "alice")
+	alice, err := tls.LoadX509KeyPair(aliceCert, aliceKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := func(url string, certs ...tls.Certificate) (mangos.Socket, error) {
+		client, err := req.NewSocket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		client.SetOption(mangos.OptionRecvDeadline, 2*time.Second)
+		config := &tls.Config{RootCAs: tlsConfig.RootCAs, Certificates: certs}
+		return client, client.DialOptions(url, map[string]interface{}{mangos.OptionTLSConfig: config})
+	}
+
+	for _, url := range urls {
+		client, err := dial(url, alice)
+		if err != nil {
+			t.Fatalf("dial %s: %v", url, err)
+		}
+		reply := roundTrip(t, client, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "whoami"})
+		if reply.Type != rgoipc.MsgTypeResult {
+			t.Fatalf("%s: %v", url, reply.Error)
+		}
+		rec, err := rgoipc.ReadArrowRecord(reply.ArrowData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names, _ := rgoipc.Column[string](rec, "name"); names[0] != "alice" {
+			t.Errorf("%s: peer = %q, want alice", url, names[0])
+		}
+		rec.Release()
+
+		// Clients without a certificate are turned away
+		anonymous, err := dial(url)
+		if err != nil {
+			continue
+		}
+		if err := anonymous.Send((&rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "whoami"}).Marshal()); err == nil {
+			if _, err := anonymous.Recv(); err == nil {
+				t.Errorf("%s: a client without a certificate was answered", url)
+			}
+		}
+	}
+
+	if _, err := rgoipc.RequireClientCerts(&tls.Config{}); err == nil {
+		t.Error("client authentication without a CA")
+	}
+}
+
+func TestServerPeersWithoutCommonName(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, "server")
+	tlsConfig, err := rgoipc.LoadTLSConfig(certFile, keyFile, ca.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig, err = rgoipc.RequireClientCerts(tlsConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	registry := rgoipc.NewRegistry()
+	registry.SetAuthorizer(rgoipc.AuthorizerFunc(func(_ context.Context, req rgoipc.AuthRequest) error {
+		if req.Function == rgoipc.BuiltinVersion {
+			return errors.New("no version for peers")
+		}
+		return nil
+	}))
+	var audit syncBuffer
+	url := "tls+tcp://" + freeTCPAddr(t)
+	sock, err := rep.NewSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := rgoipc.NewServer(registry, sock, rgoipc.WithAuditLog(log.New(&audit, "", 0)))
+	if err := rgoipc.Listen(sock, tlsConfig, url); err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- server.Serve(context.Background()) }()
+	t.Cleanup(func() {
+		server.Shutdown(context.Background())
+		<-errc
+	})
+
+	// Two certificates that only have subject alternative names
+	dial := func(name string) mangos.Socket {
+		t.Helper()
+		_, _, certFile, keyFile := ca.create(t, name, &x509.Certificate{
+			DNSNames:    []string{name},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+		})
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := req.NewSocket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		client.SetOption(mangos.OptionRecvDeadline, 2*time.Second)
+		config := &tls.Config{RootCAs: tlsConfig.RootCAs, Certificates: []tls.Certificate{cert}}
+		if err := client.DialOptions(url, map[string]interface{}{mangos.OptionTLSConfig: config}); err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+	first, second := dial("first.example"), dial("second.example")
+
+	// Their jobs stay apart
+	for _, client := range []mangos.Socket{first, second} {
+		reply := roundTrip(t, client, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeSubmit, FuncName: rgoipc.BuiltinPing})
+		if reply.Type != rgoipc.MsgTypeJobStatus {
+			t.Fatalf("submit: %v", reply.Error)
+		}
+	}
+	for _, client := range []mangos.Socket{first, second} {
+		reply := roundTrip(t, client, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeJobList})
+		if jobs, err := rgoipc.ParseJobList(reply.ArrowData); err != nil || len(jobs) != 1 {
+			t.Errorf("job list: %+v, %v", jobs, err)
+		}
+	}
+
+	// The audit line names the peer by its alternative names
+	reply := roundTrip(t, first, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: rgoipc.BuiltinVersion})
+	if !errors.Is(reply.Error, rgoipc.ErrPermissionDenied) {
+		t.Fatalf("%s: %v", rgoipc.BuiltinVersion, reply.Error)
+	}
+	if line := audit.String(); !strings.Contains(line, "peer=first.example ") {
+		t.Errorf("audit line: %q", line)
+	}
+}
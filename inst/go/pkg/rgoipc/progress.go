@@ -0,0 +1,174 @@
+package rgoipc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.nanomsg.org/mangos/v3"
+)
+
+// ProgressEvent is a progress report of a call or job. The server publishes
+// it on its progress socket as the topic, a NUL byte and the event as JSON.
+type ProgressEvent struct {
+	Session   uint32    `json:"session"` // Session.ID of the client
+	RequestID uint64    `json:"request_id"`
+	Job       string    `json:"job,omitempty"`
+	Function  string    `json:"function"`
+	Done      int64     `json:"done,omitempty"`
+	Total     int64     `json:"total,omitempty"` // zero when unknown
+	Fraction  float64   `json:"fraction"`
+	Message   string    `json:"message,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// Topic is the topic the event is published under: JobProgressTopic for
+// jobs, CallProgressTopic otherwise
+func (e *ProgressEvent) Topic() string {
+	if e.Job != "" {
+		return JobProgressTopic(e.Job)
+	}
+	return CallProgressTopic(e.Session, e.RequestID)
+}
+
+// CallProgressTopic is the topic of the progress events of the calls with
+// a request ID made by a session. Request IDs are chosen by clients, so
+// the session ID, which .session returns, tells the calls of two clients
+// apart. v1 calls have no request ID and publish under ID 0.
+func CallProgressTopic(session uint32, requestID uint64) string {
+	return "progress/call/" + strconv.FormatUint(uint64(session), 10) + "/" + strconv.FormatUint(requestID, 10)
+}
+
+// JobProgressTopic is the topic of the progress events of a job
+func JobProgressTopic(id string) string {
+	return "progress/job/" + id
+}
+
+// ParseProgressEvent decodes a message received from a progress socket
+func ParseProgressEvent(data []byte) (topic string, event *ProgressEvent, err error) {
+	i := bytes.IndexByte(data, 0)
+	if i < 0 {
+		return "", nil, fmt.Errorf("%w: progress event without topic", ErrInvalidMessage)
+	}
+	event = &ProgressEvent{}
+	if err := json.Unmarshal(data[i+1:], event); err != nil {
+		return "", nil, fmt.Errorf("%w: progress event: %w", ErrInvalidMessage, err)
+	}
+	return string(data[:i]), event, nil
+}
+
+// WithProgressSocket publishes the progress events of calls and jobs on
+// sock, a PUB socket created and bound by the caller. The server closes it
+// along with its own socket.
+func WithProgressSocket(sock mangos.Socket) ServerOption {
+	return func(s *Server) {
+		s.progressSock = sock
+	}
+}
+
+// WithProgressInterval sets the minimum time between two progress events
+// published for the same call; reports in between only update job
+// statuses. Reports of completion are always published. The default is
+// 100ms.
+func WithProgressInterval(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.progressInterval = d
+	}
+}
+
+// Progress reports that the call ctx belongs to has done done out of total
+// units of work (total is zero when unknown), with an optional message. The
+// report updates the status of jobs and is published on the server's
+// progress socket. It does nothing outside of server calls and jobs.
+func Progress(ctx context.Context, done, total int64, message string) {
+	fraction := 0.0
+	if total > 0 {
+		fraction = float64(done) / float64(total)
+	}
+	reportProgress(ctx, ProgressEvent{Done: done, Total: total, Fraction: fraction, Message: message})
+}
+
+// ReportProgress is like Progress for work that is not counted in units,
+// with the fraction done between 0 and 1
+func ReportProgress(ctx context.Context, fraction float64, message string) {
+	reportProgress(ctx, ProgressEvent{Fraction: fraction, Message: message})
+}
+
+func reportProgress(ctx context.Context, event ProgressEvent) {
+	p, ok := ctx.Value(progressKey{}).(*progressReporter)
+	if !ok {
+		return
+	}
+	event.Fraction = min(max(event.Fraction, 0), 1)
+	p.report(event)
+}
+
+// progressKey is the context key of the progress reporter of a call
+type progressKey struct{}
+
+// progressReporter fills in and publishes the progress events of one call
+// or job
+type progressReporter struct {
+	server *Server
+	key    ProgressEvent // request ID, job and function of every event
+	job    *job          // nil for calls
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+// withProgress returns ctx with a progress reporter for the events of key
+// and the session of ctx, which also updates j when it is not nil
+func (s *Server) withProgress(ctx context.Context, key ProgressEvent, j *job) context.Context {
+	if sess := SessionFrom(ctx); sess != nil {
+		key.Session = sess.ID
+	}
+	return context.WithValue(ctx, progressKey{}, &progressReporter{server: s, key: key, job: j})
+}
+
+func (p *progressReporter) report(event ProgressEvent) {
+	event.Session = p.key.Session
+	event.RequestID = p.key.RequestID
+	event.Job = p.key.Job
+	event.Function = p.key.Function
+	event.Time = time.Now()
+
+	if j := p.job; j != nil {
+		j.mu.Lock()
+		if j.info.State == JobRunning {
+			j.info.Progress = event.Fraction
+			j.info.Completed = event.Done
+			j.info.Total = event.Total
+			j.info.Message = event.Message
+		}
+		j.mu.Unlock()
+	}
+
+	s := p.server
+	if s.progressSock == nil {
+		return
+	}
+	p.mu.Lock()
+	if event.Fraction < 1 && event.Time.Sub(p.last) < s.progressInterval {
+		p.mu.Unlock()
+		return
+	}
+	p.last = event.Time
+	p.mu.Unlock()
+
+	data, err := json.Marshal(&event)
+	if err != nil {
+		s.logger.Printf("progress event: %s", err)
+		return
+	}
+	msg := append([]byte(event.Topic()+"\x00"), data...)
+	// PUB sockets drop events for subscribers that cannot keep up rather
+	// than block the handler
+	if err := s.progressSock.Send(msg); err != nil && !s.isClosing() {
+		s.logger.Printf("progress send error: %s", err)
+	}
+}
@@ -0,0 +1,106 @@
+package rgoipc_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"mangoro.local/pkg/rgoipc"
+
+	"github.com/apache/arrow/go/v18/arrow"
+	"go.nanomsg.org/mangos/v3"
+	"go.nanomsg.org/mangos/v3/protocol/pub"
+	"go.nanomsg.org/mangos/v3/protocol/sub"
+)
+
+func TestServerPublishesProgress(t *testing.T) {
+	url := fmt.Sprintf("inproc://rgoipc-progress-%d", inprocSeq.Add(1))
+	publisher, err := pub.NewSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Listen(url); err != nil {
+		t.Fatal(err)
+	}
+	subscriber, err := sub.NewSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { subscriber.Close() })
+	subscriber.SetOption(mangos.OptionRecvDeadline, 5*time.Second)
+	if err := subscriber.Dial(url); err != nil {
+		t.Fatal(err)
+	}
+
+	// The handler reports until the test has seen an event, since the
+	// subscriber may connect late
+	seen := make(chan struct{})
+	registry := rgoipc.NewRegistry()
+	registry.RegisterContext("work", func(ctx context.Context, _ arrow.Record) (arrow.Record, error) {
+		for {
+			rgoipc.Progress(ctx, 1, 4, "working")
+			select {
+			case <-seen:
+				rgoipc.Progress(ctx, 4, 4, "done")
+				return rgoipc.NewRecordBuilder().Add("result", []int32{1}).NewRecord()
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}, rgoipc.FunctionSignature{ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeInt32}})
+	serverURL, _ := startTestServer(t, registry,
+		rgoipc.WithProgressSocket(publisher),
+		rgoipc.WithProgressInterval(0))
+	sock := dialTestClient(t, serverURL)
+
+	// Topics hold the session ID, so that request 9 of another client goes
+	// elsewhere
+	ids, err := rgoipc.Column[float64](callBuiltin(t, sock, rgoipc.BuiltinSession, nil), "id")
+	if err != nil || ids[0] == 0 {
+		t.Fatalf("session ID: %v, %v", ids, err)
+	}
+	session := uint32(ids[0])
+	topic := rgoipc.CallProgressTopic(session, 9)
+	subscriber.SetOption(mangos.OptionSubscribe, []byte(topic+"\x00"))
+
+	replies := make(chan *rgoipc.RPCMessage, 1)
+	go func() {
+		replies <- roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "work", RequestID: 9})
+	}()
+
+	recv := func() *rgoipc.ProgressEvent {
+		t.Helper()
+		data, err := subscriber.Recv()
+		if err != nil {
+			t.Fatalf("progress: %v", err)
+		}
+		got, event, err := rgoipc.ParseProgressEvent(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != topic {
+			t.Errorf("topic = %q, want %q", got, topic)
+		}
+		return event
+	}
+	event := recv()
+	if event.Session != session || event.RequestID != 9 || event.Function != "work" || event.Done != 1 || event.Total != 4 ||
+		event.Fraction != 0.25 || event.Message != "working" {
+		t.Errorf("progress event: %+v", event)
+	}
+	close(seen)
+	for event.Fraction < 1 {
+		event = recv()
+	}
+	if event.Done != 4 || event.Message != "done" {
+		t.Errorf("final progress event: %+v", event)
+	}
+	if reply := <-replies; reply.Type != rgoipc.MsgTypeResult {
+		t.Errorf("call failed: %v", reply.Error)
+	}
+
+	// Outside of the server, reports are dropped
+	rgoipc.Progress(context.Background(), 1, 2, "")
+}
@@ -0,0 +1,100 @@
+package rgoipc
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/apache/arrow/go/v18/arrow"
+	"github.com/apache/arrow/go/v18/arrow/array"
+	"go.nanomsg.org/mangos/v3"
+)
+
+// Publisher pushes Arrow record batches to subscribers without a request,
+// for data that Go produces on its own: sensor readings, log lines, file
+// events. Each batch is sent on a PUB socket as its topic, a NUL byte and a
+// v2 MsgTypeEvent message whose name field is the topic, whose request ID
+// is the sequence number of the event within its topic (from 1) and whose
+// Arrow data is a complete IPC stream with the schema, so subscribers can
+// join at any time.
+//
+// SUB sockets filter on message prefixes: subscribing to "sensors/" gets
+// every topic under it, "sensors/temp\x00" only that topic.
+type Publisher struct {
+	sock mangos.Socket
+
+	mu  sync.Mutex
+	seq map[string]uint64 // last sequence number by topic
+}
+
+// NewPublisher publishes on sock, a PUB socket created and bound by the
+// caller
+func NewPublisher(sock mangos.Socket) *Publisher {
+	return &Publisher{sock: sock, seq: make(map[string]uint64)}
+}
+
+// Publish sends rec on topic. Subscribers that cannot keep up miss events
+// rather than block the publisher; gaps in the sequence numbers show them.
+func (p *Publisher) Publish(topic string, rec arrow.Record) error {
+	if err := checkTopic(topic); err != nil {
+		return err
+	}
+	data, err := WriteArrowRecord(rec)
+	if err != nil {
+		return fmt.Errorf("arrow write error: %w", err)
+	}
+
+	// Numbering and sending under the lock keeps each topic in order
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.seq[topic]++
+	msg := &RPCMessage{
+		Type:      MsgTypeEvent,
+		FuncName:  topic,
+		RequestID: p.seq[topic],
+		ArrowData: data,
+	}
+	return p.sock.Send(append([]byte(topic+"\x00"), msg.Marshal()...))
+}
+
+// PublishReader sends every batch of reader on topic, one event each
+func (p *Publisher) PublishReader(topic string, reader array.RecordReader) error {
+	for reader.Next() {
+		if err := p.Publish(topic, reader.Record()); err != nil {
+			return err
+		}
+	}
+	return reader.Err()
+}
+
+// Close closes the socket of the publisher
+func (p *Publisher) Close() error {
+	return p.sock.Close()
+}
+
+func checkTopic(topic string) error {
+	if topic == "" || strings.IndexByte(topic, 0) >= 0 {
+		return fmt.Errorf("invalid topic %q: topics are non-empty and have no NUL byte", topic)
+	}
+	return nil
+}
+
+// ParseEvent decodes a message received from a Publisher. The record is
+// read from msg.ArrowData, for instance with ReadArrowRecord, and
+// msg.RequestID is the sequence number of the event.
+func ParseEvent(data []byte) (topic string, msg *RPCMessage, err error) {
+	i := bytes.IndexByte(data, 0)
+	if i < 0 {
+		return "", nil, fmt.Errorf("%w: event without topic", ErrInvalidMessage)
+	}
+	topic = string(data[:i])
+	msg, err = UnmarshalRPCMessage(data[i+1:])
+	if err != nil {
+		return "", nil, err
+	}
+	if msg.Type != MsgTypeEvent || msg.FuncName != topic {
+		return "", nil, fmt.Errorf("%w: not an event of topic %s", ErrInvalidMessage, topic)
+	}
+	return topic, msg, nil
+}
@@ -0,0 +1,111 @@
+package rgoipc_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"mangoro.local/pkg/rgoipc"
+
+	"go.nanomsg.org/mangos/v3"
+	"go.nanomsg.org/mangos/v3/protocol/pub"
+	"go.nanomsg.org/mangos/v3/protocol/sub"
+)
+
+func TestPublisher(t *testing.T) {
+	url := fmt.Sprintf("inproc://rgoipc-publish-%d", inprocSeq.Add(1))
+	sock, err := pub.NewSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sock.Listen(url); err != nil {
+		t.Fatal(err)
+	}
+	publisher := rgoipc.NewPublisher(sock)
+	t.Cleanup(func() { publisher.Close() })
+
+	subscriber, err := sub.NewSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { subscriber.Close() })
+	subscriber.SetOption(mangos.OptionRecvDeadline, 5*time.Second)
+	subscriber.SetOption(mangos.OptionSubscribe, []byte("sensors/"))
+	if err := subscriber.Dial(url); err != nil {
+		t.Fatal(err)
+	}
+
+	tick := func(i int) {
+		t.Helper()
+		rec, err := rgoipc.NewRecordBuilder().Add("value", []float64{float64(i)}).NewRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rec.Release()
+		for _, topic := range []string{"logs/app", "sensors/temp"} {
+			if err := publisher.Publish(topic, rec); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Publish until the subscriber, which may connect late, gets events
+	received := make(chan []byte, 16)
+	go func() {
+		for {
+			data, err := subscriber.Recv()
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- data
+		}
+	}()
+	var last uint64
+	for i, events := 1, 0; events < 3; i++ {
+		tick(i)
+		select {
+		case data, ok := <-received:
+			if !ok {
+				t.Fatal("no events received")
+			}
+			topic, msg, err := rgoipc.ParseEvent(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if topic != "sensors/temp" {
+				t.Fatalf("received topic %q", topic)
+			}
+			if msg.RequestID <= last {
+				t.Errorf("sequence number %d after %d", msg.RequestID, last)
+			}
+			last = msg.RequestID
+			rec, err := rgoipc.ReadArrowRecord(msg.ArrowData)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if values, _ := rgoipc.Column[float64](rec, "value"); len(values) != 1 || values[0] != float64(msg.RequestID) {
+				t.Errorf("event %d: values %v", msg.RequestID, values)
+			}
+			rec.Release()
+			events++
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	rec, _ := rgoipc.NewRecordBuilder().Add("value", []float64{1}).NewRecord()
+	defer rec.Release()
+	for _, topic := range []string{"", "bad\x00topic"} {
+		if err := publisher.Publish(topic, rec); err == nil {
+			t.Errorf("published on topic %q", topic)
+		}
+	}
+	if _, _, err := rgoipc.ParseEvent([]byte("sensors/temp")); err == nil {
+		t.Error("parsed an event without a frame")
+	}
+	call := (&rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "sensors/temp"}).Marshal()
+	if _, _, err := rgoipc.ParseEvent(append([]byte("sensors/temp\x00"), call...)); err == nil || !strings.Contains(err.Error(), "not an event") {
+		t.Errorf("parsed a call as an event: %v", err)
+	}
+}
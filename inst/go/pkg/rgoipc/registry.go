@@ -3,6 +3,7 @@ package rgoipc
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 	"sync"
 
 	"github.com/apache/arrow/go/v18/arrow"
@@ -11,9 +12,11 @@ import (
 
 // Registry holds Go functions that can be called from R
 type Registry struct {
-	mu        sync.RWMutex
-	functions map[string]*RegisteredFunction
-	allocator memory.Allocator
+	mu         sync.RWMutex
+	functions  map[string]*RegisteredFunction
+	allocator  memory.Allocator
+	builtin    bool       // holds the server's built-in functions
+	authorizer Authorizer // see SetAuthorizer
 }
 
 // NewRegistry creates a new function registry
@@ -26,9 +29,23 @@ func NewRegistry() *Registry {
 
 // Register adds a function to the registry
 func (r *Registry) Register(name string, fn FunctionHandler, sig FunctionSignature) error {
+	return r.register(&RegisteredFunction{Name: name, Handler: fn, Signature: sig})
+}
+
+// RegisterContext adds a function whose handler receives the call context
+func (r *Registry) RegisterContext(name string, fn ContextHandler, sig FunctionSignature) error {
+	return r.register(&RegisteredFunction{Name: name, ContextHandler: fn, Signature: sig})
+}
+
+// register builds the schemas of fn and adds it
+func (r *Registry) register(fn *RegisteredFunction) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	name, sig := fn.Name, fn.Signature
+	if strings.HasPrefix(name, BuiltinPrefix) && !r.builtin {
+		return fmt.Errorf("function %s: names starting with %q are reserved for built-in functions", name, BuiltinPrefix)
+	}
 	if _, exists := r.functions[name]; exists {
 		return fmt.Errorf("function %s already registered", name)
 	}
@@ -43,13 +60,9 @@ func (r *Registry) Register(name string, fn FunctionHandler, sig FunctionSignatu
 		return fmt.Errorf("failed to build output schema: %w", err)
 	}
 
-	r.functions[name] = &RegisteredFunction{
-		Name:         name,
-		Handler:      fn,
-		InputSchema:  inputSchema,
-		OutputSchema: outputSchema,
-		Signature:    sig,
-	}
+	fn.InputSchema = inputSchema
+	fn.OutputSchema = outputSchema
+	r.functions[name] = fn
 
 	return nil
 }
@@ -73,14 +86,11 @@ func (r *Registry) List() []string {
 	return names
 }
 
-// Manifest returns function signatures as JSON for R discovery
+// Manifest returns the JSON manifest (see Manifest) for R discovery
 func (r *Registry) Manifest() ([]byte, error) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-
-	manifest := make(map[string]FunctionSignature)
-	for name, fn := range r.functions {
-		manifest[name] = fn.Signature
+	manifest, err := r.BuildManifest()
+	if err != nil {
+		return nil, err
 	}
 	return json.Marshal(manifest)
 }
@@ -96,14 +106,34 @@ func buildInputSchema(args []ArgSpec, alloc memory.Allocator) (*arrow.Schema, er
 		fields[i] = arrow.Field{
 			Name:     arg.Name,
 			Type:     dt,
-			Nullable: arg.Optional,
+			Nullable: arg.Optional || arg.Type.Nullable,
+			Metadata: typeMetadata(arg.Type),
 		}
 	}
 	return arrow.NewSchema(fields, nil), nil
 }
 
-// buildOutputSchema creates an Arrow schema for function return
+// buildOutputSchema creates an Arrow schema for function return: a single
+// "result" column, one column per field for TypeRecord, nil for TypeDynamic
 func buildOutputSchema(spec TypeSpec, alloc memory.Allocator) (*arrow.Schema, error) {
+	switch spec.Type {
+	case TypeDynamic:
+		return nil, nil
+	case TypeRecord:
+		if spec.StructDef == nil {
+			return nil, fmt.Errorf("record type requires definition")
+		}
+		fields := make([]arrow.Field, len(spec.StructDef.Fields))
+		for i, f := range spec.StructDef.Fields {
+			dt, err := arrowTypeToDataType(f.Type)
+			if err != nil {
+				return nil, fmt.Errorf("invalid type for column %s: %w", f.Name, err)
+			}
+			fields[i] = arrow.Field{Name: f.Name, Type: dt, Nullable: f.Type.Nullable, Metadata: typeMetadata(f.Type)}
+		}
+		return arrow.NewSchema(fields, nil), nil
+	}
+
 	dt, err := arrowTypeToDataType(spec)
 	if err != nil {
 		return nil, err
@@ -112,6 +142,7 @@ func buildOutputSchema(spec TypeSpec, alloc memory.Allocator) (*arrow.Schema, er
 		Name:     "result",
 		Type:     dt,
 		Nullable: spec.Nullable,
+		Metadata: typeMetadata(spec),
 	}
 	return arrow.NewSchema([]arrow.Field{field}, nil), nil
 }
@@ -127,11 +158,39 @@ func arrowTypeToDataType(spec TypeSpec) (arrow.DataType, error) {
 		return arrow.BinaryTypes.String, nil
 	case TypeBool:
 		return arrow.FixedWidthTypes.Boolean, nil
+	case TypeInt64:
+		return arrow.PrimitiveTypes.Int64, nil
+	case TypeDate32:
+		return arrow.FixedWidthTypes.Date32, nil
+	case TypeTimestamp:
+		return &arrow.TimestampType{Unit: spec.Unit, TimeZone: spec.TimeZone}, nil
+	case TypeDuration:
+		return &arrow.DurationType{Unit: spec.Unit}, nil
+	case TypeTime:
+		if spec.Unit == arrow.Second || spec.Unit == arrow.Millisecond {
+			return &arrow.Time32Type{Unit: spec.Unit}, nil
+		}
+		return &arrow.Time64Type{Unit: spec.Unit}, nil
+	case TypeDictionary:
+		return &arrow.DictionaryType{
+			IndexType: arrow.PrimitiveTypes.Int32,
+			ValueType: arrow.BinaryTypes.String,
+			Ordered:   spec.Ordered,
+		}, nil
+	case TypeBinary:
+		return arrow.BinaryTypes.Binary, nil
+	case TypeLargeString:
+		return arrow.BinaryTypes.LargeString, nil
 	case TypeList:
 		if spec.ListSchema != nil {
 			return arrow.ListOf(spec.ListSchema.Field(0).Type), nil
 		}
 		return nil, fmt.Errorf("list type requires schema")
+	case TypeFixedSizeList:
+		if spec.ListSchema == nil || spec.ListSize <= 0 {
+			return nil, fmt.Errorf("fixed-size list type requires schema and size")
+		}
+		return arrow.FixedSizeListOf(spec.ListSize, spec.ListSchema.Field(0).Type), nil
 	case TypeStruct:
 		if spec.StructDef != nil {
 			fields := make([]arrow.Field, len(spec.StructDef.Fields))
@@ -145,7 +204,23 @@ func arrowTypeToDataType(spec TypeSpec) (arrow.DataType, error) {
 			return arrow.StructOf(fields...), nil
 		}
 		return nil, fmt.Errorf("struct type requires definition")
+	case TypeRecord, TypeDynamic:
+		return nil, fmt.Errorf("%s is only valid as a return type", spec.Type)
 	default:
 		return nil, fmt.Errorf("unknown type: %s", spec.Type)
 	}
 }
+
+// levelsKey is the field metadata key holding the declared levels of a
+// dictionary type as a JSON array, since Arrow types cannot carry them
+const levelsKey = "rgoipc.levels"
+
+// typeMetadata returns the field metadata for declarations that Arrow types
+// cannot express
+func typeMetadata(spec TypeSpec) arrow.Metadata {
+	if spec.Type != TypeDictionary || len(spec.Levels) == 0 {
+		return arrow.Metadata{}
+	}
+	levels, _ := json.Marshal(spec.Levels)
+	return arrow.NewMetadata([]string{levelsKey}, []string{string(levels)})
+}
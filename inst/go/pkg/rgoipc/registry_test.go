@@ -1,6 +1,7 @@
 package rgoipc_test
 
 import (
+	"fmt"
 	"testing"
 
 	"mangoro.local/pkg/rgoipc"
@@ -100,3 +101,67 @@ func testAddHandler(input arrow.Record) (arrow.Record, error) {
 	schema := arrow.NewSchema([]arrow.Field{{Name: "result", Type: arrow.PrimitiveTypes.Float64}}, nil)
 	return array.NewRecord(schema, []arrow.Array{result}, int64(result.Len())), nil
 }
+
+func TestArrowTypes(t *testing.T) {
+	elem := arrow.NewSchema([]arrow.Field{{Name: "item", Type: arrow.PrimitiveTypes.Float64}}, nil)
+	tests := []struct {
+		spec rgoipc.TypeSpec
+		want string
+	}{
+		{rgoipc.TypeSpec{Type: rgoipc.TypeInt64}, "int64"},
+		{rgoipc.TypeSpec{Type: rgoipc.TypeDate32}, "date32"},
+		{rgoipc.TypeSpec{Type: rgoipc.TypeTimestamp, Unit: arrow.Microsecond, TimeZone: "Europe/Paris"}, "timestamp[us, tz=Europe/Paris]"},
+		{rgoipc.TypeSpec{Type: rgoipc.TypeDuration, Unit: arrow.Second}, "duration[s]"},
+		{rgoipc.TypeSpec{Type: rgoipc.TypeTime, Unit: arrow.Millisecond}, "time32[ms]"},
+		{rgoipc.TypeSpec{Type: rgoipc.TypeTime, Unit: arrow.Nanosecond}, "time64[ns]"},
+		{rgoipc.TypeSpec{Type: rgoipc.TypeDictionary, Levels: []string{"lo", "hi"}, Ordered: true}, "dictionary<values=utf8, indices=int32, ordered=true>"},
+		{rgoipc.TypeSpec{Type: rgoipc.TypeBinary}, "binary"},
+		{rgoipc.TypeSpec{Type: rgoipc.TypeLargeString}, "large_utf8"},
+		{rgoipc.TypeSpec{Type: rgoipc.TypeFixedSizeList, ListSchema: elem, ListSize: 3}, "fixed_size_list<item: float64, nullable>[3]"},
+	}
+
+	args := make([]rgoipc.ArgSpec, len(tests))
+	for i, tt := range tests {
+		args[i] = rgoipc.ArgSpec{Name: fmt.Sprintf("a%d", i), Type: tt.spec}
+	}
+	registry := rgoipc.NewRegistry()
+	if err := registry.Register("typed", testAddHandler, rgoipc.FunctionSignature{
+		Args:       args,
+		ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeDynamic},
+	}); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	fn, _ := registry.Get("typed")
+	for i, tt := range tests {
+		if got := fn.InputSchema.Field(i).Type.String(); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.spec.Type, got, tt.want)
+		}
+	}
+
+	// The manifest schemas keep the exact types and the declared levels
+	data, err := registry.Manifest()
+	if err != nil {
+		t.Fatalf("Manifest: %v", err)
+	}
+	m, err := rgoipc.ParseManifest(data)
+	if err != nil {
+		t.Fatalf("ParseManifest: %v", err)
+	}
+	schema, err := rgoipc.DecodeSchema(m.Functions[0].InputSchema)
+	if err != nil {
+		t.Fatalf("DecodeSchema: %v", err)
+	}
+	if !schema.Equal(fn.InputSchema) {
+		t.Errorf("manifest schema %s, want %s", schema, fn.InputSchema)
+	}
+	if levels := m.Functions[0].Args[6].Levels; len(levels) != 2 || levels[1] != "hi" {
+		t.Errorf("manifest levels: %v", levels)
+	}
+
+	if err := registry.Register("bad", testAddHandler, rgoipc.FunctionSignature{
+		Args: []rgoipc.ArgSpec{{Name: "v", Type: rgoipc.TypeSpec{Type: rgoipc.TypeFixedSizeList, ListSchema: elem}}},
+	}); err == nil {
+		t.Error("expected an error for a fixed-size list without a size")
+	}
+}
@@ -0,0 +1,191 @@
+package rgoipc
+
+import (
+	"fmt"
+
+	"github.com/apache/arrow/go/v18/arrow"
+	"github.com/apache/arrow/go/v18/arrow/array"
+)
+
+// RMetadataKey is the schema metadata key under which arrow-R stores the
+// R attributes that Arrow types cannot express (classes such as AsIs,
+// custom attributes, ...), as the ascii serialize() of
+// list(attributes = ..., columns = ...)
+const RMetadataKey = "r"
+
+// RMetadata is the content of the "r" schema metadata: the attributes of a
+// data frame and, recursively, of its columns. Attributes that arrow-R
+// derives from the Arrow types (names, row.names, and the class, levels and
+// tzone of factors, dates and times) are not stored.
+type RMetadata struct {
+	Attributes []RAttribute
+	Columns    []RColumn // in schema order; Meta is nil for plain columns
+}
+
+// RColumn is the R metadata of one column
+type RColumn struct {
+	Name string
+	Meta *RMetadata
+}
+
+// Attr returns the attribute name, or nil
+func (m *RMetadata) Attr(name string) *RValue {
+	return (&RValue{Attributes: m.Attributes}).Attr(name)
+}
+
+// SetAttr sets the attribute name; a nil value removes it
+func (m *RMetadata) SetAttr(name string, value *RValue) {
+	v := &RValue{Attributes: m.Attributes}
+	v.SetAttr(name, value)
+	m.Attributes = v.Attributes
+}
+
+// Class returns the class attribute
+func (m *RMetadata) Class() []string {
+	return m.Attr("class").StringValues()
+}
+
+// SetClass sets the class attribute; no classes remove it
+func (m *RMetadata) SetClass(classes ...string) {
+	if len(classes) == 0 {
+		m.SetAttr("class", nil)
+		return
+	}
+	m.SetAttr("class", RStrings(classes...))
+}
+
+// Column returns the metadata of column name, or nil
+func (m *RMetadata) Column(name string) *RMetadata {
+	if m == nil {
+		return nil
+	}
+	for _, c := range m.Columns {
+		if c.Name == name {
+			return c.Meta
+		}
+	}
+	return nil
+}
+
+// SetColumn sets the metadata of column name, adding the column if needed
+func (m *RMetadata) SetColumn(name string, meta *RMetadata) {
+	for i, c := range m.Columns {
+		if c.Name == name {
+			m.Columns[i].Meta = meta
+			return
+		}
+	}
+	m.Columns = append(m.Columns, RColumn{Name: name, Meta: meta})
+}
+
+// ReadRMetadata decodes the "r" metadata of schema. It returns nil when
+// the schema has none, e.g. when the client is not arrow-R.
+func ReadRMetadata(schema *arrow.Schema) (*RMetadata, error) {
+	md := schema.Metadata()
+	idx := md.FindKey(RMetadataKey)
+	if idx < 0 {
+		return nil, nil
+	}
+	v, err := DecodeRSerialized(md.Values()[idx])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidSchema, err)
+	}
+	return rMetadataFromValue(v)
+}
+
+// WithRMetadata returns schema with m stored as its "r" metadata; nil
+// removes it. Other metadata keys are kept.
+func WithRMetadata(schema *arrow.Schema, m *RMetadata) (*arrow.Schema, error) {
+	var keys, values []string
+	md := schema.Metadata()
+	for i, k := range md.Keys() {
+		if k != RMetadataKey {
+			keys = append(keys, k)
+			values = append(values, md.Values()[i])
+		}
+	}
+	if m != nil {
+		encoded, err := EncodeRSerialized(m.value())
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, RMetadataKey)
+		values = append(values, encoded)
+	}
+	newMD := arrow.NewMetadata(keys, values)
+	return arrow.NewSchema(schema.Fields(), &newMD), nil
+}
+
+// RecordWithRMetadata returns a record with the columns of rec and m as its
+// "r" metadata, so that arrow-R restores the attributes on the R side. The
+// caller releases both records.
+func RecordWithRMetadata(rec arrow.Record, m *RMetadata) (arrow.Record, error) {
+	schema, err := WithRMetadata(rec.Schema(), m)
+	if err != nil {
+		return nil, err
+	}
+	return array.NewRecord(schema, rec.Columns(), rec.NumRows()), nil
+}
+
+// value converts m to the list arrow-R serializes
+func (m *RMetadata) value() *RValue {
+	if m == nil {
+		return &RValue{}
+	}
+	attrs := &RValue{Kind: RList}
+	names := make([]string, len(m.Attributes))
+	for i, a := range m.Attributes {
+		names[i] = a.Name
+		attrs.List = append(attrs.List, a.Value)
+	}
+	attrs.SetAttr("names", RStrings(names...))
+
+	columns := &RValue{}
+	if len(m.Columns) > 0 {
+		cols := make([]*RValue, len(m.Columns))
+		colNames := make([]string, len(m.Columns))
+		for i, c := range m.Columns {
+			colNames[i] = c.Name
+			cols[i] = &RValue{}
+			if c.Meta != nil {
+				cols[i] = c.Meta.value()
+			}
+		}
+		columns = RNamedList(colNames, cols)
+	}
+	return RNamedList([]string{"attributes", "columns"}, []*RValue{attrs, columns})
+}
+
+func rMetadataFromValue(v *RValue) (*RMetadata, error) {
+	if v.Kind == RNull {
+		return nil, nil
+	}
+	if v.Kind != RList {
+		return nil, fmt.Errorf("%w: R metadata is not a list", ErrInvalidSchema)
+	}
+
+	m := &RMetadata{}
+	if attrs := v.Element("attributes"); attrs != nil && attrs.Kind == RList {
+		names := attrs.Names()
+		for i, a := range attrs.List {
+			if i < len(names) {
+				m.Attributes = append(m.Attributes, RAttribute{Name: names[i], Value: a})
+			}
+		}
+	}
+	if cols := v.Element("columns"); cols != nil && cols.Kind == RList {
+		names := cols.Names()
+		for i, c := range cols.List {
+			meta, err := rMetadataFromValue(c)
+			if err != nil {
+				return nil, err
+			}
+			name := ""
+			if i < len(names) {
+				name = names[i]
+			}
+			m.Columns = append(m.Columns, RColumn{Name: name, Meta: meta})
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,194 @@
+package rgoipc
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/apache/arrow/go/v18/arrow"
+)
+
+// serialize(list(attributes = list(class = "AsIs"), columns = NULL), NULL,
+// ascii = TRUE) from R 4.3.0
+const asIsMetadata = `A
+3
+262912
+197888
+5
+UTF-8
+531
+2
+531
+1
+16
+1
+262153
+4
+AsIs
+1026
+1
+262153
+5
+names
+16
+1
+262153
+5
+class
+254
+254
+1026
+511
+16
+2
+262153
+10
+attributes
+262153
+7
+columns
+254
+`
+
+func TestRSerialized(t *testing.T) {
+	v, err := DecodeRSerialized(asIsMetadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := v.Element("attributes").Element("class").StringValues(); len(got) != 1 || got[0] != "AsIs" {
+		t.Errorf("class = %v", got)
+	}
+	if v.Element("columns").Kind != RNull {
+		t.Errorf("columns should be NULL")
+	}
+	encoded, err := EncodeRSerialized(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded != asIsMetadata {
+		t.Errorf("re-encoded differently:\n%s", encoded)
+	}
+
+	// Values R writes specially
+	in := RNamedList([]string{"a b\n\"é\"", "d", "i"}, []*RValue{
+		{Kind: RString, Strings: []Optional[string]{Some("x y"), None[string]()}},
+		RDoubles(1.5, RNAReal, math.NaN(), math.Inf(-1), 1e-300),
+		RIntegers(RNAInteger, -2),
+	})
+	in.SetAttr("flag", RLogicals(true, false))
+	in.SetAttr("bytes", &RValue{Kind: RRaw, Raw: []byte{0, 0xff}})
+	encoded, err = EncodeRSerialized(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(encoded, `a\040b\n\"\303\251\"`) {
+		t.Errorf("string not escaped like R:\n%s", encoded)
+	}
+	out, err := DecodeRSerialized(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := out.Names(); got[0] != "a b\n\"é\"" {
+		t.Errorf("names = %q", got)
+	}
+	if s := out.List[0].Strings; s[0].Value != "x y" || s[1].Valid {
+		t.Errorf("strings = %v", s)
+	}
+	d := out.List[1].Doubles
+	if d[0] != 1.5 || !IsRNA(d[1]) || IsRNA(d[2]) || !math.IsNaN(d[2]) || !math.IsInf(d[3], -1) || d[4] != 1e-300 {
+		t.Errorf("doubles = %v", d)
+	}
+	if i := out.List[2].Ints; i[0] != RNAInteger || i[1] != -2 {
+		t.Errorf("ints = %v", i)
+	}
+	if b := out.Attr("bytes").Raw; len(b) != 2 || b[1] != 0xff {
+		t.Errorf("raw = %v", b)
+	}
+	if l := out.Attr("flag"); l.Kind != RLogical || l.Ints[0] != 1 {
+		t.Errorf("logical = %v", l)
+	}
+}
+
+func TestRSerializedAltrep(t *testing.T) {
+	// serialize(1:3, NULL, ascii = TRUE)
+	v, err := DecodeRSerialized("A\n3\n262912\n197888\n5\nUTF-8\n238\n2\n1\n262153\n14\ncompact_intseq\n" +
+		"2\n1\n262153\n4\nbase\n2\n13\n1\n13\n254\n14\n3\n3\n1\n1\n254\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Kind != RInteger || len(v.Ints) != 3 || v.Ints[2] != 3 {
+		t.Errorf("1:3 decoded as %+v", v)
+	}
+}
+
+func TestRSerializedRejectsCorruptInput(t *testing.T) {
+	header := "A\n3\n262912\n197888\n5\nUTF-8\n"
+	for name, body := range map[string]string{
+		"negative long length": "13\n-1\n-5\n0\n",
+		"unnamed attributes":   "525\n1\n5\n19\n1\n13\n1\n7\n",
+		"huge length":          "13\n2000000000\n1\n",
+		"deep nesting":         strings.Repeat("19\n1\n", 1000) + "254\n",
+		"huge ALTREP sequence": "238\n2\n1\n262153\n14\ncompact_intseq\n" +
+			"2\n1\n262153\n4\nbase\n2\n13\n1\n13\n254\n14\n3\n1e12\n1\n1\n254\n",
+	} {
+		if v, err := DecodeRSerialized(header + body); err == nil {
+			t.Errorf("%s: decoded as %+v", name, v)
+		}
+	}
+}
+
+func TestRMetadata(t *testing.T) {
+	m := &RMetadata{}
+	m.SetAttr("note", RStrings("from Go"))
+	col := &RMetadata{}
+	col.SetClass("AsIs")
+	m.SetColumn("plain", nil)
+	m.SetColumn("wrapped", col)
+
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "plain", Type: arrow.PrimitiveTypes.Float64},
+		{Name: "wrapped", Type: arrow.PrimitiveTypes.Float64},
+	}, nil)
+	withMeta, err := WithRMetadata(schema, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadRMetadata(withMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if note := got.Attr("note").StringValues(); len(note) != 1 || note[0] != "from Go" {
+		t.Errorf("note = %v", note)
+	}
+	if got.Column("plain") != nil {
+		t.Errorf("plain column should have no metadata")
+	}
+	if class := got.Column("wrapped").Class(); len(class) != 1 || class[0] != "AsIs" {
+		t.Errorf("wrapped class = %v", class)
+	}
+
+	if none, err := ReadRMetadata(schema); none != nil || err != nil {
+		t.Errorf("schema without metadata: %v, %v", none, err)
+	}
+	removed, err := WithRMetadata(withMeta, nil)
+	if err != nil || removed.HasMetadata() {
+		t.Errorf("metadata not removed: %v, %v", removed.Metadata(), err)
+	}
+
+	// Large metadata is compressed like arrow-R does
+	m.SetAttr("big", RStrings(strings.Repeat("x", 200000)))
+	withMeta, err = WithRMetadata(schema, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(withMeta.Metadata().Values()[0]); n > 100000 {
+		t.Errorf("metadata not compressed: %d bytes", n)
+	}
+	got, err = ReadRMetadata(withMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if big := got.Attr("big").StringValues(); len(big) != 1 || len(big[0]) != 200000 {
+		t.Errorf("compressed attribute not restored")
+	}
+}
@@ -0,0 +1,810 @@
+package rgoipc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// RKind is the type of an RValue
+type RKind uint8
+
+const (
+	RNull    RKind = iota // NULL
+	RLogical              // logical vector, in Ints
+	RInteger              // integer vector, in Ints
+	RDouble               // double vector, in Doubles
+	RString               // character vector, in Strings
+	RList                 // list, in List
+	RRaw                  // raw vector, in Raw
+)
+
+// RNAInteger is R's NA_integer_ (and NA for logical vectors)
+const RNAInteger int32 = math.MinInt32
+
+// RNAReal is R's NA_real_, a NaN with a payload distinguishing it from NaN
+var RNAReal = math.Float64frombits(0x7FF00000000007A2)
+
+// IsRNA reports whether x is R's NA_real_ rather than another NaN
+func IsRNA(x float64) bool {
+	return math.IsNaN(x) && math.Float64bits(x)&0xFFFFFFFF == 1954
+}
+
+// RValue is an R object as found in serialized R metadata: an atomic
+// vector or a list, with attributes. Other R types (functions,
+// environments, ...) are not supported.
+type RValue struct {
+	Kind       RKind
+	Ints       []int32            // RLogical (0, 1 or RNAInteger) and RInteger
+	Doubles    []float64          // RDouble
+	Strings    []Optional[string] // RString; invalid for NA_character_
+	List       []*RValue          // RList
+	Raw        []byte             // RRaw
+	Attributes []RAttribute       // in R order
+}
+
+// RAttribute is one named attribute of an RValue
+type RAttribute struct {
+	Name  string
+	Value *RValue
+}
+
+// RStrings returns a character vector
+func RStrings(values ...string) *RValue {
+	v := &RValue{Kind: RString, Strings: make([]Optional[string], len(values))}
+	for i, s := range values {
+		v.Strings[i] = Some(s)
+	}
+	return v
+}
+
+// RIntegers returns an integer vector
+func RIntegers(values ...int32) *RValue {
+	return &RValue{Kind: RInteger, Ints: values}
+}
+
+// RDoubles returns a double vector
+func RDoubles(values ...float64) *RValue {
+	return &RValue{Kind: RDouble, Doubles: values}
+}
+
+// RLogicals returns a logical vector
+func RLogicals(values ...bool) *RValue {
+	v := &RValue{Kind: RLogical, Ints: make([]int32, len(values))}
+	for i, b := range values {
+		if b {
+			v.Ints[i] = 1
+		}
+	}
+	return v
+}
+
+// RNamedList returns a list with a names attribute
+func RNamedList(names []string, values []*RValue) *RValue {
+	v := &RValue{Kind: RList, List: values}
+	if len(names) > 0 {
+		v.SetAttr("names", RStrings(names...))
+	}
+	return v
+}
+
+// Len returns the length of the vector as R's length() would
+func (v *RValue) Len() int {
+	switch v.Kind {
+	case RLogical, RInteger:
+		return len(v.Ints)
+	case RDouble:
+		return len(v.Doubles)
+	case RString:
+		return len(v.Strings)
+	case RList:
+		return len(v.List)
+	case RRaw:
+		return len(v.Raw)
+	default:
+		return 0
+	}
+}
+
+// Attr returns the attribute name, or nil
+func (v *RValue) Attr(name string) *RValue {
+	for _, a := range v.Attributes {
+		if a.Name == name {
+			return a.Value
+		}
+	}
+	return nil
+}
+
+// SetAttr sets the attribute name, keeping its position if it exists.
+// A nil value removes the attribute.
+func (v *RValue) SetAttr(name string, value *RValue) {
+	for i, a := range v.Attributes {
+		if a.Name == name {
+			if value == nil {
+				v.Attributes = append(v.Attributes[:i], v.Attributes[i+1:]...)
+			} else {
+				v.Attributes[i].Value = value
+			}
+			return
+		}
+	}
+	if value != nil {
+		v.Attributes = append(v.Attributes, RAttribute{Name: name, Value: value})
+	}
+}
+
+// StringValues returns the elements of a character vector, with "" for NA
+func (v *RValue) StringValues() []string {
+	if v == nil || v.Kind != RString {
+		return nil
+	}
+	out := make([]string, len(v.Strings))
+	for i, s := range v.Strings {
+		out[i] = s.Value
+	}
+	return out
+}
+
+// Names returns the names attribute
+func (v *RValue) Names() []string {
+	return v.Attr("names").StringValues()
+}
+
+// Element returns the list element called name, or nil
+func (v *RValue) Element(name string) *RValue {
+	if v.Kind != RList {
+		return nil
+	}
+	for i, n := range v.Names() {
+		if n == name && i < len(v.List) {
+			return v.List[i]
+		}
+	}
+	return nil
+}
+
+// SEXP types and flag bits of the R serialization format
+const (
+	sexpSym       = 1
+	sexpList      = 2
+	sexpChar      = 9
+	sexpLgl       = 10
+	sexpInt       = 13
+	sexpReal      = 14
+	sexpStr       = 16
+	sexpVec       = 19
+	sexpExpr      = 20
+	sexpRaw       = 24
+	sexpAltrep    = 238
+	sexpNilValue  = 254
+	sexpRef       = 255
+	flagObject    = 1 << 8
+	flagAttr      = 1 << 9
+	flagTag       = 1 << 10
+	charsetUTF8   = 1 << 3
+	charsetASCII  = 1 << 6
+	rVersion      = 4<<16 | 3<<8 // written as the serializing R version (4.3.0)
+	rMinVersion   = 3<<16 | 5<<8 // R 3.5.0, the first to read format 3
+	compressAbove = 100000       // arrow-R compresses larger metadata
+)
+
+// Bounds of the decoder, which reads metadata sent by clients
+const (
+	rMaxDepth        = 100      // nesting of lists and attributes
+	rMaxDecompressed = 64 << 20 // bytes of compressed metadata once inflated
+	rMaxCompact      = 1 << 20  // elements of ALTREP sequences, over the whole input
+)
+
+// DecodeRSerialized decodes the output of serialize(x, NULL, ascii = TRUE),
+// the format arrow-R uses for the "r" metadata key. A serialized raw vector
+// is taken to be zlib-compressed (memCompress(type = "gzip")) serialized
+// data, as arrow-R writes for large metadata, and is decoded in turn.
+//
+// The input may come from the network: vector lengths are checked against
+// the bytes left in it, and nesting, decompressed size and expanded ALTREP
+// sequences are bounded.
+func DecodeRSerialized(data string) (*RValue, error) {
+	v, err := decodeRSerialized(data)
+	if err != nil {
+		return nil, err
+	}
+	if v.Kind != RRaw {
+		return v, nil
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(v.Raw))
+	if err != nil {
+		return nil, fmt.Errorf("R metadata: decompress: %w", err)
+	}
+	defer zr.Close()
+	inner, err := io.ReadAll(io.LimitReader(zr, rMaxDecompressed+1))
+	if err != nil {
+		return nil, fmt.Errorf("R metadata: decompress: %w", err)
+	}
+	if len(inner) > rMaxDecompressed {
+		return nil, fmt.Errorf("R metadata: decompressed metadata exceeds %d bytes", rMaxDecompressed)
+	}
+	return decodeRSerialized(string(inner))
+}
+
+func decodeRSerialized(data string) (*RValue, error) {
+	r := &rReader{data: data}
+	if format := r.word(); format != "A" {
+		return nil, fmt.Errorf("R metadata: unsupported serialization format %q (only ascii)", format)
+	}
+	version := r.int()
+	r.int() // writer R version
+	r.int() // minimal reader R version
+	switch version {
+	case 2:
+	case 3:
+		r.string(int(r.int())) // native encoding
+	default:
+		return nil, fmt.Errorf("R metadata: unsupported serialization version %d", version)
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("R metadata: %w", r.err)
+	}
+
+	v, err := r.item()
+	if err != nil {
+		return nil, fmt.Errorf("R metadata: %w", err)
+	}
+	return v, nil
+}
+
+// EncodeRSerialized encodes v like serialize(v, NULL, ascii = TRUE) in R,
+// compressing large output like arrow-R does
+func EncodeRSerialized(v *RValue) (string, error) {
+	out, err := encodeRSerialized(v)
+	if err != nil || len(out) <= compressAbove {
+		return out, err
+	}
+
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write([]byte(out))
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	compressed, err := encodeRSerialized(&RValue{Kind: RRaw, Raw: buf.Bytes()})
+	if err != nil || len(compressed) >= len(out) {
+		return out, err
+	}
+	return compressed, nil
+}
+
+func encodeRSerialized(v *RValue) (string, error) {
+	w := &rWriter{symbols: make(map[string]int)}
+	w.buf.WriteString("A\n")
+	w.int(3)
+	w.int(rVersion)
+	w.int(rMinVersion)
+	w.int(5)
+	w.string("UTF-8")
+	if err := w.item(v); err != nil {
+		return "", err
+	}
+	return w.buf.String(), nil
+}
+
+// rReader reads the ascii serialization format. The first error sticks and
+// makes later reads return zero values.
+type rReader struct {
+	data    string
+	pos     int
+	refs    []string // symbols, for REFSXP
+	err     error
+	depth   int // items being read
+	compact int // elements of expanded ALTREP sequences
+}
+
+func (r *rReader) skipSpace() {
+	for r.pos < len(r.data) && strings.IndexByte(" \t\r\n", r.data[r.pos]) >= 0 {
+		r.pos++
+	}
+}
+
+func (r *rReader) word() string {
+	r.skipSpace()
+	start := r.pos
+	for r.pos < len(r.data) && strings.IndexByte(" \t\r\n", r.data[r.pos]) < 0 {
+		r.pos++
+	}
+	if start == r.pos && r.err == nil {
+		r.err = io.ErrUnexpectedEOF
+	}
+	return r.data[start:r.pos]
+}
+
+func (r *rReader) int() int32 {
+	w := r.word()
+	if r.err != nil {
+		return 0
+	}
+	if w == "NA" {
+		return RNAInteger
+	}
+	n, err := strconv.ParseInt(w, 10, 32)
+	if err != nil {
+		r.err = fmt.Errorf("bad integer %q", w)
+	}
+	return int32(n)
+}
+
+func (r *rReader) double() float64 {
+	w := r.word()
+	switch w {
+	case "NA":
+		return RNAReal
+	case "NaN":
+		return math.NaN()
+	case "Inf":
+		return math.Inf(1)
+	case "-Inf":
+		return math.Inf(-1)
+	}
+	if r.err != nil {
+		return 0
+	}
+	x, err := strconv.ParseFloat(w, 64)
+	if err != nil {
+		r.err = fmt.Errorf("bad double %q", w)
+	}
+	return x
+}
+
+// string reads n bytes of an escaped string (see OutStringAscii in R)
+func (r *rReader) string(n int) string {
+	r.skipSpace()
+	var b strings.Builder
+	for i := 0; i < n && r.err == nil; i++ {
+		if r.pos >= len(r.data) {
+			r.err = io.ErrUnexpectedEOF
+			break
+		}
+		c := r.data[r.pos]
+		r.pos++
+		if c != '\\' || r.pos >= len(r.data) {
+			b.WriteByte(c)
+			continue
+		}
+		c = r.data[r.pos]
+		r.pos++
+		switch c {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'v':
+			b.WriteByte('\v')
+		case 'b':
+			b.WriteByte('\b')
+		case 'r':
+			b.WriteByte('\r')
+		case 'f':
+			b.WriteByte('\f')
+		case 'a':
+			b.WriteByte('\a')
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			d := int(c - '0')
+			for j := 1; j < 3 && r.pos < len(r.data) && r.data[r.pos] >= '0' && r.data[r.pos] < '8'; j++ {
+				d = d*8 + int(r.data[r.pos]-'0')
+				r.pos++
+			}
+			b.WriteByte(byte(d))
+		default: // \\ \? \' \"
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// length reads a vector length. Every element takes at least two bytes
+// (a digit and a separator), so longer lengths than that are corrupt and
+// would only allocate.
+func (r *rReader) length() int {
+	n := r.int()
+	if r.err != nil {
+		return 0
+	}
+	switch {
+	case n == -1: // long vector: two more integers
+		r.err = fmt.Errorf("long vectors are not supported")
+	case n < 0:
+		r.err = fmt.Errorf("bad length %d", n)
+	case int(n) > (len(r.data)-r.pos+1)/2:
+		r.err = fmt.Errorf("length %d exceeds the %d bytes left", n, len(r.data)-r.pos)
+	default:
+		return int(n)
+	}
+	return 0
+}
+
+func (r *rReader) item() (*RValue, error) {
+	if r.depth >= rMaxDepth {
+		return nil, fmt.Errorf("nested deeper than %d levels", rMaxDepth)
+	}
+	r.depth++
+	defer func() { r.depth-- }()
+
+	flags := r.int()
+	if r.err != nil {
+		return nil, r.err
+	}
+	typ := flags & 0xFF
+	hasAttr := flags&flagAttr != 0
+
+	v := &RValue{}
+	switch typ {
+	case sexpNilValue:
+		return v, nil
+	case sexpLgl, sexpInt:
+		v.Kind = RInteger
+		if typ == sexpLgl {
+			v.Kind = RLogical
+		}
+		v.Ints = make([]int32, r.length())
+		for i := range v.Ints {
+			v.Ints[i] = r.int()
+		}
+	case sexpReal:
+		v.Kind = RDouble
+		v.Doubles = make([]float64, r.length())
+		for i := range v.Doubles {
+			v.Doubles[i] = r.double()
+		}
+	case sexpStr:
+		v.Kind = RString
+		v.Strings = make([]Optional[string], r.length())
+		for i := range v.Strings {
+			r.int() // CHARSXP flags
+			if n := r.int(); n >= 0 {
+				v.Strings[i] = Some(r.string(int(n)))
+			}
+		}
+	case sexpVec, sexpExpr:
+		v.Kind = RList
+		v.List = make([]*RValue, r.length())
+		for i := range v.List {
+			item, err := r.item()
+			if err != nil {
+				return nil, err
+			}
+			v.List[i] = item
+		}
+	case sexpRaw:
+		v.Kind = RRaw
+		v.Raw = make([]byte, r.length())
+		for i := range v.Raw {
+			b, err := strconv.ParseUint(r.word(), 16, 8)
+			if err != nil && r.err == nil {
+				r.err = fmt.Errorf("bad raw byte: %w", err)
+			}
+			v.Raw[i] = byte(b)
+		}
+	case sexpList:
+		return r.pairlist(flags)
+	case sexpSym, sexpRef: // only seen inside ALTREP class info
+		name, err := r.symbol(flags)
+		if err != nil {
+			return nil, err
+		}
+		return RStrings(name), nil
+	case sexpAltrep:
+		return r.altrep()
+	default:
+		return nil, fmt.Errorf("unsupported R object type %d", typ)
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	if hasAttr {
+		attrs, err := r.item()
+		if err != nil {
+			return nil, err
+		}
+		if v.Attributes, err = attrs.pairs(); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// pairlist reads a pairlist (attributes, mostly) as a named list
+func (r *rReader) pairlist(flags int32) (*RValue, error) {
+	v := &RValue{Kind: RList}
+	var names []string
+	for {
+		if flags&flagAttr != 0 {
+			if _, err := r.item(); err != nil {
+				return nil, err
+			}
+		}
+		name := ""
+		if flags&flagTag != 0 {
+			var err error
+			if name, err = r.symbol(r.int()); err != nil {
+				return nil, err
+			}
+		}
+		car, err := r.item()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		v.List = append(v.List, car)
+
+		flags = r.int()
+		if r.err != nil {
+			return nil, r.err
+		}
+		if flags&0xFF == sexpNilValue {
+			break
+		}
+		if flags&0xFF != sexpList {
+			return nil, fmt.Errorf("unsupported pairlist tail of type %d", flags&0xFF)
+		}
+	}
+	v.SetAttr("names", RStrings(names...))
+	return v, nil
+}
+
+// symbol reads a SYMSXP or a reference to one, given its flags
+func (r *rReader) symbol(flags int32) (string, error) {
+	switch flags & 0xFF {
+	case sexpSym:
+		r.int() // CHARSXP flags
+		name := r.string(int(r.int()))
+		r.refs = append(r.refs, name)
+		return name, r.err
+	case sexpRef:
+		idx := int(flags >> 8)
+		if idx < 1 || idx > len(r.refs) {
+			return "", fmt.Errorf("bad reference %d", idx)
+		}
+		return r.refs[idx-1], nil
+	default:
+		return "", fmt.Errorf("unsupported tag of type %d", flags&0xFF)
+	}
+}
+
+// altrep reads the ALTREP classes R uses for plain vectors: compact
+// integer/double sequences (e.g. 1:n) and wrappers
+func (r *rReader) altrep() (*RValue, error) {
+	info, err := r.item()
+	if err != nil {
+		return nil, err
+	}
+	state, err := r.item()
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := r.item()
+	if err != nil {
+		return nil, err
+	}
+
+	class := ""
+	if info.Kind == RList && len(info.List) > 0 && info.List[0].Kind == RString {
+		class = info.List[0].StringValues()[0]
+	}
+
+	var v *RValue
+	switch {
+	case (class == "compact_intseq" || class == "compact_realseq") && state.Kind == RDouble && len(state.Doubles) == 3:
+		length, start, step := state.Doubles[0], state.Doubles[1], state.Doubles[2]
+		if !(length >= 0 && length <= float64(rMaxCompact-r.compact)) {
+			return nil, fmt.Errorf("ALTREP sequence of length %v exceeds the limit of %d elements", length, rMaxCompact)
+		}
+		n := int(length)
+		r.compact += n
+		if class == "compact_intseq" {
+			v = &RValue{Kind: RInteger, Ints: make([]int32, n)}
+			for i := range v.Ints {
+				v.Ints[i] = int32(start + float64(i)*step)
+			}
+		} else {
+			v = &RValue{Kind: RDouble, Doubles: make([]float64, n)}
+			for i := range v.Doubles {
+				v.Doubles[i] = start + float64(i)*step
+			}
+		}
+	case strings.HasPrefix(class, "wrap_") && state.Kind == RList && len(state.List) > 0:
+		v = state.List[0]
+	default:
+		return nil, fmt.Errorf("unsupported ALTREP class %q", class)
+	}
+	if attrs.Kind == RList {
+		if v.Attributes, err = attrs.pairs(); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// pairs returns the elements of a pairlist read by rReader.pairlist. Other
+// objects in place of attributes are an error.
+func (v *RValue) pairs() ([]RAttribute, error) {
+	if v.Kind == RNull {
+		return nil, nil
+	}
+	names := v.Names()
+	if v.Kind != RList || len(names) != len(v.List) {
+		return nil, fmt.Errorf("attributes are not a pairlist")
+	}
+	out := make([]RAttribute, len(v.List))
+	for i, item := range v.List {
+		out[i] = RAttribute{Name: names[i], Value: item}
+	}
+	return out, nil
+}
+
+// rWriter writes the ascii serialization format
+type rWriter struct {
+	buf     bytes.Buffer
+	symbols map[string]int // reference index of written symbols
+}
+
+func (w *rWriter) int(n int32) {
+	if n == RNAInteger {
+		w.buf.WriteString("NA\n")
+		return
+	}
+	w.buf.WriteString(strconv.FormatInt(int64(n), 10))
+	w.buf.WriteByte('\n')
+}
+
+func (w *rWriter) double(x float64) {
+	switch {
+	case IsRNA(x):
+		w.buf.WriteString("NA\n")
+	case math.IsNaN(x):
+		w.buf.WriteString("NaN\n")
+	case math.IsInf(x, 1):
+		w.buf.WriteString("Inf\n")
+	case math.IsInf(x, -1):
+		w.buf.WriteString("-Inf\n")
+	default:
+		w.buf.WriteString(strconv.FormatFloat(x, 'g', 16, 64))
+		w.buf.WriteByte('\n')
+	}
+}
+
+// string writes s escaped like OutStringAscii in R
+func (w *rWriter) string(s string) {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\n':
+			w.buf.WriteString(`\n`)
+		case '\t':
+			w.buf.WriteString(`\t`)
+		case '\v':
+			w.buf.WriteString(`\v`)
+		case '\b':
+			w.buf.WriteString(`\b`)
+		case '\r':
+			w.buf.WriteString(`\r`)
+		case '\f':
+			w.buf.WriteString(`\f`)
+		case '\a':
+			w.buf.WriteString(`\a`)
+		case '\\', '?', '\'', '"':
+			w.buf.WriteByte('\\')
+			w.buf.WriteByte(c)
+		default:
+			if c <= 32 || c > 126 {
+				fmt.Fprintf(&w.buf, `\%03o`, c)
+			} else {
+				w.buf.WriteByte(c)
+			}
+		}
+	}
+	w.buf.WriteByte('\n')
+}
+
+func (w *rWriter) charsxp(s string) {
+	level := int32(charsetASCII)
+	for i := 0; i < len(s); i++ {
+		if s[i] > 127 {
+			level = charsetUTF8
+			break
+		}
+	}
+	w.int(sexpChar | level<<12)
+	w.int(int32(len(s)))
+	w.string(s)
+}
+
+func (w *rWriter) item(v *RValue) error {
+	if v == nil || v.Kind == RNull {
+		w.int(sexpNilValue)
+		return nil
+	}
+
+	var typ int32
+	switch v.Kind {
+	case RLogical:
+		typ = sexpLgl
+	case RInteger:
+		typ = sexpInt
+	case RDouble:
+		typ = sexpReal
+	case RString:
+		typ = sexpStr
+	case RList:
+		typ = sexpVec
+	case RRaw:
+		typ = sexpRaw
+	default:
+		return fmt.Errorf("unsupported R value kind %d", v.Kind)
+	}
+	flags := typ
+	if len(v.Attributes) > 0 {
+		flags |= flagAttr
+	}
+	if v.Attr("class") != nil {
+		flags |= flagObject
+	}
+	w.int(flags)
+	w.int(int32(v.Len()))
+
+	switch v.Kind {
+	case RLogical, RInteger:
+		for _, n := range v.Ints {
+			w.int(n)
+		}
+	case RDouble:
+		for _, x := range v.Doubles {
+			w.double(x)
+		}
+	case RString:
+		for _, s := range v.Strings {
+			if !s.Valid {
+				w.int(sexpChar)
+				w.int(-1)
+				continue
+			}
+			w.charsxp(s.Value)
+		}
+	case RList:
+		for _, item := range v.List {
+			if err := w.item(item); err != nil {
+				return err
+			}
+		}
+	case RRaw:
+		for _, b := range v.Raw {
+			fmt.Fprintf(&w.buf, "%02x\n", b)
+		}
+	}
+
+	if len(v.Attributes) == 0 {
+		return nil
+	}
+	for _, a := range v.Attributes {
+		w.int(sexpList | flagTag)
+		w.symbol(a.Name)
+		if err := w.item(a.Value); err != nil {
+			return err
+		}
+	}
+	w.int(sexpNilValue)
+	return nil
+}
+
+func (w *rWriter) symbol(name string) {
+	if idx, ok := w.symbols[name]; ok {
+		w.int(int32(idx<<8 | sexpRef))
+		return
+	}
+	w.symbols[name] = len(w.symbols) + 1
+	w.int(sexpSym)
+	w.charsxp(name)
+}
@@ -0,0 +1,606 @@
+package rgoipc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"go.nanomsg.org/mangos/v3"
+)
+
+// ErrServerClosed is returned by Server.Serve after Shutdown has been called
+// or the Serve context has been cancelled
+var ErrServerClosed = errors.New("rgoipc: server closed")
+
+// Server answers manifest and call requests for the functions of a Registry
+// on a mangos REP socket. The socket is created and bound by the caller, so
+// the server does not care which transport it listens on.
+//
+// Requests are processed by a fixed pool of workers. On a raw (xrep)
+// socket a single receiver hands messages to the pool and every reply is
+// sent with the backtrace header of its request. On a cooked REP socket each
+// worker owns a REP context instead, which gives the same routing guarantee.
+type Server struct {
+	registry     *Registry
+	builtins     *Registry // see BuiltinPrefix
+	started      time.Time
+	sock         mangos.Socket
+	logger       *log.Logger
+	workers      int
+	validation   ValidationMode
+	streamIdle   time.Duration
+	jobRetention time.Duration
+	maxJobs      int
+	maxFinished  int
+
+	progressSock     mangos.Socket // PUB socket for progress events, or nil
+	progressInterval time.Duration
+	handles          *HandleStore // nil unless WithHandles
+	onConnect        func(*Session)
+	onDisconnect     func(*Session)
+	pipeHook         mangos.PipeEventHook // installed before the server's
+	audit            *log.Logger          // denied calls; nil logs to logger
+	shutdownBuiltin  bool                 // see WithShutdownBuiltin
+	limits           Limits
+
+	// ctx is the parent of every call context; it is cancelled when the
+	// server closes
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	mu          sync.Mutex
+	closing     bool
+	inflight    sync.WaitGroup
+	streams     map[string]*resultStream
+	calls       map[callKey][]*activeCall // for MsgTypeCancel
+	jobs        map[string]*job
+	runningJobs int
+	sessions    map[uint32]*Session // by pipe ID
+}
+
+// activeCall is a call in progress that MsgTypeCancel can reach
+type activeCall struct {
+	cancel context.CancelCauseFunc
+}
+
+// callKey identifies the calls of one client with one request ID: request
+// IDs are chosen by clients, so they only mean something within a session
+type callKey struct {
+	session uint32 // Session.ID, 0 without a session
+	request uint64
+}
+
+// callKeyOf returns the key of the calls with the request ID of msg made
+// by the session of ctx
+func callKeyOf(ctx context.Context, msg *RPCMessage) callKey {
+	return callKey{session: ownerOf(ctx, msg).session, request: msg.RequestID}
+}
+
+// owner identifies the client that started a job or stream
+type owner struct {
+	session   uint32 // Session.ID, 0 without a session
+	principal string // see principalOf
+}
+
+// ownerOf returns the client making the request msg with context ctx
+func ownerOf(ctx context.Context, msg *RPCMessage) owner {
+	o := owner{principal: principalOf(ctx, msg)}
+	if sess := SessionFrom(ctx); sess != nil {
+		o.session = sess.ID
+	}
+	return o
+}
+
+// matches reports whether caller may reach what o started: the same
+// principal from any session, or the same session for anonymous clients
+func (o owner) matches(caller owner) bool {
+	if o.principal != caller.principal {
+		return false
+	}
+	return o.principal != "" || o.session == caller.session
+}
+
+// ServerOption configures a Server
+type ServerOption func(*Server)
+
+// WithLogger sets the logger used for transport and decoding errors.
+// The default logs to stderr.
+func WithLogger(logger *log.Logger) ServerOption {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+// WithWorkers sets how many requests are processed at once.
+// The default is runtime.NumCPU(); values below 1 are treated as 1.
+func WithWorkers(n int) ServerOption {
+	return func(s *Server) {
+		s.workers = max(n, 1)
+	}
+}
+
+// WithStreamIdleTimeout sets how long a streamed result waits for the
+// client to pull its next chunk before it is dropped and its handler
+// cancelled. The default is one minute.
+func WithStreamIdleTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.streamIdle = d
+	}
+}
+
+// NewServer creates a server for registry on sock. Create it before sock
+// listens or dials: clients that connected earlier have no session.
+func NewServer(registry *Registry, sock mangos.Socket, opts ...ServerOption) *Server {
+	s := &Server{
+		registry:         registry,
+		started:          time.Now(),
+		sock:             sock,
+		logger:           log.New(os.Stderr, "[rgoipc] ", log.LstdFlags),
+		workers:          runtime.NumCPU(),
+		streamIdle:       time.Minute,
+		jobRetention:     10 * time.Minute,
+		maxJobs:          64,
+		maxFinished:      256,
+		progressInterval: 100 * time.Millisecond,
+		streams:          make(map[string]*resultStream),
+		calls:            make(map[callKey][]*activeCall),
+		jobs:             make(map[string]*job),
+		sessions:         make(map[uint32]*Session),
+	}
+	s.ctx, s.cancel = context.WithCancelCause(context.Background())
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.builtins = newBuiltins(s)
+	s.applyLimits()
+	s.pipeHook = sock.SetPipeEventHook(s.pipeEvent)
+	return s
+}
+
+// Serve receives requests and sends replies until ctx is cancelled or
+// Shutdown is called, in which case it returns ErrServerClosed. The socket
+// is closed when Serve returns.
+func (s *Server) Serve(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() {
+		s.close()
+	})
+	defer stop()
+	defer s.close()
+
+	if raw, _ := s.sock.GetOption(mangos.OptionRaw); raw == true {
+		return s.serveRaw()
+	}
+	return s.serveContexts()
+}
+
+// serveRaw reads from a raw socket and dispatches onto the worker pool.
+// The queue is as deep as the pool, so a slow pool stalls the receiver
+// rather than buffering an unbounded number of requests.
+func (s *Server) serveRaw() error {
+	queue := make(chan *mangos.Message, s.workers)
+	var wg sync.WaitGroup
+	for i := 0; i < s.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for m := range queue {
+				s.serveMessage(s.sock, m)
+			}
+		}()
+	}
+	defer wg.Wait()
+	defer close(queue)
+
+	for {
+		m, err := s.sock.RecvMsg()
+		if err != nil {
+			if err = s.recvError(err); err != nil {
+				return err
+			}
+			continue
+		}
+		queue <- m
+	}
+}
+
+// serveContexts runs one receive loop per REP context
+func (s *Server) serveContexts() error {
+	errc := make(chan error, s.workers)
+	for i := 0; i < s.workers; i++ {
+		c, err := s.sock.OpenContext()
+		if err != nil {
+			s.close()
+			return fmt.Errorf("rgoipc: open context: %w", err)
+		}
+		go func() {
+			errc <- s.serveContext(c)
+		}()
+	}
+
+	result := ErrServerClosed
+	for i := 0; i < s.workers; i++ {
+		if err := <-errc; err != ErrServerClosed {
+			result = err
+		}
+		// One failed worker takes the others down with it
+		s.close()
+	}
+	return result
+}
+
+func (s *Server) serveContext(c mangos.Context) error {
+	defer c.Close()
+	for {
+		m, err := c.RecvMsg()
+		if err != nil {
+			if err = s.recvError(err); err != nil {
+				return err
+			}
+			continue
+		}
+		s.serveMessage(c, m)
+	}
+}
+
+// recvError classifies a receive error: nil means log and keep going
+func (s *Server) recvError(err error) error {
+	if s.isClosing() {
+		return ErrServerClosed
+	}
+	if errors.Is(err, mangos.ErrClosed) {
+		return err
+	}
+	s.logger.Printf("receive error: %s", err)
+	return nil
+}
+
+// replySender is the part of mangos.Socket and mangos.Context used to reply
+type replySender interface {
+	SendMsg(*mangos.Message) error
+}
+
+// serveMessage handles one request and sends the reply with the request's
+// header, which holds the REP backtrace on raw sockets
+func (s *Server) serveMessage(out replySender, m *mangos.Message) {
+	if !s.begin() {
+		m.Free()
+		return
+	}
+	defer s.inflight.Done()
+
+	ctx := s.ctx
+	if sess := s.session(m.Pipe); sess != nil {
+		ctx = context.WithValue(ctx, sessionKey{}, sess)
+	}
+	hold := &workerHold{}
+	ctx = context.WithValue(ctx, workerHoldKey{}, hold)
+	reply := s.handle(ctx, m.Body)
+
+	r := mangos.NewMessage(0)
+	r.Header = append(r.Header, m.Header...)
+	r.Body = reply.Marshal()
+	m.Free()
+
+	if err := out.SendMsg(r); err != nil && !s.isClosing() {
+		s.logger.Printf("send error: %s", err)
+	}
+	// Handlers abandoned at their deadline keep the worker until they
+	// return, so that the pool bounds the handlers running
+	hold.wait()
+	if shutdownAfter(reply) {
+		// The REP socket has no linger: give the pipe time to write the
+		// reply before closing it
+		time.AfterFunc(shutdownGrace, s.close)
+	}
+}
+
+// Shutdown stops the server and closes its socket, then waits for the
+// requests being processed to finish or for ctx to expire
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.close()
+
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Server) close() {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return
+	}
+	s.closing = true
+	s.sock.Close()
+	if s.progressSock != nil {
+		s.progressSock.Close()
+	}
+	cause := fmt.Errorf("%w: server shutting down", ErrCancelled)
+	s.cancel(cause)
+	ids := make([]string, 0, len(s.streams))
+	for id := range s.streams {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+
+	for _, id := range ids {
+		s.dropStream(id, cause)
+	}
+}
+
+// begin registers an in-flight request unless the server is shutting down
+func (s *Server) begin() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.inflight.Add(1)
+	return true
+}
+
+func (s *Server) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// handle answers one request. ctx is the server's context with the
+// session of the client.
+func (s *Server) handle(ctx context.Context, msgBytes []byte) *RPCMessage {
+	// Oversized requests are refused before decoding; the reply only needs
+	// the version and request ID from the header
+	if err := s.limits.checkMessage(len(msgBytes)); err != nil {
+		reply := errorMessage("", err)
+		if !IsV2Message(msgBytes) {
+			reply.Version = ProtocolV1
+		} else if len(msgBytes) >= v2HeaderSize {
+			reply.RequestID = binary.BigEndian.Uint64(msgBytes[8:16])
+		}
+		return reply
+	}
+
+	msg, err := UnmarshalRPCMessage(msgBytes)
+	if err != nil {
+		s.logger.Printf("unmarshal error: %s", err)
+		reply := errorMessage("", err)
+		if !IsV2Message(msgBytes) {
+			reply.Version = ProtocolV1
+		}
+		return reply
+	}
+
+	reply := s.dispatch(ctx, msg)
+	reply.Version = msg.Version
+	reply.RequestID = msg.RequestID
+	return reply
+}
+
+func (s *Server) dispatch(ctx context.Context, msg *RPCMessage) *RPCMessage {
+	// The other messages are authorized against their function once the
+	// handler has found it
+	switch msg.Type {
+	case MsgTypeManifest, MsgTypeJobList, MsgTypeHandleList, MsgTypeHandleRelease:
+		if err := s.authorize(ctx, msg, nil); err != nil {
+			return errorMessage(msg.FuncName, err)
+		}
+	}
+
+	switch msg.Type {
+	case MsgTypeManifest:
+		return s.handleManifest()
+	case MsgTypeCall:
+		return s.handleCall(ctx, msg)
+	case MsgTypeStreamNext:
+		return s.handleStreamNext(ctx, msg)
+	case MsgTypeCancel:
+		return s.handleCancel(ctx, msg)
+	case MsgTypeSubmit:
+		return s.handleSubmit(ctx, msg)
+	case MsgTypeJobStatus:
+		return s.handleJobStatus(ctx, msg)
+	case MsgTypeJobResult:
+		return s.handleJobResult(ctx, msg)
+	case MsgTypeJobCancel:
+		return s.handleJobCancel(ctx, msg)
+	case MsgTypeJobList:
+		return s.handleJobList(ctx, msg)
+	case MsgTypeHandleList:
+		return s.handleHandleList(ctx)
+	case MsgTypeHandleRelease:
+		return s.handleHandleRelease(ctx, msg)
+	default:
+		return errorMessage("", fmt.Errorf("%w: unknown message type %d", ErrInvalidMessage, msg.Type))
+	}
+}
+
+func (s *Server) handleManifest() *RPCMessage {
+	manifest, err := s.registry.Manifest()
+	if err != nil {
+		return errorMessage("", fmt.Errorf("manifest error: %w", err))
+	}
+	return &RPCMessage{
+		Type:      MsgTypeManifest,
+		ArrowData: manifest,
+	}
+}
+
+func (s *Server) handleCall(ctx context.Context, msg *RPCMessage) *RPCMessage {
+	fn, ok := s.function(msg.FuncName)
+	if !ok {
+		return errorMessage(msg.FuncName, fmt.Errorf("%w: %s", ErrFunctionNotFound, msg.FuncName))
+	}
+	if err := s.authorize(ctx, msg, fn); err != nil {
+		return errorMessage(msg.FuncName, err)
+	}
+	ctx, done := s.callContext(ctx, msg, fn)
+	defer done()
+
+	if fn.streaming() {
+		run, err := s.prepareRun(msg, fn)
+		if err != nil {
+			return errorMessage(msg.FuncName, err)
+		}
+		return s.handleStreamCall(ctx, msg, fn, run)
+	}
+
+	mem := s.limits.allocator()
+	ctx = withAllocator(ctx, mem)
+	input, err := s.readInput(msg.ArrowData, mem)
+	if err != nil {
+		return errorMessage(msg.FuncName, err)
+	}
+	defer input.Release()
+
+	if s.validation&ValidateInput != 0 {
+		validated, err := fn.validateInput(input, mem)
+		if err != nil {
+			return errorMessage(msg.FuncName, err)
+		}
+		defer validated.Release()
+		input = validated
+	}
+
+	result, err := fn.CallContext(ctx, input)
+	if err != nil {
+		if ctx.Err() != nil {
+			return errorMessage(msg.FuncName, contextError(ctx))
+		}
+		if errors.Is(err, ErrHandlerPanic) {
+			s.logger.Printf("recovered %s", err)
+		}
+		return errorMessage(msg.FuncName, fmt.Errorf("%w: %w", ErrExecutionFailed, err))
+	}
+	defer result.Release()
+
+	if s.validation&ValidateOutput != 0 {
+		if err := fn.ValidateOutput(result); err != nil {
+			s.logger.Printf("contract violation: %s", err)
+			return errorMessage(msg.FuncName, err)
+		}
+	}
+
+	data, err := WriteArrowRecord(result)
+	if err != nil {
+		return errorMessage(msg.FuncName, fmt.Errorf("arrow write error: %w", err))
+	}
+
+	return &RPCMessage{
+		Type:      MsgTypeResult,
+		FuncName:  msg.FuncName,
+		ArrowData: data,
+	}
+}
+
+// callContext returns the context of a call. It ends at the earlier of the
+// function's Timeout and the client's deadline, or when MsgTypeCancel
+// cancels it by request ID. It carries the call's progress reporter. done
+// must be called when the call returns.
+func (s *Server) callContext(parent context.Context, msg *RPCMessage, fn *RegisteredFunction) (ctx context.Context, done func()) {
+	ctx, cancel := context.WithCancelCause(parent)
+	stop := func() {}
+	if timeout := callTimeout(msg, fn); timeout > 0 {
+		var stopTimeout context.CancelFunc
+		ctx, stopTimeout = context.WithTimeoutCause(ctx, timeout, fmt.Errorf("%w after %s", ErrDeadlineExceeded, timeout))
+		stop = stopTimeout
+	}
+	ctx = s.withProgress(ctx, ProgressEvent{RequestID: msg.RequestID, Function: fn.Name}, nil)
+	if msg.RequestID == 0 {
+		return ctx, func() {
+			stop()
+			cancel(nil)
+		}
+	}
+
+	call := &activeCall{cancel: cancel}
+	key := callKeyOf(parent, msg)
+	s.mu.Lock()
+	s.calls[key] = append(s.calls[key], call)
+	s.mu.Unlock()
+	return ctx, func() {
+		s.mu.Lock()
+		calls := s.calls[key]
+		for i, c := range calls {
+			if c == call {
+				calls = append(calls[:i], calls[i+1:]...)
+				break
+			}
+		}
+		if len(calls) == 0 {
+			delete(s.calls, key)
+		} else {
+			s.calls[key] = calls
+		}
+		s.mu.Unlock()
+		stop()
+		cancel(nil)
+	}
+}
+
+// callTimeout is the shorter of the function's Timeout and the client's
+// deadline, zero if neither is set
+func callTimeout(msg *RPCMessage, fn *RegisteredFunction) time.Duration {
+	timeout := fn.Signature.Timeout
+	if msg.Timeout > 0 && (timeout == 0 || msg.Timeout < timeout) {
+		timeout = msg.Timeout
+	}
+	return timeout
+}
+
+// handleCancel cancels the calls in progress with the request ID of msg
+// from the same client, or the streamed result whose stream ID is in the
+// name field
+func (s *Server) handleCancel(ctx context.Context, msg *RPCMessage) *RPCMessage {
+	cause := fmt.Errorf("%w by the client", ErrCancelled)
+	if msg.FuncName != "" {
+		st, err := s.stream(ctx, msg)
+		if err != nil {
+			return errorMessage(msg.FuncName, err)
+		}
+		if !s.dropStream(st.id, cause) {
+			return errorMessage(msg.FuncName, fmt.Errorf("%w: unknown or expired stream %s", ErrInvalidMessage, msg.FuncName))
+		}
+		return &RPCMessage{Type: MsgTypeCancel, FuncName: msg.FuncName}
+	}
+	if err := s.authorize(ctx, msg, nil); err != nil {
+		return errorMessage("", err)
+	}
+
+	s.mu.Lock()
+	calls := append([]*activeCall(nil), s.calls[callKeyOf(ctx, msg)]...)
+	s.mu.Unlock()
+	if len(calls) == 0 {
+		return errorMessage("", fmt.Errorf("%w: no call in progress with request ID %d", ErrInvalidMessage, msg.RequestID))
+	}
+	for _, c := range calls {
+		c.cancel(cause)
+	}
+	return &RPCMessage{Type: MsgTypeCancel}
+}
+
+// errorMessage builds an error reply carrying both the structured error
+// and its plain-text message for v1 clients
+func errorMessage(funcName string, err error) *RPCMessage {
+	rpcErr := AsRPCError(err)
+	return &RPCMessage{
+		Type:     MsgTypeError,
+		FuncName: funcName,
+		ErrorMsg: rpcErr.Message,
+		Error:    rpcErr,
+	}
+}
@@ -0,0 +1,463 @@
+package rgoipc_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"mangoro.local/pkg/rgoipc"
+
+	"github.com/apache/arrow/go/v18/arrow"
+	"github.com/apache/arrow/go/v18/arrow/array"
+	"github.com/apache/arrow/go/v18/arrow/memory"
+	"go.nanomsg.org/mangos/v3"
+	"go.nanomsg.org/mangos/v3/protocol/rep"
+	"go.nanomsg.org/mangos/v3/protocol/req"
+	"go.nanomsg.org/mangos/v3/protocol/xrep"
+	_ "go.nanomsg.org/mangos/v3/transport/inproc"
+)
+
+var inprocSeq atomic.Int64
+
+// startTestServer serves registry on a fresh inproc address and returns
+// the address
+func startTestServer(t *testing.T, registry *rgoipc.Registry, opts ...rgoipc.ServerOption) (string, *rgoipc.Server) {
+	t.Helper()
+	return startTestServerOn(t, rep.NewSocket, registry, opts...)
+}
+
+// startTestServerOn is startTestServer on a socket made by newSocket
+func startTestServerOn(t *testing.T, newSocket func() (mangos.Socket, error), registry *rgoipc.Registry, opts ...rgoipc.ServerOption) (string, *rgoipc.Server) {
+	t.Helper()
+
+	url := fmt.Sprintf("inproc://rgoipc-test-%d", inprocSeq.Add(1))
+	sock, err := newSocket()
+	if err != nil {
+		t.Fatalf("socket: %v", err)
+	}
+	if err := sock.Listen(url); err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	server := rgoipc.NewServer(registry, sock, opts...)
+	errc := make(chan error, 1)
+	go func() { errc <- server.Serve(context.Background()) }()
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+		if err := <-errc; err != rgoipc.ErrServerClosed {
+			t.Errorf("Serve returned %v, want ErrServerClosed", err)
+		}
+	})
+	return url, server
+}
+
+func dialTestClient(t *testing.T, url string) mangos.Socket {
+	t.Helper()
+
+	sock, err := req.NewSocket()
+	if err != nil {
+		t.Fatalf("req socket: %v", err)
+	}
+	if err := sock.Dial(url); err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	sock.SetOption(mangos.OptionRecvDeadline, 5*time.Second)
+	t.Cleanup(func() { sock.Close() })
+	return sock
+}
+
+// requester is the part of mangos.Socket and mangos.Context that roundTrip
+// uses
+type requester interface {
+	Send([]byte) error
+	Recv() ([]byte, error)
+}
+
+func roundTrip(t *testing.T, sock requester, msg *rgoipc.RPCMessage) *rgoipc.RPCMessage {
+	t.Helper()
+
+	if err := sock.Send(msg.Marshal()); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	data, err := sock.Recv()
+	if err != nil {
+		t.Fatalf("recv: %v", err)
+	}
+	reply, err := rgoipc.UnmarshalRPCMessage(data)
+	if err != nil {
+		t.Fatalf("unmarshal reply: %v", err)
+	}
+	return reply
+}
+
+func float64Record(t *testing.T, names []string, cols ...[]float64) []byte {
+	t.Helper()
+
+	pool := memory.NewGoAllocator()
+	fields := make([]arrow.Field, len(cols))
+	arrays := make([]arrow.Array, len(cols))
+	for i, col := range cols {
+		b := array.NewFloat64Builder(pool)
+		b.AppendValues(col, nil)
+		arrays[i] = b.NewArray()
+		b.Release()
+		defer arrays[i].Release()
+		fields[i] = arrow.Field{Name: names[i], Type: arrow.PrimitiveTypes.Float64}
+	}
+	nrows := int64(0)
+	if len(cols) > 0 {
+		nrows = int64(len(cols[0]))
+	}
+	rec := array.NewRecord(arrow.NewSchema(fields, nil), arrays, nrows)
+	defer rec.Release()
+
+	data, err := rgoipc.WriteArrowRecord(rec)
+	if err != nil {
+		t.Fatalf("write record: %v", err)
+	}
+	return data
+}
+
+func TestServerCall(t *testing.T) {
+	registry := rgoipc.NewRegistry()
+	registry.Register("add", testAddHandler, rgoipc.FunctionSignature{
+		Args: []rgoipc.ArgSpec{
+			{Name: "x", Type: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64}},
+			{Name: "y", Type: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64}},
+		},
+		ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64},
+	})
+
+	url, _ := startTestServer(t, registry)
+	sock := dialTestClient(t, url)
+
+	reply := roundTrip(t, sock, &rgoipc.RPCMessage{
+		Type:      rgoipc.MsgTypeCall,
+		FuncName:  "add",
+		ArrowData: float64Record(t, []string{"x", "y"}, []float64{1, 2}, []float64{10, 20}),
+	})
+	if reply.Type != rgoipc.MsgTypeResult {
+		t.Fatalf("expected result, got type %d: %s", reply.Type, reply.ErrorMsg)
+	}
+
+	result, err := rgoipc.ReadArrowRecord(reply.ArrowData)
+	if err != nil {
+		t.Fatalf("read result: %v", err)
+	}
+	defer result.Release()
+	got := result.Column(0).(*array.Float64).Float64Values()
+	if len(got) != 2 || got[0] != 11 || got[1] != 22 {
+		t.Errorf("unexpected result %v", got)
+	}
+
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "missing"})
+	if reply.Type != rgoipc.MsgTypeError || !errors.Is(reply.Error, rgoipc.ErrFunctionNotFound) {
+		t.Errorf("expected function not found error, got type %d: %q", reply.Type, reply.ErrorMsg)
+	}
+
+	// v1 clients only get the message text
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "missing", Version: rgoipc.ProtocolV1})
+	if reply.Error != nil || reply.ErrorMsg != "function not found: missing" {
+		t.Errorf("v1 error reply: %q (structured: %v)", reply.ErrorMsg, reply.Error)
+	}
+}
+
+func TestServerErrorCodes(t *testing.T) {
+	registry := rgoipc.NewRegistry()
+	registry.Register("fail", func(input arrow.Record) (arrow.Record, error) {
+		cause := errors.New("column x is empty")
+		return nil, fmt.Errorf("checking input: %w", cause)
+	}, rgoipc.FunctionSignature{ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64}})
+	registry.Register("reject", func(input arrow.Record) (arrow.Record, error) {
+		return nil, rgoipc.NewError(rgoipc.CodeInvalidSchema, "x must be positive").WithDetail("column", "x")
+	}, rgoipc.FunctionSignature{ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64}})
+
+	url, _ := startTestServer(t, registry)
+	sock := dialTestClient(t, url)
+
+	reply := roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "fail"})
+	if reply.Error == nil || reply.Error.Code != rgoipc.CodeExecutionFailed {
+		t.Fatalf("expected execution_failed, got %+v", reply.Error)
+	}
+	wantCauses := []string{"function execution failed", "checking input: column x is empty", "column x is empty"}
+	if fmt.Sprint(reply.Error.Causes) != fmt.Sprint(wantCauses) {
+		t.Errorf("causes: got %q, want %q", reply.Error.Causes, wantCauses)
+	}
+
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "reject"})
+	if reply.Error == nil || reply.Error.Code != rgoipc.CodeInvalidSchema || reply.Error.Details["column"] != "x" {
+		t.Errorf("expected invalid_schema with column detail, got %+v", reply.Error)
+	}
+	if !errors.Is(reply.Error, rgoipc.ErrInvalidSchema) {
+		t.Errorf("decoded error does not match ErrInvalidSchema")
+	}
+}
+
+func TestServerValidatesOutput(t *testing.T) {
+	registry := rgoipc.NewRegistry()
+	registry.Register("add", testAddHandler, rgoipc.FunctionSignature{
+		Args: []rgoipc.ArgSpec{
+			{Name: "x", Type: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64}},
+			{Name: "y", Type: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64}},
+		},
+		ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeString}, // testAddHandler returns float64
+	})
+
+	url, _ := startTestServer(t, registry, rgoipc.WithValidation(rgoipc.ValidateOutput))
+	sock := dialTestClient(t, url)
+
+	reply := roundTrip(t, sock, &rgoipc.RPCMessage{
+		Type:      rgoipc.MsgTypeCall,
+		FuncName:  "add",
+		ArrowData: float64Record(t, []string{"x", "y"}, []float64{1}, []float64{2}),
+	})
+	if reply.Error == nil || reply.Error.Code != rgoipc.CodeOutputMismatch {
+		t.Fatalf("expected output_mismatch, got %+v", reply.Error)
+	}
+	if reply.Error.Details["result"] != "expected utf8, got float64" {
+		t.Errorf("unexpected details %v", reply.Error.Details)
+	}
+}
+
+func TestServerEmptyInput(t *testing.T) {
+	registry := rgoipc.NewRegistry()
+	var gotCols, gotRows int64 = -1, -1
+	registry.Register("status", func(input arrow.Record) (arrow.Record, error) {
+		gotCols, gotRows = input.NumCols(), input.NumRows()
+		input.Retain()
+		return input, nil
+	}, rgoipc.FunctionSignature{ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeString}})
+
+	url, _ := startTestServer(t, registry)
+	sock := dialTestClient(t, url)
+
+	reply := roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "status"})
+	if reply.Type != rgoipc.MsgTypeResult {
+		t.Fatalf("empty payload: expected result, got %q", reply.ErrorMsg)
+	}
+	if gotCols != 0 || gotRows != 0 {
+		t.Errorf("empty payload: got %d cols, %d rows", gotCols, gotRows)
+	}
+
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{
+		Type:      rgoipc.MsgTypeCall,
+		FuncName:  "status",
+		ArrowData: float64Record(t, []string{"dummy"}, []float64{}),
+	})
+	if reply.Type != rgoipc.MsgTypeResult {
+		t.Fatalf("zero-row stream: expected result, got %q", reply.ErrorMsg)
+	}
+	if gotCols != 1 || gotRows != 0 {
+		t.Errorf("zero-row stream: got %d cols, %d rows", gotCols, gotRows)
+	}
+}
+
+func TestServerConcurrentWorkers(t *testing.T) {
+	t.Run("rep", func(t *testing.T) { testConcurrentWorkers(t, rep.NewSocket) })
+	t.Run("xrep", func(t *testing.T) { testConcurrentWorkers(t, xrep.NewSocket) })
+}
+
+// testConcurrentWorkers runs calls of several clients at once and checks
+// that every reply reaches the client that sent the call
+func testConcurrentWorkers(t *testing.T, newSocket func() (mangos.Socket, error)) {
+	const workers = 4
+
+	// Every call blocks until all of them have arrived, so the test only
+	// finishes if the server really runs them at the same time
+	var arrived sync.WaitGroup
+	arrived.Add(workers)
+	registry := rgoipc.NewRegistry()
+	registry.Register("barrier", func(input arrow.Record) (arrow.Record, error) {
+		arrived.Done()
+		arrived.Wait()
+		input.Retain()
+		return input, nil
+	}, rgoipc.FunctionSignature{ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64}})
+
+	url, _ := startTestServerOn(t, newSocket, registry, rgoipc.WithWorkers(workers))
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		sock := dialTestClient(t, url)
+		value := float64(i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reply := roundTrip(t, sock, &rgoipc.RPCMessage{
+				Type:      rgoipc.MsgTypeCall,
+				FuncName:  "barrier",
+				ArrowData: float64Record(t, []string{"x"}, []float64{value}),
+			})
+			result, err := rgoipc.ReadArrowRecord(reply.ArrowData)
+			if err != nil {
+				t.Errorf("read result: %v", err)
+				return
+			}
+			defer result.Release()
+			if got := result.Column(0).(*array.Float64).Value(0); got != value {
+				t.Errorf("client %v got reply for %v", value, got)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// rawSocket is a minimal raw-mode socket: requests come from in, replies go
+// to out with the header the server attached
+type rawSocket struct {
+	mangos.Socket
+	in     chan *mangos.Message
+	out    chan *mangos.Message
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (s *rawSocket) GetOption(name string) (interface{}, error) {
+	if name == mangos.OptionRaw {
+		return true, nil
+	}
+	return nil, mangos.ErrBadOption
+}
+
+func (s *rawSocket) RecvMsg() (*mangos.Message, error) {
+	select {
+	case m := <-s.in:
+		return m, nil
+	case <-s.closed:
+		return nil, mangos.ErrClosed
+	}
+}
+
+func (s *rawSocket) SendMsg(m *mangos.Message) error {
+	s.out <- m
+	return nil
+}
+
+// SetPipeEventHook does nothing: the fake socket has no pipes
+func (s *rawSocket) SetPipeEventHook(mangos.PipeEventHook) mangos.PipeEventHook {
+	return nil
+}
+
+func (s *rawSocket) Close() error {
+	s.once.Do(func() { close(s.closed) })
+	return nil
+}
+
+func TestServerRawBacktrace(t *testing.T) {
+	registry := rgoipc.NewRegistry()
+	registry.Register("add", testAddHandler, rgoipc.FunctionSignature{
+		ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64},
+	})
+
+	sock := &rawSocket{
+		in:     make(chan *mangos.Message),
+		out:    make(chan *mangos.Message, 2),
+		closed: make(chan struct{}),
+	}
+	server := rgoipc.NewServer(registry, sock, rgoipc.WithWorkers(2))
+	errc := make(chan error, 1)
+	go func() { errc <- server.Serve(context.Background()) }()
+
+	for _, id := range []byte{1, 2} {
+		m := mangos.NewMessage(0)
+		m.Header = []byte{0x80, 0, 0, id}
+		m.Body = (&rgoipc.RPCMessage{
+			Type:      rgoipc.MsgTypeCall,
+			FuncName:  "add",
+			ArrowData: float64Record(t, []string{"x", "y"}, []float64{float64(id)}, []float64{0}),
+		}).Marshal()
+		sock.in <- m
+	}
+
+	for i := 0; i < 2; i++ {
+		r := <-sock.out
+		reply, err := rgoipc.UnmarshalRPCMessage(r.Body)
+		if err != nil {
+			t.Fatalf("unmarshal reply: %v", err)
+		}
+		result, err := rgoipc.ReadArrowRecord(reply.ArrowData)
+		if err != nil {
+			t.Fatalf("read result: %v", err)
+		}
+		got := result.Column(0).(*array.Float64).Value(0)
+		result.Release()
+		if len(r.Header) != 4 || float64(r.Header[3]) != got {
+			t.Errorf("reply for %v carries header %v", got, r.Header)
+		}
+	}
+
+	server.Shutdown(context.Background())
+	if err := <-errc; err != rgoipc.ErrServerClosed {
+		t.Errorf("Serve returned %v, want ErrServerClosed", err)
+	}
+}
+
+func TestServerEchoesRequestID(t *testing.T) {
+	registry := rgoipc.NewRegistry()
+	url, _ := startTestServer(t, registry)
+	sock := dialTestClient(t, url)
+
+	reply := roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "missing", RequestID: 42})
+	if reply.Version != rgoipc.ProtocolV2 || reply.RequestID != 42 {
+		t.Errorf("v2 call: got version %d, request ID %d", reply.Version, reply.RequestID)
+	}
+
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeManifest, Version: rgoipc.ProtocolV1})
+	if reply.Version != rgoipc.ProtocolV1 || reply.Type != rgoipc.MsgTypeManifest {
+		t.Errorf("v1 manifest: got version %d, type %d", reply.Version, reply.Type)
+	}
+}
+
+func TestServerRecoversHandlerPanic(t *testing.T) {
+	registry := rgoipc.NewRegistry()
+	registry.Register("crash", func(input arrow.Record) (arrow.Record, error) {
+		// Unchecked cast on the wrong column type, as a careless handler would do
+		_ = input.Column(0).(*array.String)
+		return nil, nil
+	}, rgoipc.FunctionSignature{ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeString}})
+	registry.Register("add", testAddHandler, rgoipc.FunctionSignature{
+		ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64},
+	})
+
+	url, _ := startTestServer(t, registry, rgoipc.WithLogger(log.New(io.Discard, "", 0)))
+	sock := dialTestClient(t, url)
+
+	for i := 0; i < 2; i++ {
+		reply := roundTrip(t, sock, &rgoipc.RPCMessage{
+			Type:      rgoipc.MsgTypeCall,
+			FuncName:  "crash",
+			ArrowData: float64Record(t, []string{"x"}, []float64{1}),
+		})
+		if reply.Error == nil || reply.Error.Code != rgoipc.CodeHandlerPanic {
+			t.Fatalf("expected handler_panic, got %+v", reply.Error)
+		}
+		if !strings.Contains(reply.Error.Stack, "TestServerRecoversHandlerPanic") {
+			t.Errorf("stack does not point at the handler:\n%s", reply.Error.Stack)
+		}
+	}
+
+	// The server is still serving
+	reply := roundTrip(t, sock, &rgoipc.RPCMessage{
+		Type:      rgoipc.MsgTypeCall,
+		FuncName:  "add",
+		ArrowData: float64Record(t, []string{"x", "y"}, []float64{1}, []float64{2}),
+	})
+	if reply.Type != rgoipc.MsgTypeResult {
+		t.Fatalf("server stopped answering after a panic: %q", reply.ErrorMsg)
+	}
+
+	fn, _ := registry.Get("crash")
+	if got := fn.Stats().Panics; got != 2 {
+		t.Errorf("expected 2 recovered panics, got %d", got)
+	}
+}
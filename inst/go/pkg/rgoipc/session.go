@@ -0,0 +1,233 @@
+package rgoipc
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"go.nanomsg.org/mangos/v3"
+)
+
+// Session is the server-side state of one connected client, that is of one
+// mangos pipe. It begins when the client connects and ends when it closes
+// its socket or its process dies, which the server learns from the pipe
+// layer. Handlers reach the session of the calling client with
+// SessionFrom.
+type Session struct {
+	ID        uint32    // pipe ID, unique among connected clients
+	Address   string    // address the client connected to
+	Connected time.Time // when the client connected
+	Peer      *Peer     // verified TLS client identity, or nil
+
+	mu      sync.Mutex
+	closed  bool
+	values  map[any]any
+	owned   map[ownedHandle]struct{}
+	onClose []func()
+}
+
+// ownedHandle is a handle reference held by a session
+type ownedHandle struct {
+	store *HandleStore
+	id    string
+}
+
+// SessionFrom returns the session of the client whose request ctx belongs
+// to, or nil outside of server calls and jobs
+func SessionFrom(ctx context.Context) *Session {
+	sess, _ := ctx.Value(sessionKey{}).(*Session)
+	return sess
+}
+
+// sessionKey is the context key of the session of a request
+type sessionKey struct{}
+
+// Get returns the value stored under key, or nil
+func (s *Session) Get(key any) any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.values[key]
+}
+
+// Set stores value under key for the rest of the session. Values that are
+// io.Closers are closed when the session ends; a value set after that is
+// closed right away.
+func (s *Session) Set(key, value any) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		closeValue(value)
+		return
+	}
+	if s.values == nil {
+		s.values = make(map[any]any)
+	}
+	s.values[key] = value
+	s.mu.Unlock()
+}
+
+// Delete removes the value stored under key without closing it
+func (s *Session) Delete(key any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// Own hands a reference to a handle of store over to the session: it is
+// released when the session ends, unless the client releases the handle
+// first with MsgTypeHandleRelease. Handlers call it for the handles they
+// return to the client:
+//
+//	id := handles.New(model)
+//	rgoipc.SessionFrom(ctx).Own(handles, id)
+//
+// Own on a nil session does nothing, so handlers also work outside of the
+// server.
+func (s *Session) Own(store *HandleStore, id string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		store.Release(id)
+		return
+	}
+	if s.owned == nil {
+		s.owned = make(map[ownedHandle]struct{})
+	}
+	s.owned[ownedHandle{store, id}] = struct{}{}
+	s.mu.Unlock()
+}
+
+// owns reports whether the session holds a reference to a handle
+func (s *Session) owns(store *HandleStore, id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.owned[ownedHandle{store, id}]
+	return ok
+}
+
+// disown forgets a handle reference the client released itself, and
+// reports whether the session held it
+func (s *Session) disown(store *HandleStore, id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := ownedHandle{store, id}
+	_, ok := s.owned[key]
+	delete(s.owned, key)
+	return ok
+}
+
+// OnClose registers fn to run when the session ends
+func (s *Session) OnClose(fn func()) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		fn()
+		return
+	}
+	s.onClose = append(s.onClose, fn)
+	s.mu.Unlock()
+}
+
+// close ends the session: it runs the OnClose functions in reverse order,
+// releases the owned handles and closes the values
+func (s *Session) close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	onClose, owned, values := s.onClose, s.owned, s.values
+	s.onClose, s.owned, s.values = nil, nil, nil
+	s.mu.Unlock()
+
+	for i := len(onClose) - 1; i >= 0; i-- {
+		onClose[i]()
+	}
+	for h := range owned {
+		h.store.Release(h.id)
+	}
+	for _, v := range values {
+		closeValue(v)
+	}
+}
+
+func closeValue(v any) {
+	if c, ok := v.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// OnConnect sets a function called with the session of every client that
+// connects. It runs on the pipe layer's goroutine and must not block.
+func OnConnect(fn func(*Session)) ServerOption {
+	return func(s *Server) {
+		s.onConnect = fn
+	}
+}
+
+// OnDisconnect sets a function called with the session of every client
+// that disconnects, before the session's resources are cleaned up. It runs
+// on the pipe layer's goroutine and must not block.
+func OnDisconnect(fn func(*Session)) ServerOption {
+	return func(s *Server) {
+		s.onDisconnect = fn
+	}
+}
+
+// Sessions returns the sessions of the connected clients
+func (s *Server) Sessions() []*Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	return sessions
+}
+
+// pipeEvent tracks the clients of the socket. It chains to the hook that
+// was installed before the server's.
+func (s *Server) pipeEvent(event mangos.PipeEvent, p mangos.Pipe) {
+	if s.pipeHook != nil {
+		s.pipeHook(event, p)
+	}
+	switch event {
+	case mangos.PipeEventAttached:
+		sess := &Session{ID: p.ID(), Address: p.Address(), Connected: time.Now(), Peer: pipePeer(p)}
+		s.mu.Lock()
+		s.sessions[p.ID()] = sess
+		s.mu.Unlock()
+		if s.onConnect != nil {
+			s.onConnect(sess)
+		}
+	case mangos.PipeEventDetached:
+		s.mu.Lock()
+		sess, ok := s.sessions[p.ID()]
+		delete(s.sessions, p.ID())
+		s.mu.Unlock()
+		if !ok {
+			return
+		}
+		if s.onDisconnect != nil {
+			s.onDisconnect(sess)
+		}
+		sess.close()
+	}
+}
+
+// session returns the session of the client on p. Sessions only begin when
+// a pipe attaches: a pipe that attached before the server installed its
+// hook, or a request still queued after its pipe detached, has none.
+func (s *Server) session(p mangos.Pipe) *Session {
+	if p == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions[p.ID()]
+}
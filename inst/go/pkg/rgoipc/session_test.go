@@ -0,0 +1,173 @@
+package rgoipc_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"mangoro.local/pkg/rgoipc"
+
+	"github.com/apache/arrow/go/v18/arrow"
+	"go.nanomsg.org/mangos/v3"
+	"go.nanomsg.org/mangos/v3/protocol/xrep"
+)
+
+type counterKey struct{}
+
+func TestServerSessions(t *testing.T) {
+	connected := make(chan *rgoipc.Session, 2)
+	disconnected := make(chan *rgoipc.Session, 2)
+	store := rgoipc.NewHandleStore(0)
+
+	registry := rgoipc.NewRegistry()
+	// count returns how often the calling client called it
+	registry.RegisterContext("count", func(ctx context.Context, _ arrow.Record) (arrow.Record, error) {
+		sess := rgoipc.SessionFrom(ctx)
+		n, _ := sess.Get(counterKey{}).(int32)
+		sess.Set(counterKey{}, n+1)
+		return rgoipc.NewRecordBuilder().Add("result", []int32{n + 1}).NewRecord()
+	}, rgoipc.FunctionSignature{ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeInt32}})
+	registry.RegisterContext("open", func(ctx context.Context, _ arrow.Record) (arrow.Record, error) {
+		id := store.New(&closer{closed: make(chan struct{})})
+		rgoipc.SessionFrom(ctx).Own(store, id)
+		return rgoipc.NewRecordBuilder().Add("handle", []string{id}).NewRecord()
+	}, rgoipc.FunctionSignature{ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeDynamic}})
+
+	url, server := startTestServer(t, registry,
+		rgoipc.WithHandles(store),
+		rgoipc.OnConnect(func(s *rgoipc.Session) { connected <- s }),
+		rgoipc.OnDisconnect(func(s *rgoipc.Session) { disconnected <- s }))
+	first := dialTestClient(t, url)
+	second := dialTestClient(t, url)
+
+	call := func(sock mangos.Socket, name string) *rgoipc.RPCMessage {
+		t.Helper()
+		reply := roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: name})
+		if reply.Type != rgoipc.MsgTypeResult {
+			t.Fatalf("%s: %v", name, reply.Error)
+		}
+		return reply
+	}
+	result := func(reply *rgoipc.RPCMessage) int32 {
+		t.Helper()
+		rec, err := rgoipc.ReadArrowRecord(reply.ArrowData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rec.Release()
+		values, _ := rgoipc.Column[int32](rec, "result")
+		return values[0]
+	}
+
+	// Each client has its own session state
+	call(first, "count")
+	if n := result(call(first, "count")); n != 2 {
+		t.Errorf("first client: count = %d, want 2", n)
+	}
+	if n := result(call(second, "count")); n != 1 {
+		t.Errorf("second client: count = %d, want 1", n)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-connected:
+		case <-time.After(5 * time.Second):
+			t.Fatal("OnConnect not called")
+		}
+	}
+	if n := len(server.Sessions()); n != 2 {
+		t.Errorf("%d sessions, want 2", n)
+	}
+
+	// Handles owned by a session are released when its client goes away
+	call(second, "open")
+	if n := len(store.List()); n != 1 {
+		t.Fatalf("%d handles, want 1", n)
+	}
+	second.Close()
+	select {
+	case sess := <-disconnected:
+		if sess.Address != url {
+			t.Errorf("disconnected session address = %q", sess.Address)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnDisconnect not called")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(store.List()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("handle of a closed session not released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(server.Sessions()); n != 1 {
+		t.Errorf("%d sessions after a disconnect, want 1", n)
+	}
+}
+
+func TestServerSessionsOfDetachedPipes(t *testing.T) {
+	release := make(chan struct{})
+	var unblock sync.Once
+	t.Cleanup(func() { unblock.Do(func() { close(release) }) }) // before the server's
+	started := make(chan struct{}, 1)
+	served := make(chan bool, 1)
+	var connects atomic.Int32
+
+	registry := rgoipc.NewRegistry()
+	registry.RegisterContext("block", func(ctx context.Context, _ arrow.Record) (arrow.Record, error) {
+		started <- struct{}{}
+		<-release
+		return rgoipc.NewRecordBuilder().Add("result", []int32{1}).NewRecord()
+	}, rgoipc.FunctionSignature{ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeInt32}})
+	registry.RegisterContext("session", func(ctx context.Context, _ arrow.Record) (arrow.Record, error) {
+		served <- rgoipc.SessionFrom(ctx) != nil
+		return rgoipc.NewRecordBuilder().Add("result", []int32{1}).NewRecord()
+	}, rgoipc.FunctionSignature{ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeInt32}})
+
+	// A raw socket hands requests to the workers itself, so a request can
+	// outlive the pipe it came on
+	url, server := startTestServerOn(t, xrep.NewSocket, registry,
+		rgoipc.WithWorkers(1),
+		rgoipc.OnConnect(func(*rgoipc.Session) { connects.Add(1) }))
+	busy := dialTestClient(t, url)
+	gone := dialTestClient(t, url)
+
+	// The only worker is busy, so the second request waits in the queue
+	// until its client has gone
+	send := func(sock mangos.Socket, name string) {
+		t.Helper()
+		msg := &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: name}
+		if err := sock.Send(msg.Marshal()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(busy, "block")
+	<-started
+	send(gone, "session")
+	time.Sleep(50 * time.Millisecond)
+	gone.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(server.Sessions()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("session of a closed client not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	unblock.Do(func() { close(release) })
+
+	select {
+	case hasSession := <-served:
+		if hasSession {
+			t.Error("request of a closed client ran with a session")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued request not served")
+	}
+	if n := len(server.Sessions()); n != 1 {
+		t.Errorf("%d sessions, want 1", n)
+	}
+	if n := connects.Load(); n != 2 {
+		t.Errorf("OnConnect called %d times, want 2", n)
+	}
+}
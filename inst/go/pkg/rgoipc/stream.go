@@ -0,0 +1,508 @@
+package rgoipc
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/apache/arrow/go/v18/arrow"
+	"github.com/apache/arrow/go/v18/arrow/array"
+	"github.com/apache/arrow/go/v18/arrow/ipc"
+	"github.com/apache/arrow/go/v18/arrow/memory"
+)
+
+// RecordWriter receives the batches of a streamed result
+type RecordWriter interface {
+	// Write sends one batch. Every batch must have the same schema. The
+	// writer takes its own reference, so the caller still releases rec.
+	// Write blocks until the batch is taken and returns the context's
+	// error if the call is abandoned.
+	Write(rec arrow.Record) error
+}
+
+// StreamHandler computes a result that may not fit in memory as a sequence
+// of record batches written to out. ctx is cancelled when the client stops
+// pulling batches or the server shuts down.
+type StreamHandler func(ctx context.Context, input arrow.Record, out RecordWriter) error
+
+// RegisterStream adds a streaming function. Clients that ask for a
+// streamed result (FlagStream) pull it one batch at a time; others get
+// all batches at once as one multi-batch IPC stream.
+func (r *Registry) RegisterStream(name string, fn StreamHandler, sig FunctionSignature) error {
+	return r.register(&RegisteredFunction{Name: name, Stream: fn, Signature: sig})
+}
+
+// ReaderHandler consumes its input batch by batch, for inputs that R sends
+// as a chunked stream (e.g. nanoarrow::basic_array_stream()) and that need
+// not be held in memory at once, and writes its result batches to out.
+// Reading stops early if a batch fails input validation; the server
+// reports input.Err() after the handler returns.
+type ReaderHandler func(ctx context.Context, input array.RecordReader, out RecordWriter) error
+
+// RegisterReader adds a function that reads its input as a stream of
+// batches. Its result is streamed like that of RegisterStream.
+func (r *Registry) RegisterReader(name string, fn ReaderHandler, sig FunctionSignature) error {
+	return r.register(&RegisteredFunction{Name: name, Reader: fn, Signature: sig})
+}
+
+// streaming reports whether the function may return several batches
+func (fn *RegisteredFunction) streaming() bool {
+	return fn.Stream != nil || fn.Reader != nil
+}
+
+// CallStream runs the function on input, writing the result batches to
+// out and recovering panics like Call. A plain function writes its single
+// result.
+func (fn *RegisteredFunction) CallStream(ctx context.Context, input arrow.Record, out RecordWriter) (err error) {
+	if fn.Reader != nil {
+		reader, err := array.NewRecordReader(input.Schema(), []arrow.Record{input})
+		if err != nil {
+			return err
+		}
+		defer reader.Release()
+		return fn.CallReader(ctx, reader, out)
+	}
+
+	defer fn.stats.count(&err)
+	defer func() {
+		if r := recover(); r != nil {
+			err = fn.recovered(r)
+		}
+	}()
+	if fn.Stream != nil {
+		return fn.Stream(ctx, input, out)
+	}
+
+	result, err := fn.callRecord(ctx, input)
+	if err != nil {
+		return err
+	}
+	defer result.Release()
+	return out.Write(result)
+}
+
+// CallReader runs the function on a stream of input batches. Functions
+// that are not reader functions get the batches concatenated into one
+// record.
+func (fn *RegisteredFunction) CallReader(ctx context.Context, input array.RecordReader, out RecordWriter) (err error) {
+	if fn.Reader == nil {
+		rec, err := readAll(input, Allocator(ctx))
+		if err != nil {
+			return err
+		}
+		defer rec.Release()
+		return fn.CallStream(ctx, rec, out)
+	}
+
+	defer fn.stats.count(&err)
+	defer func() {
+		if r := recover(); r != nil {
+			err = fn.recovered(r)
+		}
+	}()
+	if err := fn.Reader(ctx, input, out); err != nil {
+		return err
+	}
+	return input.Err()
+}
+
+// collect runs a streaming function and concatenates its result batches
+func (fn *RegisteredFunction) collect(ctx context.Context, input arrow.Record) (arrow.Record, error) {
+	var batches recordSlice
+	defer batches.Release()
+	if err := fn.CallStream(ctx, input, &batches); err != nil {
+		return nil, err
+	}
+
+	schema := fn.OutputSchema
+	if len(batches) > 0 {
+		schema = batches[0].Schema()
+	}
+	if schema == nil {
+		schema = arrow.NewSchema([]arrow.Field{}, nil)
+	}
+	rec, err := concatRecords(Allocator(ctx), schema, batches)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrOutputMismatch, err)
+	}
+	return rec, nil
+}
+
+// recordSlice is a RecordWriter keeping every batch in memory
+type recordSlice []arrow.Record
+
+func (s *recordSlice) Write(rec arrow.Record) error {
+	rec.Retain()
+	*s = append(*s, rec)
+	return nil
+}
+
+func (s *recordSlice) Release() {
+	for _, rec := range *s {
+		rec.Release()
+	}
+	*s = nil
+}
+
+// streamEncoder writes batches as one Arrow IPC stream and hands out the
+// bytes written so far, so that a stream can be sent in chunks whose
+// concatenation is a valid IPC stream. The schema comes from the first
+// batch, or from fallback if there is none.
+type streamEncoder struct {
+	ctx      context.Context // if set, Write fails once it is done
+	fn       *RegisteredFunction
+	validate bool
+	fallback *arrow.Schema
+	buf      bytes.Buffer
+	writer   *ipc.Writer
+	schema   *arrow.Schema
+	batches  int
+}
+
+func newStreamEncoder(fn *RegisteredFunction, validate bool) *streamEncoder {
+	fallback := fn.OutputSchema
+	if fallback == nil {
+		fallback = arrow.NewSchema([]arrow.Field{}, nil)
+	}
+	return &streamEncoder{fn: fn, validate: validate, fallback: fallback}
+}
+
+// Write encodes one batch, checking it against the declared return type
+// when validate is set
+func (e *streamEncoder) Write(rec arrow.Record) error {
+	if e.ctx != nil && e.ctx.Err() != nil {
+		return e.ctx.Err()
+	}
+	e.batches++
+	if e.writer == nil {
+		e.open(rec.Schema())
+	} else if !rec.Schema().Equal(e.schema) {
+		return NewError(CodeOutputMismatch, "%s: batch %d has schema %s, expected %s",
+			e.fn.Name, e.batches, rec.Schema(), e.schema)
+	}
+	if e.validate {
+		if err := e.fn.ValidateOutput(rec); err != nil {
+			return err
+		}
+	}
+	return e.writer.Write(rec)
+}
+
+func (e *streamEncoder) open(schema *arrow.Schema) {
+	e.schema = schema
+	e.writer = ipc.NewWriter(&e.buf, ipc.WithSchema(schema), ipc.WithAllocator(memory.DefaultAllocator))
+}
+
+// take returns the bytes written since the last call
+func (e *streamEncoder) take() []byte {
+	out := bytes.Clone(e.buf.Bytes())
+	e.buf.Reset()
+	return out
+}
+
+// close ends the IPC stream
+func (e *streamEncoder) close() error {
+	if e.writer == nil {
+		e.open(e.fallback)
+	}
+	return e.writer.Close()
+}
+
+// resultStream is a streamed result being pulled by a client. The handler
+// runs in its own goroutine and hands batches over one at a time, so at
+// most one batch is buffered whatever the size of the result.
+type resultStream struct {
+	id      string
+	owner   owner
+	fn      *RegisteredFunction
+	batches chan arrow.Record
+	err     error // result of the handler, set before batches is closed
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+	enc     *streamEncoder
+	idle    *time.Timer
+
+	mu sync.Mutex // one pull at a time
+}
+
+// streamWriter is the RecordWriter of a resultStream handler
+type streamWriter struct {
+	ctx     context.Context
+	batches chan<- arrow.Record
+}
+
+func (w *streamWriter) Write(rec arrow.Record) error {
+	rec.Retain()
+	select {
+	case w.batches <- rec:
+		return nil
+	case <-w.ctx.Done():
+		rec.Release()
+		return w.ctx.Err()
+	}
+}
+
+// streamRun runs one call of a streaming function. It owns the input of
+// the call and releases it when done.
+type streamRun func(ctx context.Context, out RecordWriter) error
+
+// handleStreamCall runs a streaming function. Without FlagStream (and for
+// v1 clients) all batches are sent in one reply; otherwise the reply is
+// the first chunk of a stream.
+//
+// A streamed result outlives the call: it gets its own context with the
+// call's timeout and is cancelled by stream ID rather than by request ID.
+func (s *Server) handleStreamCall(ctx context.Context, msg *RPCMessage, fn *RegisteredFunction, run streamRun) *RPCMessage {
+	validate := s.validation&ValidateOutput != 0
+	if msg.Version == ProtocolV1 || msg.Flags&FlagStream == 0 {
+		enc := newStreamEncoder(fn, validate)
+		enc.ctx = ctx
+		if err := run(ctx, enc); err != nil {
+			if ctx.Err() != nil {
+				return errorMessage(msg.FuncName, contextError(ctx))
+			}
+			return s.streamError(msg.FuncName, err)
+		}
+		if err := enc.close(); err != nil {
+			return errorMessage(msg.FuncName, fmt.Errorf("arrow write error: %w", err))
+		}
+		return &RPCMessage{
+			Type:      MsgTypeResult,
+			FuncName:  msg.FuncName,
+			ArrowData: enc.take(),
+		}
+	}
+
+	st := s.openStream(ctx, ownerOf(ctx, msg), fn, run, validate, callTimeout(msg, fn))
+	reply := s.nextChunk(ctx, st)
+	if ctx.Err() != nil && reply.Type == MsgTypeError {
+		// The client never learns the stream ID, so nobody can pull it
+		s.dropStream(st.id, context.Cause(ctx))
+	}
+	return reply
+}
+
+// prepareRun reads (and with ValidateInput, validates) the input of a call
+// to a function of any kind, for a run that may outlive the request
+// message. Reader functions read and validate their input lazily.
+// .shutdown only closes the server when it is answered directly, so it
+// cannot run as a job or a stream.
+func (s *Server) prepareRun(msg *RPCMessage, fn *RegisteredFunction) (streamRun, error) {
+	if fn.Name == BuiltinShutdown {
+		return nil, fmt.Errorf("%w: %s can only be called directly, not as a job or a stream", ErrInvalidMessage, fn.Name)
+	}
+	validate := s.validation&ValidateInput != 0
+	mem := s.limits.allocator()
+	if fn.Reader != nil {
+		// The request buffer is reused once the call returns
+		reader, err := s.inputReader(bytes.Clone(msg.ArrowData), mem)
+		if err != nil {
+			return nil, err
+		}
+		input := reader
+		if validate {
+			input = &validatingReader{RecordReader: reader, fn: fn, mem: mem}
+		}
+		return func(ctx context.Context, out RecordWriter) error {
+			defer input.Release()
+			return fn.CallReader(withAllocator(ctx, mem), input, out)
+		}, nil
+	}
+
+	input, err := s.readInput(msg.ArrowData, mem)
+	if err != nil {
+		return nil, err
+	}
+	if validate {
+		validated, err := fn.validateInput(input, mem)
+		input.Release()
+		if err != nil {
+			return nil, err
+		}
+		input = validated
+	}
+	return func(ctx context.Context, out RecordWriter) error {
+		defer input.Release()
+		return fn.CallStream(withAllocator(ctx, mem), input, out)
+	}, nil
+}
+
+// stream returns the stream named in the name field of msg, once the
+// Authorizer has allowed msg to reach its function. The streams of other
+// clients are not found.
+func (s *Server) stream(ctx context.Context, msg *RPCMessage) (*resultStream, error) {
+	s.mu.Lock()
+	st, ok := s.streams[msg.FuncName]
+	s.mu.Unlock()
+	if !ok || !st.owner.matches(ownerOf(ctx, msg)) {
+		return nil, fmt.Errorf("%w: unknown or expired stream %s", ErrInvalidMessage, msg.FuncName)
+	}
+	if err := s.authorize(ctx, msg, st.fn); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s *Server) handleStreamNext(ctx context.Context, msg *RPCMessage) *RPCMessage {
+	st, err := s.stream(ctx, msg)
+	if err != nil {
+		return errorMessage(msg.FuncName, err)
+	}
+	if msg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, msg.Timeout, fmt.Errorf("%w after %s", ErrDeadlineExceeded, msg.Timeout))
+		defer cancel()
+	}
+	return s.nextChunk(ctx, st)
+}
+
+// openStream starts the handler of a streamed result. The stream outlives
+// the call, so it keeps the values of the call's context (session, progress
+// reporter) but not its cancellation; closing the server still ends it.
+// Only owner can pull or cancel it.
+func (s *Server) openStream(call context.Context, owner owner, fn *RegisteredFunction, run streamRun, validate bool, timeout time.Duration) *resultStream {
+	ctx, cancel := context.WithCancelCause(context.WithoutCancel(call))
+	stopShutdown := context.AfterFunc(s.ctx, func() {
+		cancel(context.Cause(s.ctx))
+	})
+	stop := func() {}
+	if timeout > 0 {
+		var stopTimeout context.CancelFunc
+		ctx, stopTimeout = context.WithTimeoutCause(ctx, timeout, fmt.Errorf("%w after %s", ErrDeadlineExceeded, timeout))
+		stop = stopTimeout
+	}
+	st := &resultStream{
+		id:      randomID(),
+		owner:   owner,
+		fn:      fn,
+		batches: make(chan arrow.Record),
+		ctx:     ctx,
+		cancel: func(cause error) {
+			cancel(cause)
+			stop()
+			stopShutdown()
+		},
+		enc: newStreamEncoder(fn, validate),
+	}
+
+	// The timer exists before the stream is published, since dropStream
+	// stops it
+	st.idle = time.AfterFunc(s.streamIdle, func() {
+		s.dropStream(st.id, fmt.Errorf("%w: stream not pulled for %s", ErrCancelled, s.streamIdle))
+	})
+	s.mu.Lock()
+	s.streams[st.id] = st
+	s.mu.Unlock()
+
+	go func() {
+		defer close(st.batches)
+		st.err = run(ctx, &streamWriter{ctx: ctx, batches: st.batches})
+	}()
+	return st
+}
+
+// nextChunk waits for the next batch and returns it as a chunk reply, or
+// the end-of-stream chunk once the handler is done. It stops waiting when
+// the stream's context ends, which drops the stream, or when ctx, the
+// context of the request, ends first; the stream can then be pulled again.
+func (s *Server) nextChunk(ctx context.Context, st *resultStream) *RPCMessage {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.idle.Stop() // the handler may take longer than the idle timeout
+
+	var rec arrow.Record
+	var ok bool
+	select {
+	case rec, ok = <-st.batches:
+	case <-st.ctx.Done():
+		s.dropStream(st.id, nil)
+		return errorMessage(st.fn.Name, contextError(st.ctx))
+	case <-ctx.Done():
+		st.idle.Reset(s.streamIdle)
+		return errorMessage(st.fn.Name, contextError(ctx))
+	}
+	if !ok {
+		s.dropStream(st.id, nil)
+		if st.err != nil {
+			if st.ctx.Err() != nil {
+				return errorMessage(st.fn.Name, contextError(st.ctx))
+			}
+			return s.streamError(st.fn.Name, st.err)
+		}
+		if err := st.enc.close(); err != nil {
+			return errorMessage(st.fn.Name, fmt.Errorf("arrow write error: %w", err))
+		}
+		return st.chunk(FlagEndOfStream)
+	}
+
+	err := st.enc.Write(rec)
+	rec.Release()
+	if err != nil {
+		s.dropStream(st.id, nil)
+		return s.streamError(st.fn.Name, err)
+	}
+	st.idle.Reset(s.streamIdle)
+	return st.chunk(0)
+}
+
+// chunk returns the bytes encoded since the last chunk
+func (st *resultStream) chunk(flags uint16) *RPCMessage {
+	return &RPCMessage{
+		Type:      MsgTypeResult,
+		FuncName:  st.id,
+		Flags:     FlagStream | flags,
+		ArrowData: st.enc.take(),
+	}
+}
+
+// dropStream forgets a stream and cancels its handler with cause. It
+// reports whether the stream existed.
+func (s *Server) dropStream(id string, cause error) bool {
+	s.mu.Lock()
+	st, ok := s.streams[id]
+	delete(s.streams, id)
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	st.idle.Stop()
+	st.cancel(cause)
+	go func() {
+		for rec := range st.batches {
+			rec.Release()
+		}
+	}()
+	return true
+}
+
+// streamError builds the error reply of a failed streaming call
+func (s *Server) streamError(funcName string, err error) *RPCMessage {
+	return errorMessage(funcName, s.runError(err))
+}
+
+// runError logs and classifies the error of a run: output mismatches are
+// reported as they are, anything else as an execution failure
+func (s *Server) runError(err error) error {
+	switch {
+	case errors.Is(err, ErrOutputMismatch):
+		s.logger.Printf("contract violation: %s", err)
+		return err
+	case errors.Is(err, ErrHandlerPanic):
+		s.logger.Printf("recovered %s", err)
+	}
+	return fmt.Errorf("%w: %w", ErrExecutionFailed, err)
+}
+
+// randomID returns a new stream or job ID. IDs are not guessable, so that
+// clients cannot reach the streams and jobs of others.
+func randomID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
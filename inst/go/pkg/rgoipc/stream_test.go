@@ -0,0 +1,326 @@
+package rgoipc_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"mangoro.local/pkg/rgoipc"
+
+	"github.com/apache/arrow/go/v18/arrow"
+	"github.com/apache/arrow/go/v18/arrow/array"
+	"github.com/apache/arrow/go/v18/arrow/ipc"
+	"github.com/apache/arrow/go/v18/arrow/memory"
+)
+
+// countHandler streams the numbers 1..n in batches of two
+func countHandler(n int) rgoipc.StreamHandler {
+	return func(ctx context.Context, _ arrow.Record, out rgoipc.RecordWriter) error {
+		for start := 1; start <= n; start += 2 {
+			values := []int32{int32(start)}
+			if start < n {
+				values = append(values, int32(start+1))
+			}
+			rec, err := rgoipc.NewRecordBuilder().Add("result", values).NewRecord()
+			if err != nil {
+				return err
+			}
+			err = out.Write(rec)
+			rec.Release()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// readStream returns the int32 values of every batch of an IPC stream
+func readStream(t *testing.T, data []byte) (batches int, values []int32) {
+	t.Helper()
+
+	reader, err := rgoipc.NewArrowReader(data)
+	if err != nil {
+		t.Fatalf("read stream: %v", err)
+	}
+	defer reader.Release()
+	for reader.Next() {
+		batches++
+		values = append(values, reader.Record().Column(0).(*array.Int32).Int32Values()...)
+	}
+	if err := reader.Err(); err != nil {
+		t.Fatalf("read stream: %v", err)
+	}
+	return batches, values
+}
+
+func TestServerStreamsResult(t *testing.T) {
+	registry := rgoipc.NewRegistry()
+	sig := rgoipc.FunctionSignature{ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeInt32}}
+	if err := registry.RegisterStream("count", countHandler(5), sig); err != nil {
+		t.Fatal(err)
+	}
+	url, _ := startTestServer(t, registry, rgoipc.WithValidation(rgoipc.ValidateOutput))
+	sock := dialTestClient(t, url)
+
+	// Without FlagStream, and for v1 clients, all batches come in one reply
+	for _, version := range []uint8{rgoipc.ProtocolV1, rgoipc.ProtocolV2} {
+		reply := roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "count", Version: version})
+		if reply.Type != rgoipc.MsgTypeResult {
+			t.Fatalf("v%d: expected result, got %q", version, reply.ErrorMsg)
+		}
+		if batches, values := readStream(t, reply.ArrowData); batches != 3 || len(values) != 5 || values[4] != 5 {
+			t.Errorf("v%d: got %d batches %v", version, batches, values)
+		}
+	}
+
+	// With FlagStream, the client pulls one chunk per batch
+	reply := roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "count", Flags: rgoipc.FlagStream, RequestID: 7})
+	var data []byte
+	chunks := 0
+	for {
+		if reply.Type != rgoipc.MsgTypeResult || reply.Flags&rgoipc.FlagStream == 0 {
+			t.Fatalf("expected a stream chunk, got type %d flags %d: %q", reply.Type, reply.Flags, reply.ErrorMsg)
+		}
+		data = append(data, reply.ArrowData...)
+		chunks++
+		if reply.Flags&rgoipc.FlagEndOfStream != 0 {
+			break
+		}
+		reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeStreamNext, FuncName: reply.FuncName, RequestID: 7})
+	}
+	if chunks != 4 {
+		t.Errorf("expected 3 batch chunks and an end-of-stream chunk, got %d chunks", chunks)
+	}
+	if batches, values := readStream(t, data); batches != 3 || len(values) != 5 {
+		t.Errorf("chunked stream: got %d batches %v", batches, values)
+	}
+
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeStreamNext, FuncName: reply.FuncName})
+	if !errors.Is(reply.Error, rgoipc.ErrInvalidMessage) {
+		t.Errorf("pulling a finished stream: %v", reply.Error)
+	}
+
+	// Call concatenates the batches
+	fn, _ := registry.Get("count")
+	empty, _ := rgoipc.ReadArrowRecord(nil)
+	defer empty.Release()
+	rec, err := fn.Call(empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rec.Release()
+	if rec.NumRows() != 5 {
+		t.Errorf("Call returned %d rows", rec.NumRows())
+	}
+}
+
+func TestServerStreamErrors(t *testing.T) {
+	cancelled := make(chan struct{})
+	registry := rgoipc.NewRegistry()
+	registry.RegisterStream("forever", func(ctx context.Context, _ arrow.Record, out rgoipc.RecordWriter) error {
+		defer close(cancelled)
+		for {
+			rec, _ := rgoipc.NewRecordBuilder().Add("result", []int32{1}).NewRecord()
+			err := out.Write(rec)
+			rec.Release()
+			if err != nil {
+				return err
+			}
+		}
+	}, rgoipc.FunctionSignature{ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeInt32}})
+	registry.RegisterStream("mistyped", countHandler(3), rgoipc.FunctionSignature{ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeString}})
+
+	url, _ := startTestServer(t, registry,
+		rgoipc.WithValidation(rgoipc.ValidateOutput),
+		rgoipc.WithStreamIdleTimeout(50*time.Millisecond),
+		rgoipc.WithLogger(log.New(io.Discard, "", 0)))
+	sock := dialTestClient(t, url)
+
+	// An abandoned stream is dropped and its handler cancelled
+	reply := roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "forever", Flags: rgoipc.FlagStream})
+	if reply.Flags&rgoipc.FlagStream == 0 {
+		t.Fatalf("expected a stream chunk, got %q", reply.ErrorMsg)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler of an abandoned stream was not cancelled")
+	}
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeStreamNext, FuncName: reply.FuncName})
+	if !errors.Is(reply.Error, rgoipc.ErrInvalidMessage) {
+		t.Errorf("pulling an expired stream: %v", reply.Error)
+	}
+
+	// Batches are validated against the declared return type
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "mistyped", Flags: rgoipc.FlagStream})
+	if reply.Error == nil || reply.Error.Code != rgoipc.CodeOutputMismatch {
+		t.Errorf("expected output_mismatch, got %v", reply.Error)
+	}
+}
+
+// chunkedStream writes one IPC stream with one batch of column x per chunk,
+// like nanoarrow::basic_array_stream() does
+func chunkedStream(t *testing.T, chunks ...interface{}) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	var writer *ipc.Writer
+	for _, chunk := range chunks {
+		rec, err := rgoipc.NewRecordBuilder().Add("x", chunk).NewRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if writer == nil {
+			writer = ipc.NewWriter(&buf, ipc.WithSchema(rec.Schema()))
+		}
+		if err := writer.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+		rec.Release()
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestServerReadsEveryInputBatch(t *testing.T) {
+	registry := rgoipc.NewRegistry()
+	rgoipc.RegisterFunc(registry, "double", func(x []float64) []float64 {
+		out := make([]float64, len(x))
+		for i, v := range x {
+			out[i] = 2 * v
+		}
+		return out
+	}, rgoipc.WithArgNames("x"))
+	registry.RegisterReader("sum", func(ctx context.Context, in array.RecordReader, out rgoipc.RecordWriter) error {
+		total, batches := 0.0, int32(0)
+		for in.Next() {
+			batches++
+			for _, v := range in.Record().Column(0).(*array.Float64).Float64Values() {
+				total += v
+			}
+		}
+		rec, err := rgoipc.NewRecordBuilder().
+			Add("total", []float64{total}).
+			Add("batches", []int32{batches}).
+			NewRecord()
+		if err != nil {
+			return err
+		}
+		defer rec.Release()
+		return out.Write(rec)
+	}, rgoipc.FunctionSignature{
+		Args: []rgoipc.ArgSpec{{Name: "x", Type: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64}}},
+		ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeRecord, StructDef: &rgoipc.StructDef{Fields: []rgoipc.FieldDef{
+			{Name: "total", Type: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64}},
+			{Name: "batches", Type: rgoipc.TypeSpec{Type: rgoipc.TypeInt32}},
+		}}},
+	})
+	url, _ := startTestServer(t, registry, rgoipc.WithValidation(rgoipc.ValidateInput|rgoipc.ValidateOutput))
+	sock := dialTestClient(t, url)
+
+	// Plain handlers see the batches concatenated
+	reply := roundTrip(t, sock, &rgoipc.RPCMessage{
+		Type: rgoipc.MsgTypeCall, FuncName: "double",
+		ArrowData: chunkedStream(t, []float64{1, 2}, []float64{3}, []float64{4, 5}),
+	})
+	if reply.Type != rgoipc.MsgTypeResult {
+		t.Fatalf("double: %q", reply.ErrorMsg)
+	}
+	result, err := rgoipc.ReadArrowRecord(reply.ArrowData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := result.Column(0).(*array.Float64).Float64Values(); len(got) != 5 || got[4] != 10 {
+		t.Errorf("double of a chunked input = %v", got)
+	}
+	result.Release()
+
+	// Reader handlers see every batch, validated (R integers become doubles)
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{
+		Type: rgoipc.MsgTypeCall, FuncName: "sum",
+		ArrowData: chunkedStream(t, []int32{1, 2}, []int32{3}, []int32{4, 5}),
+	})
+	if reply.Type != rgoipc.MsgTypeResult {
+		t.Fatalf("sum: %q", reply.ErrorMsg)
+	}
+	result, err = rgoipc.ReadArrowRecord(reply.ArrowData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := result.Column(0).(*array.Float64).Value(0)
+	batches := result.Column(1).(*array.Int32).Value(0)
+	result.Release()
+	if total != 15 || batches != 3 {
+		t.Errorf("sum = %v over %d batches, want 15 over 3", total, batches)
+	}
+
+	reply = roundTrip(t, sock, &rgoipc.RPCMessage{
+		Type: rgoipc.MsgTypeCall, FuncName: "sum",
+		ArrowData: chunkedStream(t, []string{"a"}),
+	})
+	if !errors.Is(reply.Error, rgoipc.ErrInvalidSchema) {
+		t.Errorf("expected invalid_schema for a mistyped batch, got %v", reply.Error)
+	}
+}
+
+func TestValidatingReaderSchema(t *testing.T) {
+	registry := rgoipc.NewRegistry()
+	registry.RegisterReader("zone", func(ctx context.Context, in array.RecordReader, out rgoipc.RecordWriter) error {
+		schema := in.Schema()
+		for in.Next() {
+			if !in.Record().Schema().Equal(schema) {
+				return fmt.Errorf("reader schema %s, batch schema %s", schema, in.Record().Schema())
+			}
+		}
+		if err := in.Err(); err != nil {
+			return err
+		}
+		tz := schema.Field(0).Type.(*arrow.TimestampType).TimeZone
+		rec, err := rgoipc.NewRecordBuilder().Add("tz", []string{tz}).NewRecord()
+		if err != nil {
+			return err
+		}
+		defer rec.Release()
+		return out.Write(rec)
+	}, rgoipc.FunctionSignature{
+		Args:       []rgoipc.ArgSpec{{Name: "x", Type: rgoipc.TypeSpec{Type: rgoipc.TypeTimestamp}}},
+		ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeString},
+	})
+	url, _ := startTestServer(t, registry, rgoipc.WithValidation(rgoipc.ValidateInput))
+	sock := dialTestClient(t, url)
+
+	// The declaration accepts any time zone; the reader reports the one sent
+	dt := &arrow.TimestampType{Unit: arrow.Second, TimeZone: "Europe/Paris"}
+	b := array.NewTimestampBuilder(memory.NewGoAllocator(), dt)
+	defer b.Release()
+	b.AppendValues([]arrow.Timestamp{0, 60}, nil)
+	col := b.NewArray()
+	defer col.Release()
+	rec := array.NewRecord(arrow.NewSchema([]arrow.Field{{Name: "x", Type: dt}}, nil), []arrow.Array{col}, 2)
+	defer rec.Release()
+	input, err := rgoipc.WriteArrowRecord(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply := roundTrip(t, sock, &rgoipc.RPCMessage{Type: rgoipc.MsgTypeCall, FuncName: "zone", ArrowData: input})
+	if reply.Type != rgoipc.MsgTypeResult {
+		t.Fatalf("zone: %q", reply.ErrorMsg)
+	}
+	result, err := rgoipc.ReadArrowRecord(reply.ArrowData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer result.Release()
+	if tz := result.Column(0).(*array.String).Value(0); tz != "Europe/Paris" {
+		t.Errorf("reader schema has time zone %q", tz)
+	}
+}
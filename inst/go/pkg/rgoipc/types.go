@@ -2,6 +2,10 @@
 package rgoipc
 
 import (
+	"context"
+	"sync/atomic"
+	"time"
+
 	"github.com/apache/arrow/go/v18/arrow"
 )
 
@@ -13,17 +17,33 @@ const (
 	TypeFloat64 ArrowType = "float64" // R numeric (single column)
 	TypeString  ArrowType = "string"  // R character (single column)
 	TypeBool    ArrowType = "bool"    // R logical (single column)
-	
+
+	// Typed R vectors; the TypeSpec fields in brackets refine them
+	TypeInt64         ArrowType = "int64"           // bit64::integer64
+	TypeDate32        ArrowType = "date32"          // R Date (days since the epoch)
+	TypeTimestamp     ArrowType = "timestamp"       // R POSIXct [Unit, TimeZone]
+	TypeDuration      ArrowType = "duration"        // R difftime [Unit]
+	TypeTime          ArrowType = "time"            // hms: time32 for s/ms, time64 for us/ns [Unit]
+	TypeDictionary    ArrowType = "dictionary"      // R factor: int32 indices, string levels [Levels, Ordered]
+	TypeBinary        ArrowType = "binary"          // raw vectors and blobs, one per row
+	TypeLargeString   ArrowType = "large_string"    // character with 64-bit offsets
+	TypeFixedSizeList ArrowType = "fixed_size_list" // fixed-length arrays per row [ListSchema, ListSize]
+
 	// Complex types - rarely used in typical data processing
-	TypeList    ArrowType = "list"    // Arrow List<T> - variable-length arrays (R list column)
-	TypeStruct  ArrowType = "struct"  // Arrow Struct - nested record with named fields (R struct column)
-	
+	TypeList   ArrowType = "list"   // Arrow List<T> - variable-length arrays (R list column)
+	TypeStruct ArrowType = "struct" // Arrow Struct - nested record with named fields (R struct column)
+
+	// Return-only kinds describing the whole result record
+	TypeRecord  ArrowType = "record"  // Multi-column result, one column per StructDef field (R data.frame)
+	TypeDynamic ArrowType = "dynamic" // Result schema only known at runtime; never checked
+
 	// Note: The primary data exchange format is Arrow RecordBatch (tabular data),
 	// which naturally maps to R data.frame. Functions receive/return arrow.Record,
 	// which represents tabular data with multiple columns and rows.
 	//
 	// TypeStruct is for creating a COLUMN of structs (nested data), NOT for describing
-	// multi-column results. For multi-column returns, just create arrow.Record with
+	// multi-column results. For multi-column returns, declare TypeRecord (or
+	// TypeDynamic if the columns vary per call) and create arrow.Record with
 	// multiple columns directly - see cmd/rpc-example for examples.
 	//
 	// Example struct column usage: misc/test_struct_column.R
@@ -33,8 +53,14 @@ const (
 type TypeSpec struct {
 	Type       ArrowType
 	Nullable   bool
-	StructDef  *StructDef  // For struct types
-	ListSchema *arrow.Schema // For list types
+	StructDef  *StructDef    // For struct types
+	ListSchema *arrow.Schema // For list and fixed-size list types: the element is field 0
+
+	Unit     arrow.TimeUnit // For timestamp, duration and time types (zero value: seconds)
+	TimeZone string         // For timestamp types; empty accepts any time zone
+	Levels   []string       // For dictionary types: the allowed values, empty allows any
+	Ordered  bool           // For dictionary types: an R ordered factor
+	ListSize int32          // For fixed-size list types
 }
 
 // StructDef defines structure for complex types
@@ -63,6 +89,18 @@ type FunctionSignature struct {
 	ReturnType TypeSpec
 	Vectorized bool // Can process batches
 	Metadata   map[string]string
+	// Description and Tags document the function in the manifest
+	Description string
+	Tags        []string
+	// Scopes are the permissions a caller needs, checked by the Authorizer
+	// of the registry (see Registry.SetAuthorizer)
+	Scopes []string
+	// DynamicArgs marks functions that accept any input columns (for
+	// example a matrix of arbitrary width); Args are then not validated
+	DynamicArgs bool
+	// Timeout bounds every call of the function; a shorter client deadline
+	// (FlagDeadline) wins. Zero means no default timeout.
+	Timeout time.Duration
 }
 
 // FunctionHandler processes Arrow record batches
@@ -86,11 +124,44 @@ type FunctionSignature struct {
 //   return array.NewRecord(schema, []arrow.Array{statusArray, messageArray}, 1)
 type FunctionHandler func(input arrow.Record) (arrow.Record, error)
 
+// ContextHandler is a FunctionHandler that receives the context of the
+// call. ctx is cancelled when the call's deadline passes, when the client
+// cancels it (MsgTypeCancel) or when the server shuts down; long-running
+// handlers should check it and return ctx.Err().
+type ContextHandler func(ctx context.Context, input arrow.Record) (arrow.Record, error)
+
 // RegisteredFunction represents a function registered for RPC
 type RegisteredFunction struct {
-	Name         string
-	Handler      FunctionHandler
-	InputSchema  *arrow.Schema
-	OutputSchema *arrow.Schema
-	Signature    FunctionSignature
+	Name           string
+	Handler        FunctionHandler
+	ContextHandler ContextHandler // set instead of Handler by RegisterContext
+	Stream         StreamHandler  // set instead of Handler by RegisterStream
+	Reader         ReaderHandler  // set instead of Handler by RegisterReader
+	InputSchema    *arrow.Schema
+	OutputSchema   *arrow.Schema // nil for TypeDynamic returns
+	Signature      FunctionSignature
+
+	stats functionCounters
+}
+
+// FunctionStats is a snapshot of the counters of a registered function
+type FunctionStats struct {
+	Calls  int64 // handler invocations, through any Call method
+	Errors int64 // invocations that returned an error, panics included
+	Panics int64 // handler panics recovered by Call
+}
+
+// functionCounters holds the live counters behind FunctionStats
+type functionCounters struct {
+	calls  atomic.Int64
+	errors atomic.Int64
+	panics atomic.Int64
+}
+
+// count records a finished handler invocation whose error *err is
+func (c *functionCounters) count(err *error) {
+	c.calls.Add(1)
+	if *err != nil {
+		c.errors.Add(1)
+	}
 }
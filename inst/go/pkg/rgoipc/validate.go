@@ -0,0 +1,465 @@
+package rgoipc
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/apache/arrow/go/v18/arrow"
+	"github.com/apache/arrow/go/v18/arrow/array"
+	"github.com/apache/arrow/go/v18/arrow/memory"
+)
+
+// ValidationMode selects the contract checks a Server applies around calls
+type ValidationMode uint8
+
+const (
+	// ValidateInput checks call inputs against RegisteredFunction.InputSchema
+	// before the handler runs (see RegisteredFunction.ValidateInput)
+	ValidateInput ValidationMode = 1 << iota
+
+	// ValidateOutput checks handler results against
+	// RegisteredFunction.OutputSchema before they are sent
+	// (see RegisteredFunction.ValidateOutput)
+	ValidateOutput
+)
+
+// WithValidation enables the given contract checks
+func WithValidation(mode ValidationMode) ServerOption {
+	return func(s *Server) {
+		s.validation = mode
+	}
+}
+
+// ValidateInput checks input against the function's InputSchema and returns
+// a record laid out exactly as declared: one column per argument, in
+// argument order. Columns are matched by name. A missing optional argument
+// becomes an all-null column; any other missing, unexpected, duplicate,
+// mistyped or wrongly null column is reported in one RPCError with
+// CodeInvalidSchema and one detail per offending column.
+//
+// Columns whose type differs from the declaration are converted when no
+// information is lost:
+//   - int32 to float64 or int64 (R integer where a double is declared)
+//   - float64 to int32 or int64 when every value is a whole number in range
+//   - a string dictionary (R factor) to string
+//   - large_string to string and back
+//   - an all-null column to any type
+//
+// Functions with DynamicArgs are returned unchanged.
+//
+// The caller owns the returned record.
+func (fn *RegisteredFunction) ValidateInput(input arrow.Record) (arrow.Record, error) {
+	return fn.validateInput(input, memory.DefaultAllocator)
+}
+
+// validateInput is ValidateInput allocating converted columns with mem. An
+// allocation over the limit of a LimitedAllocator is returned as its error.
+func (fn *RegisteredFunction) validateInput(input arrow.Record, mem memory.Allocator) (_ arrow.Record, err error) {
+	defer recoverLimit(&err)
+	if fn.Signature.DynamicArgs {
+		input.Retain()
+		return input, nil
+	}
+
+	schema := fn.InputSchema
+	byName := make(map[string]int, input.NumCols())
+	duplicates := make(map[string]bool)
+	for i, f := range input.Schema().Fields() {
+		if _, ok := byName[f.Name]; ok {
+			duplicates[f.Name] = true
+		}
+		byName[f.Name] = i
+	}
+
+	rpcErr := NewError(CodeInvalidSchema, "")
+	fields := make([]arrow.Field, schema.NumFields())
+	cols := make([]arrow.Array, schema.NumFields())
+	defer func() {
+		for _, c := range cols {
+			if c != nil {
+				c.Release()
+			}
+		}
+	}()
+
+	for i, want := range schema.Fields() {
+		fields[i] = want
+		idx, ok := byName[want.Name]
+		if !ok {
+			if fn.Signature.Args[i].Optional {
+				cols[i] = array.MakeArrayOfNull(mem, want.Type, int(input.NumRows()))
+				continue
+			}
+			rpcErr.WithDetail(want.Name, "missing column")
+			continue
+		}
+		delete(byName, want.Name)
+		if duplicates[want.Name] {
+			continue
+		}
+
+		col, err := coerceColumn(input.Column(idx), want.Type, mem)
+		if err != nil {
+			rpcErr.WithDetail(want.Name, err.Error())
+			continue
+		}
+		if !want.Nullable && col.NullN() > 0 {
+			rpcErr.WithDetail(want.Name, fmt.Sprintf("%d null values but the argument is not nullable", col.NullN()))
+			col.Release()
+			continue
+		}
+		if err := checkLevels(col, want); err != nil {
+			rpcErr.WithDetail(want.Name, err.Error())
+			col.Release()
+			continue
+		}
+		// Compatible types may still differ in nested nullability or time zone
+		fields[i].Type = col.DataType()
+		fields[i].Metadata = input.Schema().Field(idx).Metadata
+		cols[i] = col
+	}
+	for name := range byName {
+		rpcErr.WithDetail(name, "unexpected column")
+	}
+	for name := range duplicates {
+		rpcErr.WithDetail(name, "duplicate column")
+	}
+
+	if len(rpcErr.Details) > 0 {
+		rpcErr.Message = fmt.Sprintf("input does not match the signature of %s: %s", fn.Name, formatDetails(rpcErr.Details))
+		return nil, rpcErr
+	}
+
+	md := input.Schema().Metadata()
+	return array.NewRecord(arrow.NewSchema(fields, &md), cols, input.NumRows()), nil
+}
+
+// ValidateOutput checks a handler result against the function's
+// OutputSchema. A TypeRecord return must have exactly the declared columns,
+// in order; any other return must be a single column of the declared type,
+// under any name. Non-nullable columns must not contain nulls. TypeDynamic
+// returns are not checked.
+//
+// A mismatch is a bug in the handler, not in the request: it is reported as
+// an RPCError with CodeOutputMismatch and one detail per offending column.
+func (fn *RegisteredFunction) ValidateOutput(result arrow.Record) error {
+	schema := fn.OutputSchema
+	if schema == nil {
+		return nil
+	}
+
+	rpcErr := NewError(CodeOutputMismatch, "")
+	record := fn.Signature.ReturnType.Type == TypeRecord
+	if !record && result.NumCols() != 1 {
+		rpcErr.WithDetail("columns", fmt.Sprintf("expected 1 column, got %d", result.NumCols()))
+	}
+
+	got := result.Schema()
+	for i, want := range schema.Fields() {
+		if i >= got.NumFields() {
+			rpcErr.WithDetail(want.Name, "missing column")
+			continue
+		}
+		name := got.Field(i).Name
+		if record && name != want.Name {
+			rpcErr.WithDetail(want.Name, fmt.Sprintf("column %d is named %q", i+1, name))
+			continue
+		}
+		col := result.Column(i)
+		if !typesCompatible(col.DataType(), want.Type) {
+			rpcErr.WithDetail(name, fmt.Sprintf("expected %s, got %s", want.Type, col.DataType()))
+			continue
+		}
+		if !want.Nullable && col.NullN() > 0 {
+			rpcErr.WithDetail(name, fmt.Sprintf("%d null values but the return type is not nullable", col.NullN()))
+			continue
+		}
+		if err := checkLevels(col, want); err != nil {
+			rpcErr.WithDetail(name, err.Error())
+		}
+	}
+	if record {
+		for _, f := range got.Fields()[min(schema.NumFields(), got.NumFields()):] {
+			rpcErr.WithDetail(f.Name, "unexpected column")
+		}
+	}
+
+	if len(rpcErr.Details) > 0 {
+		rpcErr.Message = fmt.Sprintf("%s returned output that does not match its declared return type: %s", fn.Name, formatDetails(rpcErr.Details))
+		return rpcErr
+	}
+	return nil
+}
+
+// formatDetails renders details as "k: v; k: v" in key order
+func formatDetails(details map[string]string) string {
+	parts := make([]string, 0, len(details))
+	for _, k := range sortedKeys(details) {
+		parts = append(parts, k+": "+details[k])
+	}
+	return strings.Join(parts, "; ")
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// typesCompatible compares data types like arrow.TypeEqual, but ignores the
+// nullability of nested fields: R always marks struct and list children as
+// nullable while declared types default to non-nullable. A timestamp
+// declared without a time zone accepts any time zone.
+func typesCompatible(got, want arrow.DataType) bool {
+	if got.ID() != want.ID() {
+		return false
+	}
+	switch w := want.(type) {
+	case *arrow.StructType:
+		g := got.(*arrow.StructType)
+		if g.NumFields() != w.NumFields() {
+			return false
+		}
+		for i := 0; i < w.NumFields(); i++ {
+			if g.Field(i).Name != w.Field(i).Name || !typesCompatible(g.Field(i).Type, w.Field(i).Type) {
+				return false
+			}
+		}
+		return true
+	case *arrow.ListType:
+		return typesCompatible(got.(*arrow.ListType).Elem(), w.Elem())
+	case *arrow.FixedSizeListType:
+		g := got.(*arrow.FixedSizeListType)
+		return g.Len() == w.Len() && typesCompatible(g.Elem(), w.Elem())
+	case *arrow.TimestampType:
+		g := got.(*arrow.TimestampType)
+		return g.Unit == w.Unit && (w.TimeZone == "" || g.TimeZone == w.TimeZone)
+	default:
+		return arrow.TypeEqual(got, want)
+	}
+}
+
+// checkLevels checks that the values of a dictionary column are among the
+// levels declared for field (see typeMetadata)
+func checkLevels(col arrow.Array, field arrow.Field) error {
+	raw, ok := field.Metadata.GetValue(levelsKey)
+	dict, isDict := col.(*array.Dictionary)
+	if !ok || !isDict {
+		return nil
+	}
+	var levels []string
+	if err := json.Unmarshal([]byte(raw), &levels); err != nil {
+		return fmt.Errorf("invalid declared levels: %w", err)
+	}
+	allowed := make(map[string]bool, len(levels))
+	for _, l := range levels {
+		allowed[l] = true
+	}
+
+	values, ok := dict.Dictionary().(*array.String)
+	if !ok {
+		return fmt.Errorf("dictionary values are %s, not strings", dict.Dictionary().DataType())
+	}
+	for i := 0; i < dict.Len(); i++ {
+		if dict.IsNull(i) {
+			continue
+		}
+		if v := values.Value(dict.GetValueIndex(i)); !allowed[v] {
+			return fmt.Errorf("value %q at row %d is not one of the levels %s", v, i+1, raw)
+		}
+	}
+	return nil
+}
+
+// coerceColumn returns col as type want, converting it with mem when that
+// is safe. The caller owns the returned array.
+func coerceColumn(col arrow.Array, want arrow.DataType, mem memory.Allocator) (arrow.Array, error) {
+	got := col.DataType()
+	if typesCompatible(got, want) {
+		col.Retain()
+		return col, nil
+	}
+
+	if col.NullN() == col.Len() {
+		return array.MakeArrayOfNull(mem, want, col.Len()), nil
+	}
+
+	mismatch := fmt.Errorf("expected %s, got %s", want, got)
+	switch want.ID() {
+	case arrow.FLOAT64:
+		if c, ok := col.(*array.Int32); ok {
+			b := array.NewFloat64Builder(mem)
+			defer b.Release()
+			for i := 0; i < c.Len(); i++ {
+				if c.IsNull(i) {
+					b.AppendNull()
+				} else {
+					b.Append(float64(c.Value(i)))
+				}
+			}
+			return b.NewArray(), nil
+		}
+
+	case arrow.INT32:
+		if c, ok := col.(*array.Float64); ok {
+			b := array.NewInt32Builder(mem)
+			defer b.Release()
+			for i := 0; i < c.Len(); i++ {
+				if c.IsNull(i) {
+					b.AppendNull()
+					continue
+				}
+				v := c.Value(i)
+				if v != math.Trunc(v) || v < math.MinInt32 || v > math.MaxInt32 {
+					return nil, fmt.Errorf("%s; value %v at row %d is not a 32-bit integer", mismatch, v, i+1)
+				}
+				b.Append(int32(v))
+			}
+			return b.NewArray(), nil
+		}
+
+	case arrow.INT64:
+		b := array.NewInt64Builder(mem)
+		defer b.Release()
+		switch c := col.(type) {
+		case *array.Int32:
+			for i := 0; i < c.Len(); i++ {
+				if c.IsNull(i) {
+					b.AppendNull()
+				} else {
+					b.Append(int64(c.Value(i)))
+				}
+			}
+			return b.NewArray(), nil
+		case *array.Float64:
+			for i := 0; i < c.Len(); i++ {
+				if c.IsNull(i) {
+					b.AppendNull()
+					continue
+				}
+				// 2^63 itself is representable as a float64 but not as an int64
+				v := c.Value(i)
+				if v != math.Trunc(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+					return nil, fmt.Errorf("%s; value %v at row %d is not a 64-bit integer", mismatch, v, i+1)
+				}
+				b.Append(int64(v))
+			}
+			return b.NewArray(), nil
+		}
+
+	case arrow.STRING, arrow.LARGE_STRING:
+		var value func(i int) string
+		switch c := col.(type) {
+		case *array.String:
+			value = c.Value
+		case *array.LargeString:
+			value = c.Value
+		case *array.Dictionary:
+			if dict, ok := c.Dictionary().(*array.String); ok {
+				value = func(i int) string { return dict.Value(c.GetValueIndex(i)) }
+			}
+		}
+		if value == nil {
+			break
+		}
+		b := array.NewBuilder(mem, want)
+		defer b.Release()
+		for i := 0; i < col.Len(); i++ {
+			if col.IsNull(i) {
+				b.AppendNull()
+				continue
+			}
+			switch sb := b.(type) {
+			case *array.StringBuilder:
+				sb.Append(value(i))
+			case *array.LargeStringBuilder:
+				sb.Append(value(i))
+			}
+		}
+		return b.NewArray(), nil
+	}
+
+	return nil, mismatch
+}
+
+// validatingReader applies ValidateInput to every batch of a reader. Its
+// schema is that of the validated batches, which may differ from the
+// declared input schema in time zones, nested nullability and metadata; it
+// reads the first batch ahead when asked before any. DynamicArgs functions
+// get the schema of the input.
+type validatingReader struct {
+	array.RecordReader
+	fn     *RegisteredFunction
+	mem    memory.Allocator
+	cur    arrow.Record
+	err    error
+	schema *arrow.Schema
+	read   bool // a batch has been read from the input
+	peeked bool // cur was read ahead by Schema and not returned by Next yet
+}
+
+func (r *validatingReader) Schema() *arrow.Schema {
+	if r.fn.Signature.DynamicArgs {
+		return r.RecordReader.Schema()
+	}
+	if !r.read {
+		r.peeked = r.advance()
+	}
+	if r.schema != nil {
+		return r.schema
+	}
+	return r.fn.InputSchema
+}
+
+func (r *validatingReader) Next() bool {
+	if r.peeked {
+		r.peeked = false
+		return true
+	}
+	return r.advance()
+}
+
+// advance replaces cur with the next validated batch
+func (r *validatingReader) advance() bool {
+	r.read = true
+	if r.cur != nil {
+		r.cur.Release()
+		r.cur = nil
+	}
+	if r.err != nil || !r.RecordReader.Next() {
+		return false
+	}
+	r.cur, r.err = r.fn.validateInput(r.RecordReader.Record(), r.mem)
+	if r.err != nil {
+		return false
+	}
+	if r.schema == nil {
+		r.schema = r.cur.Schema()
+	}
+	return true
+}
+
+func (r *validatingReader) Record() arrow.Record {
+	return r.cur
+}
+
+func (r *validatingReader) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.RecordReader.Err()
+}
+
+func (r *validatingReader) Release() {
+	if r.cur != nil {
+		r.cur.Release()
+		r.cur = nil
+	}
+	r.RecordReader.Release()
+}
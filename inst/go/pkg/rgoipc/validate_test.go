@@ -0,0 +1,294 @@
+package rgoipc_test
+
+import (
+	"errors"
+	"testing"
+
+	"mangoro.local/pkg/rgoipc"
+
+	"github.com/apache/arrow/go/v18/arrow"
+	"github.com/apache/arrow/go/v18/arrow/array"
+	"github.com/apache/arrow/go/v18/arrow/memory"
+)
+
+func registerValidated(t *testing.T, args ...rgoipc.ArgSpec) *rgoipc.RegisteredFunction {
+	t.Helper()
+
+	registry := rgoipc.NewRegistry()
+	err := registry.Register("f", testAddHandler, rgoipc.FunctionSignature{
+		Args:       args,
+		ReturnType: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64},
+	})
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	fn, _ := registry.Get("f")
+	return fn
+}
+
+func TestValidateInputCoercesRInteger(t *testing.T) {
+	fn := registerValidated(t,
+		rgoipc.ArgSpec{Name: "x", Type: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64, Nullable: true}},
+		rgoipc.ArgSpec{Name: "n", Type: rgoipc.TypeSpec{Type: rgoipc.TypeInt32}},
+		rgoipc.ArgSpec{Name: "label", Type: rgoipc.TypeSpec{Type: rgoipc.TypeString}, Optional: true},
+	)
+
+	pool := memory.NewGoAllocator()
+	xb := array.NewInt32Builder(pool)
+	xb.AppendValues([]int32{1, 2}, []bool{true, false})
+	x := xb.NewArray()
+	defer x.Release()
+	nb := array.NewFloat64Builder(pool)
+	nb.AppendValues([]float64{3, 4}, nil)
+	n := nb.NewArray()
+	defer n.Release()
+
+	// Columns in a different order than declared, optional "label" absent
+	input := array.NewRecord(arrow.NewSchema([]arrow.Field{
+		{Name: "n", Type: arrow.PrimitiveTypes.Float64},
+		{Name: "x", Type: arrow.PrimitiveTypes.Int32, Nullable: true},
+	}, nil), []arrow.Array{n, x}, 2)
+	defer input.Release()
+
+	out, err := fn.ValidateInput(input)
+	if err != nil {
+		t.Fatalf("ValidateInput: %v", err)
+	}
+	defer out.Release()
+
+	if !out.Schema().Equal(fn.InputSchema) {
+		t.Errorf("validated schema %s, want %s", out.Schema(), fn.InputSchema)
+	}
+	xs := out.Column(0).(*array.Float64)
+	if xs.Value(0) != 1 || !xs.IsNull(1) {
+		t.Errorf("x not coerced to float64 with nulls kept")
+	}
+	if got := out.Column(1).(*array.Int32).Int32Values(); got[0] != 3 || got[1] != 4 {
+		t.Errorf("n not coerced to int32: %v", got)
+	}
+	if out.Column(2).NullN() != 2 {
+		t.Errorf("missing optional arg should be all null")
+	}
+}
+
+func TestValidateInputReportsEveryColumn(t *testing.T) {
+	fn := registerValidated(t,
+		rgoipc.ArgSpec{Name: "x", Type: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64}},
+		rgoipc.ArgSpec{Name: "n", Type: rgoipc.TypeSpec{Type: rgoipc.TypeInt32}},
+		rgoipc.ArgSpec{Name: "s", Type: rgoipc.TypeSpec{Type: rgoipc.TypeString}},
+	)
+
+	pool := memory.NewGoAllocator()
+	xb := array.NewFloat64Builder(pool)
+	xb.AppendValues([]float64{1, 2}, []bool{true, false})
+	x := xb.NewArray()
+	defer x.Release()
+	nb := array.NewFloat64Builder(pool)
+	nb.AppendValues([]float64{1.5, 2}, nil)
+	n := nb.NewArray()
+	defer n.Release()
+	extra := array.MakeArrayOfNull(pool, arrow.FixedWidthTypes.Boolean, 2)
+	defer extra.Release()
+
+	input := array.NewRecord(arrow.NewSchema([]arrow.Field{
+		{Name: "x", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
+		{Name: "n", Type: arrow.PrimitiveTypes.Float64},
+		{Name: "dummy", Type: arrow.FixedWidthTypes.Boolean, Nullable: true},
+	}, nil), []arrow.Array{x, n, extra}, 2)
+	defer input.Release()
+
+	_, err := fn.ValidateInput(input)
+	var rpcErr *rgoipc.RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != rgoipc.CodeInvalidSchema {
+		t.Fatalf("expected invalid_schema RPCError, got %v", err)
+	}
+	for _, col := range []string{"x", "n", "s", "dummy"} {
+		if rpcErr.Details[col] == "" {
+			t.Errorf("no detail for column %s in %q", col, rpcErr.Message)
+		}
+	}
+}
+
+func TestValidateInputRejectsDuplicateColumns(t *testing.T) {
+	fn := registerValidated(t,
+		rgoipc.ArgSpec{Name: "x", Type: rgoipc.TypeSpec{Type: rgoipc.TypeFloat64}},
+	)
+
+	// The second x is not a double, and would go unchecked if the first
+	// one shadowed it
+	input := stringRecord("x", "x")
+	defer input.Release()
+	_, err := fn.ValidateInput(input)
+	var rpcErr *rgoipc.RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Details["x"] != "duplicate column" {
+		t.Fatalf("expected a duplicate column error, got %v", err)
+	}
+}
+
+func TestValidateInputFactorToString(t *testing.T) {
+	fn := registerValidated(t, rgoipc.ArgSpec{Name: "s", Type: rgoipc.TypeSpec{Type: rgoipc.TypeString}})
+
+	pool := memory.NewGoAllocator()
+	dt := &arrow.DictionaryType{IndexType: arrow.PrimitiveTypes.Int32, ValueType: arrow.BinaryTypes.String}
+	db := array.NewDictionaryBuilder(pool, dt).(*array.BinaryDictionaryBuilder)
+	defer db.Release()
+	db.AppendString("b")
+	db.AppendString("a")
+	db.AppendString("b")
+	factor := db.NewArray()
+	defer factor.Release()
+
+	input := array.NewRecord(arrow.NewSchema([]arrow.Field{{Name: "s", Type: dt}}, nil), []arrow.Array{factor}, 3)
+	defer input.Release()
+
+	out, err := fn.ValidateInput(input)
+	if err != nil {
+		t.Fatalf("ValidateInput: %v", err)
+	}
+	defer out.Release()
+	s := out.Column(0).(*array.String)
+	if s.Value(0) != "b" || s.Value(1) != "a" || s.Value(2) != "b" {
+		t.Errorf("factor decoded wrongly: %v", s)
+	}
+}
+
+func stringRecord(names ...string) arrow.Record {
+	pool := memory.NewGoAllocator()
+	fields := make([]arrow.Field, len(names))
+	cols := make([]arrow.Array, len(names))
+	for i, name := range names {
+		b := array.NewStringBuilder(pool)
+		b.Append(name)
+		cols[i] = b.NewArray()
+		defer cols[i].Release()
+		b.Release()
+		fields[i] = arrow.Field{Name: name, Type: arrow.BinaryTypes.String}
+	}
+	return array.NewRecord(arrow.NewSchema(fields, nil), cols, 1)
+}
+
+func TestValidateOutput(t *testing.T) {
+	recordType := rgoipc.TypeSpec{
+		Type: rgoipc.TypeRecord,
+		StructDef: &rgoipc.StructDef{
+			Fields: []rgoipc.FieldDef{
+				{Name: "status", Type: rgoipc.TypeSpec{Type: rgoipc.TypeString}},
+				{Name: "message", Type: rgoipc.TypeSpec{Type: rgoipc.TypeString}},
+			},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		ret     rgoipc.TypeSpec
+		columns []string
+		details []string // offending columns, none if valid
+	}{
+		{"record", recordType, []string{"status", "message"}, nil},
+		{"record renamed", recordType, []string{"status", "msg"}, []string{"message"}},
+		{"record extra", recordType, []string{"status", "message", "code"}, []string{"code"}},
+		{"record short", recordType, []string{"status"}, []string{"message"}},
+		{"scalar any name", rgoipc.TypeSpec{Type: rgoipc.TypeString}, []string{"value"}, nil},
+		{"scalar wide", rgoipc.TypeSpec{Type: rgoipc.TypeString}, []string{"status", "message"}, []string{"columns"}},
+		{"scalar wrong type", rgoipc.TypeSpec{Type: rgoipc.TypeFloat64}, []string{"value"}, []string{"value"}},
+		{"dynamic", rgoipc.TypeSpec{Type: rgoipc.TypeDynamic}, []string{"a", "b", "c"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := rgoipc.NewRegistry()
+			if err := registry.Register("f", testAddHandler, rgoipc.FunctionSignature{ReturnType: tt.ret}); err != nil {
+				t.Fatalf("register: %v", err)
+			}
+			fn, _ := registry.Get("f")
+
+			result := stringRecord(tt.columns...)
+			defer result.Release()
+
+			err := fn.ValidateOutput(result)
+			if tt.details == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			var rpcErr *rgoipc.RPCError
+			if !errors.As(err, &rpcErr) || !errors.Is(err, rgoipc.ErrOutputMismatch) {
+				t.Fatalf("expected output_mismatch RPCError, got %v", err)
+			}
+			if len(rpcErr.Details) != len(tt.details) {
+				t.Errorf("details %v, want keys %v", rpcErr.Details, tt.details)
+			}
+			for _, col := range tt.details {
+				if rpcErr.Details[col] == "" {
+					t.Errorf("no detail for %s in %q", col, rpcErr.Message)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateInputTypedVectors(t *testing.T) {
+	fn := registerValidated(t,
+		rgoipc.ArgSpec{Name: "when", Type: rgoipc.TypeSpec{Type: rgoipc.TypeTimestamp, Unit: arrow.Microsecond}},
+		rgoipc.ArgSpec{Name: "size", Type: rgoipc.TypeSpec{Type: rgoipc.TypeDictionary, Levels: []string{"S", "M", "L"}}},
+		rgoipc.ArgSpec{Name: "person", Type: rgoipc.TypeSpec{Type: rgoipc.TypeStruct, StructDef: &rgoipc.StructDef{
+			Fields: []rgoipc.FieldDef{{Name: "name", Type: rgoipc.TypeSpec{Type: rgoipc.TypeString}}},
+		}}},
+	)
+
+	pool := memory.NewGoAllocator()
+	// POSIXct with a time zone, accepted because none is declared
+	tsType := &arrow.TimestampType{Unit: arrow.Microsecond, TimeZone: "America/New_York"}
+	tb := array.NewTimestampBuilder(pool, tsType)
+	tb.AppendValues([]arrow.Timestamp{0, 1}, nil)
+	when := tb.NewArray()
+	defer when.Release()
+
+	dt := &arrow.DictionaryType{IndexType: arrow.PrimitiveTypes.Int32, ValueType: arrow.BinaryTypes.String}
+	newFactor := func(values ...string) arrow.Array {
+		db := array.NewDictionaryBuilder(pool, dt).(*array.BinaryDictionaryBuilder)
+		defer db.Release()
+		for _, v := range values {
+			db.AppendString(v)
+		}
+		return db.NewArray()
+	}
+	size := newFactor("M", "L")
+	defer size.Release()
+	badSize := newFactor("M", "XL")
+	defer badSize.Release()
+
+	// R marks struct children nullable; the declaration does not
+	st := arrow.StructOf(arrow.Field{Name: "name", Type: arrow.BinaryTypes.String, Nullable: true})
+	sb := array.NewStructBuilder(pool, st)
+	for _, name := range []string{"a", "b"} {
+		sb.Append(true)
+		sb.FieldBuilder(0).(*array.StringBuilder).Append(name)
+	}
+	person := sb.NewArray()
+	sb.Release()
+	defer person.Release()
+
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "when", Type: tsType},
+		{Name: "size", Type: dt},
+		{Name: "person", Type: st},
+	}, nil)
+
+	input := array.NewRecord(schema, []arrow.Array{when, size, person}, 2)
+	defer input.Release()
+	out, err := fn.ValidateInput(input)
+	if err != nil {
+		t.Fatalf("ValidateInput: %v", err)
+	}
+	out.Release()
+
+	bad := array.NewRecord(schema, []arrow.Array{when, badSize, person}, 2)
+	defer bad.Release()
+	_, err = fn.ValidateInput(bad)
+	var rpcErr *rgoipc.RPCError
+	if !errors.As(err, &rpcErr) || len(rpcErr.Details) != 1 || rpcErr.Details["size"] == "" {
+		t.Fatalf("expected a levels error for size, got %v", err)
+	}
+}
@@ -14,6 +14,7 @@ import (
 	_ "go.nanomsg.org/mangos/v3/protocol/star"
 	_ "go.nanomsg.org/mangos/v3/protocol/sub"
 	_ "go.nanomsg.org/mangos/v3/protocol/surveyor"
+	_ "go.nanomsg.org/mangos/v3/protocol/xrep"
 
 	// Transports
 	_ "go.nanomsg.org/mangos/v3/transport/inproc"